@@ -0,0 +1,186 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! On-disk caches of collected commits, used to avoid walking history again.
+//!
+//! Several ggl may run at the same time, e.g. from cron while someone runs it
+//! by hand.  Files are replaced in one go with [`write_atomically`], and
+//! [`lock`] makes them take turns where that isn't enough.
+
+use crate::collect::{CommitSet, Timeline};
+use crate::debug;
+use crate::error::GglError;
+use serde::{Deserialize, Serialize};
+use std::fs;
+use std::io::{Read, Seek, SeekFrom, Write};
+use std::path::{Path, PathBuf};
+use std::process;
+
+/// The timeline as last collected by `ggl daemon`.  `until` is the cutoff
+/// that was used, in seconds since the epoch.
+#[derive(Serialize, Deserialize)]
+struct TimelineCache {
+    until: i64,
+    timeline: Timeline,
+}
+
+pub(crate) fn cache_dir() -> Result<PathBuf, GglError> {
+    match dirs::cache_dir() {
+        Some(path) => Ok(path.join("ggl")),
+        None => Err(GglError::CacheError(
+            "can't find a cache directory".to_string(),
+        )),
+    }
+}
+
+/// The commit sets of a single repository from the last run.  `head` is the
+/// commit we started walking from, and `key` identifies the configuration
+/// that the sets were collected with.
+#[derive(Serialize, Deserialize)]
+pub struct RepoCache {
+    pub key: String,
+    pub head: String,
+    pub until: i64,
+    pub sets: Vec<CommitSet>,
+}
+
+/// Replace the file at `path` with `contents`, through a temporary file of our
+/// own, so that readers and other writers never see half of it.
+pub(crate) fn write_atomically(path: &Path, contents: &[u8]) -> Result<(), GglError> {
+    let mut tmp = path.as_os_str().to_owned();
+    tmp.push(format!(".{}.tmp", process::id()));
+    fs::write(&tmp, contents)?;
+    fs::rename(&tmp, path)?;
+    Ok(())
+}
+
+/// An exclusive lock on a file in the cache directory, held until it's
+/// dropped.  The file can say how what the lock was taken for went, for the
+/// ggl that takes it next.
+pub struct Lock {
+    file: fs::File,
+}
+
+impl Lock {
+    /// What the last holder of the lock left in its file.
+    pub fn read(&mut self) -> Result<String, GglError> {
+        let mut contents = String::new();
+        self.file.seek(SeekFrom::Start(0))?;
+        self.file.read_to_string(&mut contents)?;
+        Ok(contents)
+    }
+
+    /// Replace what's in the file of the lock.
+    pub fn write(&mut self, contents: &str) -> Result<(), GglError> {
+        self.file.set_len(0)?;
+        self.file.seek(SeekFrom::Start(0))?;
+        self.file.write_all(contents.as_bytes())?;
+        Ok(())
+    }
+}
+
+/// Take the lock called `name`, waiting for the ggl that holds it first if
+/// there is one.  Also says whether we had to wait, i.e. whether another ggl
+/// was just doing what the lock is for.
+pub fn lock(name: &str) -> Result<(Lock, bool), GglError> {
+    let dir = cache_dir()?.join("locks");
+    fs::create_dir_all(&dir)?;
+    let file_name = format!("{}.lock", name.replace(std::path::MAIN_SEPARATOR, "_"));
+    let file = fs::OpenOptions::new()
+        .create(true)
+        .read(true)
+        .write(true)
+        .open(dir.join(file_name))?;
+
+    let mut waited = false;
+    #[cfg(unix)]
+    {
+        use std::os::unix::io::AsRawFd;
+
+        let fd = file.as_raw_fd();
+        if unsafe { libc::flock(fd, libc::LOCK_EX | libc::LOCK_NB) } != 0 {
+            debug!("Waiting for another ggl to be done with {}", name);
+            waited = true;
+            if unsafe { libc::flock(fd, libc::LOCK_EX) } != 0 {
+                return Err(std::io::Error::last_os_error().into());
+            }
+        }
+    }
+
+    Ok((Lock { file }, waited))
+}
+
+fn repo_path(name: &str) -> Result<PathBuf, GglError> {
+    let file_name = format!("{}.json", name.replace(std::path::MAIN_SEPARATOR, "_"));
+    Ok(cache_dir()?.join("repos").join(file_name))
+}
+
+/// Load the cache of a repository.  A missing or unreadable cache is not an
+/// error; we just walk the repository from scratch.
+pub fn read_repo(name: &str) -> Option<RepoCache> {
+    let contents = fs::read(repo_path(name).ok()?).ok()?;
+    serde_json::from_slice(&contents).ok()
+}
+
+pub fn write_repo(name: &str, cache: &RepoCache) -> Result<(), GglError> {
+    let path = repo_path(name)?;
+    fs::create_dir_all(cache_dir()?.join("repos"))?;
+    write_atomically(&path, &serde_json::to_vec(cache)?)
+}
+
+fn timeline_path() -> Result<PathBuf, GglError> {
+    Ok(cache_dir()?.join("timeline.json"))
+}
+
+/// Store the timeline.
+pub fn write_timeline(timeline: Timeline, until: git2::Time) -> Result<(), GglError> {
+    let path = timeline_path()?;
+    fs::create_dir_all(cache_dir()?)?;
+
+    let cache = TimelineCache {
+        until: until.seconds(),
+        timeline,
+    };
+
+    write_atomically(&path, &serde_json::to_vec(&cache)?)
+}
+
+/// Load the cached timeline, keeping only the entries newer than `until`.
+pub fn read_timeline(until: git2::Time) -> Result<Timeline, GglError> {
+    let path = timeline_path()?;
+    let contents = match fs::read(&path) {
+        Ok(c) => c,
+        Err(_) => {
+            return Err(GglError::CacheError(format!(
+                "no cache at {}; is `ggl daemon` running?",
+                path.display()
+            )))
+        }
+    };
+
+    let mut cache: TimelineCache = serde_json::from_slice(&contents)?;
+
+    if cache.until > until.seconds() {
+        eprintln!("warning: the cache only goes back as far as the daemon's --until");
+    }
+
+    cache
+        .timeline
+        .entries
+        .retain(|entry| entry.date().unix_timestamp() >= until.seconds());
+
+    Ok(cache.timeline)
+}
@@ -0,0 +1,174 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl changelog`: release notes for every repository, between two tags.
+
+use crate::collect::{global_commit, open_repository, repo_url_base, GlobalCommit};
+use crate::config::{Config, RepositoryType};
+use crate::error::GglError;
+use std::io;
+use std::io::Write;
+use std::path::Path;
+
+/// The commits of one repository between two revisions.
+#[derive(Debug)]
+pub struct Changelog {
+    pub repo_name: String,
+    pub from: String,
+    pub to: String,
+    pub commits: Vec<GlobalCommit>,
+}
+
+// Conventional commit types we give their own heading.  Everything else goes
+// under "Other".
+const GROUPS: &[(&str, &str)] = &[("feat", "Features"), ("fix", "Fixes")];
+
+// The tags of the repository, newest first by the date of the commit they
+// point at.
+fn tags_by_date(repo: &git2::Repository) -> Result<Vec<(String, git2::Oid)>, GglError> {
+    let mut tags = vec![];
+    for name in repo.tag_names(None)?.iter().flatten() {
+        let commit = repo
+            .revparse_single(&format!("refs/tags/{}", name))?
+            .peel_to_commit()?;
+        tags.push((name.to_string(), commit.id(), commit.time().seconds()));
+    }
+    tags.sort_by(|a, b| b.2.cmp(&a.2));
+    Ok(tags.into_iter().map(|(name, id, _)| (name, id)).collect())
+}
+
+/// For every repository, collect the commits between `from` and HEAD or, when
+/// `from` isn't given, between the latest two tags.  Repositories without
+/// such a range are skipped with a warning.
+pub fn collect(config: &Config, from: &Option<String>) -> Result<Vec<Changelog>, GglError> {
+    let mut changelogs = vec![];
+
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local)
+        {
+            let repo = open_repository(&Path::new(&block.root).join(&r.path))?;
+
+            let range = match from {
+                Some(tag) => match repo.revparse_single(&format!("refs/tags/{}", tag)) {
+                    Ok(object) => Some((
+                        (tag.clone(), object.peel_to_commit()?.id()),
+                        ("HEAD".to_string(), repo.head()?.peel_to_commit()?.id()),
+                    )),
+                    Err(_) => None,
+                },
+                None => {
+                    let mut tags = tags_by_date(&repo)?.into_iter();
+                    match (tags.next(), tags.next()) {
+                        (Some(to), Some(from)) => Some((from, to)),
+                        _ => None,
+                    }
+                }
+            };
+
+            let ((from_name, from_id), (to_name, to_id)) = match range {
+                Some(range) => range,
+                None => {
+                    eprintln!("warning: no tags to compare in {}, skipping", r.name);
+                    continue;
+                }
+            };
+
+            let url_base = repo_url_base(&repo, r);
+            let mut revwalk = repo.revwalk()?;
+            revwalk.push(to_id)?;
+            revwalk.hide(from_id)?;
+            revwalk.set_sorting(git2::Sort::TOPOLOGICAL)?;
+
+            let mut commits = vec![];
+            for id in revwalk {
+                let commit = repo.find_commit(id?)?;
+                if commit.parent_count() > 1 {
+                    continue;
+                }
+                commits.push(global_commit(&commit, r, &url_base)?);
+            }
+
+            changelogs.push(Changelog {
+                repo_name: r.name.clone(),
+                from: from_name,
+                to: to_name,
+                commits,
+            });
+        }
+    }
+
+    Ok(changelogs)
+}
+
+// The heading a commit goes under, based on its conventional commit type,
+// e.g. "fix(parser): ..." goes under "Fixes".
+fn group(subject: &str) -> &'static str {
+    let kind = subject
+        .split(|c| c == ':' || c == '(' || c == '!')
+        .next()
+        .unwrap_or("");
+    GROUPS
+        .iter()
+        .find(|(prefix, _)| *prefix == kind)
+        .map(|(_, heading)| *heading)
+        .unwrap_or("Other")
+}
+
+/// Write the changelogs as Markdown, one section per repository.
+pub fn write(w: &mut dyn Write, changelogs: &[Changelog]) -> io::Result<()> {
+    let mut headings: Vec<&str> = GROUPS.iter().map(|(_, heading)| *heading).collect();
+    headings.push("Other");
+
+    for changelog in changelogs {
+        writeln!(
+            w,
+            "## {} ({}..{})\n",
+            changelog.repo_name, changelog.from, changelog.to
+        )?;
+
+        if changelog.commits.is_empty() {
+            writeln!(w, "No changes.\n")?;
+            continue;
+        }
+
+        for heading in &headings {
+            let commits: Vec<&GlobalCommit> = changelog
+                .commits
+                .iter()
+                .filter(|c| group(c.message.lines().next().unwrap_or("")) == *heading)
+                .collect();
+
+            if commits.is_empty() {
+                continue;
+            }
+
+            writeln!(w, "### {}\n", heading)?;
+            for commit in commits {
+                let subject = commit.message.lines().next().unwrap_or("");
+                match &commit.url {
+                    Some(url) => writeln!(w, "- {} ([`{}`]({}))", subject, commit.short(), url)?,
+                    None => writeln!(w, "- {} (`{}`)", subject, commit.short())?,
+                }
+            }
+            writeln!(w)?;
+        }
+    }
+
+    Ok(())
+}
@@ -0,0 +1,1819 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Walking the repositories and merging their history into a [`Timeline`].
+
+use crate::cache;
+use crate::config::{self, Config, Fallback, Filter, FilterType, Repository, RepositoryType};
+use crate::error::GglError;
+use crate::files;
+use crate::glob;
+use crate::interrupt;
+use crate::logger;
+use crate::mailmap::Identities;
+use crate::metrics;
+use crate::pattern::Pattern;
+use crate::signature::{self, SignatureStatus};
+use crate::source::{self, Collected, Context, Source};
+use crate::state;
+use crate::tickets;
+use crate::trailer::{self, Trailer};
+use crate::{debug, info};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::fs;
+use std::io::{self, IsTerminal};
+use std::path::{Path, PathBuf};
+use std::process::Command;
+use std::str::FromStr;
+use std::time::{Duration, Instant};
+
+/// A commit together with the name of the repository it came from.
+#[derive(Debug, Serialize, Deserialize, Clone)]
+pub struct GlobalCommit {
+    pub author: String,
+    #[serde(default)]
+    pub email: String,
+    pub date: time::OffsetDateTime,
+    /// Who applied the commit, which differs from the author after a rebase
+    /// or when a maintainer applies a patch.
+    #[serde(default)]
+    pub committer: String,
+    #[serde(default)]
+    pub committer_email: String,
+    pub committer_date: time::OffsetDateTime,
+    pub message: String,
+    pub repo_name: String,
+    pub sha: String,
+    pub url: Option<String>,
+    /// Branches and tags pointing at the commit, like `git log --decorate`.
+    /// Only filled in when collecting with `decorate`.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub refs: Vec<String>,
+    /// Only filled in when collecting with `show_signature`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub signature: Option<SignatureStatus>,
+    /// Other repositories with the same commit, see [`Timeline::dedupe`].
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub also_in: Vec<String>,
+    /// The remote-tracking branches the commit is on, e.g. `upstream/main`.
+    /// Only filled in for repositories with several `remotes`.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub branches: Vec<String>,
+    /// Parsed from the end of the message, e.g. `Reviewed-by`.
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub trailers: Vec<Trailer>,
+    /// The ticket IDs the message mentions, see [`crate::tickets`].
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub tickets: Vec<String>,
+    /// The abbreviated hash, unambiguous within the repository.
+    #[serde(default)]
+    pub short_sha: String,
+    /// From the `authors` in the config.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub team: Option<String>,
+    /// The note in `refs/notes/commits`, like `git log --notes`.  Only filled
+    /// in when collecting with `show_notes`.
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub notes: Option<String>,
+}
+
+/// How long abbreviated hashes are at least, as in git.
+pub const DEFAULT_ABBREV: usize = 7;
+
+impl GlobalCommit {
+    /// The abbreviated hash, or the first [`DEFAULT_ABBREV`] characters of
+    /// the hash for commits that don't have one, e.g. from an old cache.
+    pub fn short(&self) -> &str {
+        if self.short_sha.is_empty() {
+            &self.sha[..DEFAULT_ABBREV.min(self.sha.len())]
+        } else {
+            &self.short_sha
+        }
+    }
+
+    /// The people in the `Co-authored-by` trailers, as name and email.
+    pub fn co_authors(&self) -> Vec<(&str, &str)> {
+        self.trailers
+            .iter()
+            .filter(|t| t.key.eq_ignore_ascii_case("Co-authored-by"))
+            .map(|t| match t.value.rsplit_once('<') {
+                Some((name, email)) => (name.trim(), email.trim_end_matches('>').trim()),
+                None => (t.value.trim(), ""),
+            })
+            .collect()
+    }
+
+    /// The author and the co-authors, as name and email.
+    pub fn authors(&self) -> Vec<(&str, &str)> {
+        let mut authors = vec![(self.author.as_str(), self.email.as_str())];
+        authors.extend(self.co_authors());
+        authors
+    }
+
+    /// Whether the name or email of the author or of a co-author contains
+    /// `needle`, ignoring case.
+    pub fn authored_by(&self, needle: &str) -> bool {
+        let needle = needle.to_lowercase();
+        self.authors().iter().any(|(name, email)| {
+            name.to_lowercase().contains(&needle) || email.to_lowercase().contains(&needle)
+        })
+    }
+
+    /// Whether the author or a co-author, as `Name <email>`, matches
+    /// `pattern`.
+    pub fn author_matches(&self, pattern: &Pattern) -> bool {
+        self.authors()
+            .iter()
+            .any(|(name, email)| pattern.is_match(&format!("{} <{}>", name, email)))
+    }
+
+    /// The repository names of the commit, including `also_in`.
+    pub fn repo_names(&self) -> String {
+        let mut names = vec![self.repo_name.as_str()];
+        names.extend(self.also_in.iter().map(|name| name.as_str()));
+        names.join(", ")
+    }
+}
+
+/// A CommitSet represents a unit of change to a repo.  It's either:
+///
+/// 1.  A single commit committed to your selected branch
+/// 2.  One or more commits introduced to your branch by a merge commit
+///
+/// The purpose of this tool is to find commits that broke things.
+///
+/// Here is how we create these sets:
+///
+/// For every repository, we walk in topological order.
+///
+/// If we see a commit that isn't a merge, we create a set with a single item.
+/// The date is the date of that commit.
+///
+/// If we see a commit that is a merge, we collect commits until we hit the
+/// SHA of the first parent of that commit.  The date is the date of the
+/// merge commit.
+///
+/// These CommitSets are then merged into a Timeline, and printed.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CommitSet {
+    pub date: time::OffsetDateTime,
+    pub commits: Vec<GlobalCommit>,
+}
+
+type CommitSetResult = Result<Vec<CommitSet>, GglError>;
+
+/// An Entry is a single item in the aggregated log.  Everything we show is an
+/// Entry so that different kinds of events from all repositories end up
+/// interleaved in one chronological stream.  New kinds of events are added as
+/// new variants.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub enum Entry {
+    Commits(CommitSet),
+}
+
+impl Entry {
+    pub fn date(&self) -> time::OffsetDateTime {
+        match self {
+            Entry::Commits(set) => set.date,
+        }
+    }
+
+    pub fn commits(&self) -> &[GlobalCommit] {
+        match self {
+            Entry::Commits(set) => &set.commits,
+        }
+    }
+
+    pub fn commits_mut(&mut self) -> &mut Vec<GlobalCommit> {
+        match self {
+            Entry::Commits(set) => &mut set.commits,
+        }
+    }
+
+    pub fn reverse(&mut self) {
+        match self {
+            Entry::Commits(set) => set.commits.reverse(),
+        }
+    }
+}
+
+/// How to order the entries of a [`Timeline`].  The newest entry comes first
+/// unless the timeline is reversed.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum SortOrder {
+    AuthorDate,
+    CommitterDate,
+    /// By repository name, then by author date.
+    Repo,
+}
+
+impl FromStr for SortOrder {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "author-date" => Ok(SortOrder::AuthorDate),
+            "committer-date" => Ok(SortOrder::CommitterDate),
+            "repo" => Ok(SortOrder::Repo),
+            _ => Err(format!("unknown sort order: {}", s)),
+        }
+    }
+}
+
+/// The Timeline is the merged log of all repositories, newest entry first.
+/// `heads` maps each repository to the commit we started walking from.
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct Timeline {
+    pub entries: Vec<Entry>,
+    #[serde(default)]
+    pub heads: HashMap<String, String>,
+}
+
+impl Timeline {
+    /// Merge entries into the timeline.  Entries with the same date keep the
+    /// order in which they were merged.
+    pub fn merge<I: IntoIterator<Item = Entry>>(&mut self, entries: I) {
+        self.entries.extend(entries);
+        self.entries.sort_by(|a, b| b.date().cmp(&a.date()));
+    }
+
+    /// Order the entries.  A merge and the commits it brought in stay together
+    /// as one entry, dated by their newest commit.
+    pub fn sort(&mut self, order: SortOrder) {
+        let author_date = |entry: &Entry| entry.commits().iter().map(|c| c.date).max();
+        let committer_date = |entry: &Entry| entry.commits().iter().map(|c| c.committer_date).max();
+        let repo_name = |entry: &Entry| {
+            entry
+                .commits()
+                .first()
+                .map(|c| c.repo_name.clone())
+                .unwrap_or_default()
+        };
+
+        match order {
+            SortOrder::AuthorDate => self
+                .entries
+                .sort_by(|a, b| author_date(b).cmp(&author_date(a))),
+            SortOrder::CommitterDate => self
+                .entries
+                .sort_by(|a, b| committer_date(b).cmp(&committer_date(a))),
+            SortOrder::Repo => self.entries.sort_by(|a, b| {
+                repo_name(a)
+                    .cmp(&repo_name(b))
+                    .then(b.date().cmp(&a.date()))
+            }),
+        }
+    }
+
+    /// Flip the timeline so that the oldest entry comes first.
+    pub fn reverse(&mut self) {
+        self.entries.reverse();
+        for entry in self.entries.iter_mut() {
+            entry.reverse();
+        }
+    }
+
+    pub fn commits(&self) -> impl Iterator<Item = &GlobalCommit> {
+        self.entries.iter().flat_map(|entry| entry.commits())
+    }
+
+    /// Keep only the commits for which `keep` returns true, and drop the
+    /// entries left empty.
+    pub fn retain<F: FnMut(&GlobalCommit) -> bool>(&mut self, mut keep: F) {
+        for entry in self.entries.iter_mut() {
+            entry.commits_mut().retain(|commit| keep(commit));
+        }
+        self.entries.retain(|entry| !entry.commits().is_empty());
+    }
+
+    /// Keep only the first `n` commits, and drop the entries left empty.
+    /// Says whether that left any commits out.
+    pub fn truncate(&mut self, n: usize) -> bool {
+        let total = self.commits().count();
+        let mut left = n;
+        for entry in self.entries.iter_mut() {
+            let commits = entry.commits_mut();
+            commits.truncate(left);
+            left -= commits.len();
+        }
+        self.entries.retain(|entry| !entry.commits().is_empty());
+        total > n
+    }
+
+    /// Collapse commits that appear in several repositories (forks, mirrors)
+    /// into the first one in the timeline, and list the other repositories
+    /// in its `also_in`.
+    pub fn dedupe(&mut self) {
+        let mut first: HashMap<String, (usize, usize)> = HashMap::new();
+        let mut duplicates: Vec<(usize, usize, String)> = vec![];
+
+        for (i, entry) in self.entries.iter().enumerate() {
+            for (j, commit) in entry.commits().iter().enumerate() {
+                match first.get(&commit.sha) {
+                    Some(&(fi, fj)) => duplicates.push((fi, fj, commit.repo_name.clone())),
+                    None => {
+                        first.insert(commit.sha.clone(), (i, j));
+                    }
+                }
+            }
+        }
+
+        for (i, j, repo_name) in duplicates {
+            let also_in = &mut self.entries[i].commits_mut()[j].also_in;
+            if !also_in.contains(&repo_name) {
+                also_in.push(repo_name);
+            }
+        }
+
+        for (i, entry) in self.entries.iter_mut().enumerate() {
+            let mut j = 0;
+            entry.commits_mut().retain(|commit| {
+                j += 1;
+                first.get(&commit.sha) == Some(&(i, j - 1))
+            });
+        }
+        self.entries.retain(|entry| !entry.commits().is_empty());
+    }
+}
+
+/// Everything that affects how we walk the repositories, apart from the
+/// cutoff date which is computed anew for every collection.
+#[derive(Debug, Clone, Default)]
+pub struct CollectOptions {
+    pub fetch: bool,
+    pub use_cache: bool,
+    pub new_only: bool,
+    pub decorate: bool,
+    pub show_signature: bool,
+    pub show_notes: bool,
+    /// Only keep commits touching files that match one of these globs.
+    pub paths: Vec<String>,
+    /// Only keep commits authored from one of these email domains.
+    pub domains: Vec<String>,
+    /// Only keep commits whose author or a co-author, as `Name <email>`,
+    /// matches one of these.
+    pub authors: Vec<Pattern>,
+    /// Only keep commits whose committer, as `Name <email>`, matches one of
+    /// these.
+    pub committers: Vec<Pattern>,
+    /// Only keep commits that add and delete at least this many lines.
+    pub min_changes: Option<usize>,
+    pub date_source: DateSource,
+    /// Fetch depth for all repositories, instead of the one in the config.
+    pub depth: Option<u32>,
+    /// Remove remote-tracking branches that no longer exist on the remote.
+    pub prune: bool,
+    /// Only walk the repositories with these names; all of them when empty.
+    pub repos: Vec<String>,
+    /// Leave out the repositories whose names match these globs.
+    pub exclude_repos: Vec<String>,
+    /// Walk at most this many commits in every repository, instead of the
+    /// `limit` from the config.  0 means no limit.
+    pub limit: Option<usize>,
+    /// Only follow the first parent of merges in every repository, like
+    /// `first-parent` in the config.
+    pub first_parent: bool,
+    /// Only keep commits with a trailer matching one of these, see
+    /// [`trailer::matches`].
+    pub trailers: Vec<String>,
+    /// The minimum length of abbreviated hashes; [`DEFAULT_ABBREV`] if not set.
+    pub abbrev: Option<usize>,
+    /// Give up on fetching or walking a repository after this many seconds,
+    /// instead of the `timeout` from the config.  0 means no timeout.
+    pub timeout: Option<u64>,
+    /// How many times to try a failed fetch again, instead of the `retries`
+    /// from the config.
+    pub retries: Option<u32>,
+}
+
+/// Which date of a commit decides whether it's within the window, and when
+/// its entry happened.
+#[derive(Debug, Clone, Copy, PartialEq, Default)]
+pub enum DateSource {
+    #[default]
+    Author,
+    Committer,
+}
+
+impl FromStr for DateSource {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "author" => Ok(DateSource::Author),
+            "committer" => Ok(DateSource::Committer),
+            _ => Err(format!("unknown date source: {}", s)),
+        }
+    }
+}
+
+fn git_fetch(
+    repo: &git2::Repository,
+    r: &Repository,
+    opts: &CollectOptions,
+) -> Result<(), GglError> {
+    if !r.fetch {
+        return Ok(());
+    }
+
+    // Don't fetch the same repository as another ggl at the same time, or
+    // right after it did, unless its fetch failed.  It clears the lock file
+    // first, so that one that didn't get to say how it went doesn't count.
+    let (mut lock, waited) = cache::lock(&format!("fetch-{}", r.name))?;
+    if waited && lock.read()? == "ok" {
+        debug!("{} was just fetched by another ggl", r.name);
+        return Ok(());
+    }
+    lock.write("")?;
+
+    let result = git_fetch_with_retries(repo, r, opts);
+    metrics::record_fetch(&r.name, result.is_ok());
+    lock.write(if result.is_ok() { "ok" } else { "failed" })?;
+    result
+}
+
+fn git_fetch_with_retries(
+    repo: &git2::Repository,
+    r: &Repository,
+    opts: &CollectOptions,
+) -> Result<(), GglError> {
+    let branch = resolve_branch(repo, r)?;
+    info!("Fetching {} {}/{}", &r.name, &r.remote, &branch);
+    let prune = opts.prune || r.prune;
+    let timeout = timeout(r, opts);
+    let retries = opts.retries.or(r.retries).unwrap_or(0);
+    let mut attempt = 0;
+
+    loop {
+        let depth = opts.depth.or(r.depth);
+        let result = if depth.is_none() && timeout.is_none() {
+            git_fetch_with_progress(repo, r, &branch, prune)
+        } else {
+            git_fetch_cli(repo, r, &branch, depth, prune, timeout)
+        };
+        match result {
+            Err(e) if attempt < retries && !interrupt::interrupted() => {
+                let wait = Duration::from_secs(1 << attempt.min(6));
+                info!("{}: {}, trying again in {}s", r.name, e, wait.as_secs());
+                interrupt::sleep(wait);
+                attempt += 1;
+            }
+            result => return result,
+        }
+    }
+}
+
+/// Where the branches of the remote are kept: its remote-tracking branches,
+/// or the repository's own branches in a mirror, as made by `ggl sync`.
+pub fn remote_prefix(repo: &git2::Repository, remote: &str) -> String {
+    let mirror = repo
+        .config()
+        .and_then(|config| config.get_bool(&format!("remote.{}.mirror", remote)))
+        .unwrap_or(false);
+    if mirror {
+        "refs/heads/".to_string()
+    } else {
+        format!("refs/remotes/{}/", remote)
+    }
+}
+
+/// The branch to fetch: the one from the config, or the one the remote's HEAD
+/// points at, e.g. refs/remotes/origin/HEAD -> refs/remotes/origin/main.
+pub fn resolve_branch(repo: &git2::Repository, r: &Repository) -> Result<String, GglError> {
+    if let Some(branch) = &r.branch {
+        return Ok(branch.clone());
+    }
+
+    let prefix = remote_prefix(repo, &r.remote);
+    let head = if prefix == "refs/heads/" {
+        "HEAD".to_string()
+    } else {
+        format!("{}HEAD", prefix)
+    };
+    repo.find_reference(&head)
+        .ok()
+        .and_then(|head| {
+            head.symbolic_target()
+                .and_then(|target| target.strip_prefix(&prefix))
+                .map(|branch| branch.to_string())
+        })
+        .ok_or_else(|| {
+            GglError::GitError(format!(
+                "can't tell the default branch of {} in {}; set branch in the config",
+                r.remote, r.name
+            ))
+        })
+}
+
+/// Open the repository checked out at `path`.  This can be a linked worktree
+/// (or a submodule), whose .git is a file pointing into the main repository;
+/// libgit2 follows the pointer, so branches, remotes, and objects are shared
+/// with the main repository while HEAD is the worktree's own.
+pub fn open_repository(path: &Path) -> Result<git2::Repository, GglError> {
+    let dot_git = path.join(".git");
+    if dot_git.is_file() {
+        let contents = fs::read_to_string(&dot_git)?;
+        let gitdir = match contents.trim().strip_prefix("gitdir:") {
+            Some(gitdir) => path.join(gitdir.trim()),
+            None => {
+                return Err(GglError::GitError(format!(
+                    "{} isn't a gitdir pointer",
+                    dot_git.display()
+                )))
+            }
+        };
+
+        // The main repository was moved or deleted, and the worktree wasn't
+        // repaired with `git worktree repair`.
+        if !gitdir.exists() {
+            return Err(GglError::GitError(format!(
+                "{} is a worktree of a repository that's no longer at {}",
+                path.display(),
+                gitdir.display()
+            )));
+        }
+    }
+
+    Ok(git2::Repository::open(path)?)
+}
+
+// How many commits to walk at most in this repository: the --limit or `limit`
+// from the config, where 0 means no limit.  The walk isn't cached with a
+// limit, as it may not reach the cutoff.  --max-count isn't one, since it
+// counts the commits left after the filters, across all repositories.
+fn walk_limit(r: &Repository, opts: &CollectOptions) -> Option<usize> {
+    opts.limit.or(r.limit).filter(|&n| n > 0)
+}
+
+// How long fetching or walking the repository may take.
+pub(crate) fn timeout(r: &Repository, opts: &CollectOptions) -> Option<Duration> {
+    opts.timeout
+        .or(r.timeout)
+        .filter(|&s| s > 0)
+        .map(Duration::from_secs)
+}
+
+// A repository that takes too long is left out, rather than failing the whole
+// run.  None when it was.
+fn skip_timed_out<T>(result: Result<T, GglError>) -> Result<Option<T>, GglError> {
+    match result {
+        Ok(value) => Ok(Some(value)),
+        Err(GglError::TimeoutError(e)) => {
+            eprintln!("warning: {}, leaving it out", e);
+            Ok(None)
+        }
+        Err(e) => Err(e),
+    }
+}
+
+fn timed_out(r: &Repository, what: &str, timeout: Duration) -> GglError {
+    GglError::TimeoutError(format!(
+        "{} {} took longer than {}s",
+        what,
+        r.name,
+        timeout.as_secs()
+    ))
+}
+
+// Whether --repo picked this repository, or didn't pick any, and
+// --exclude-repo didn't leave it out.
+pub(crate) fn selected(r: &Repository, opts: &CollectOptions) -> bool {
+    (opts.repos.is_empty() || opts.repos.contains(&r.name))
+        && !config::excluded(&r.name, &opts.exclude_repos)
+}
+
+/// Fetch every repository in the config, without collecting anything.  A
+/// failed fetch doesn't stop the others; the last error is returned at the
+/// end.
+pub fn fetch_all(config: &Config, opts: &CollectOptions) -> Result<(), GglError> {
+    let mut result = Ok(());
+
+    for block in &config.blocks {
+        for r in block.repositories.iter().filter(|r| selected(r, opts)) {
+            if let Err(e) = source::source(&r.kind).fetch(Path::new(&block.root), r, opts) {
+                result = Err(e);
+            }
+        }
+    }
+
+    result
+}
+
+/// The commit to start walking from.  That's HEAD, unless the config names a
+/// `branch` or lists `remotes`: then it's the remote-tracking branch or, with
+/// `fallback: local`, the local branch or HEAD when there isn't one.
+pub fn resolve_tip(repo: &git2::Repository, r: &Repository) -> Result<git2::Oid, GglError> {
+    if r.branch.is_none() && !r.tracking {
+        let tip = repo.head()?.peel_to_commit()?.id();
+        debug!("{}: walking from HEAD at {}", r.name, tip);
+        return Ok(tip);
+    }
+
+    let remote_tip = resolve_branch(repo, r).and_then(|branch| {
+        repo.find_reference(&format!("{}{}", remote_prefix(repo, &r.remote), branch))
+            .and_then(|reference| reference.peel_to_commit())
+            .map(|commit| commit.id())
+            .map_err(|_| {
+                GglError::GitError(format!(
+                    "can't find {}/{} in {}; fetch it, or set fallback: local",
+                    r.remote, branch, r.name
+                ))
+            })
+    });
+
+    match (remote_tip, &r.fallback) {
+        (Ok(tip), _) => {
+            debug!(
+                "{}: walking from the remote-tracking branch at {}",
+                r.name, tip
+            );
+            Ok(tip)
+        }
+        (Err(e), Some(Fallback::Local)) => {
+            debug!("{}: {}, falling back to the local branch", r.name, e);
+            let local = r
+                .branch
+                .as_ref()
+                .and_then(|branch| repo.find_reference(&format!("refs/heads/{}", branch)).ok());
+            let tip = match local {
+                Some(reference) => reference.peel_to_commit()?.id(),
+                None => repo.head()?.peel_to_commit()?.id(),
+            };
+            debug!("{}: walking from {}", r.name, tip);
+            Ok(tip)
+        }
+        (Err(e), None) => Err(e),
+    }
+}
+
+// Show how far along the fetch is on stderr, so that a big fetch doesn't look
+// like it hung.  Nothing is shown when stderr isn't a terminal.
+fn git_fetch_with_progress(
+    repo: &git2::Repository,
+    r: &Repository,
+    branch: &str,
+    prune: bool,
+) -> Result<(), GglError> {
+    let show = io::stderr().is_terminal() && logger::enabled(logger::Level::Normal);
+    let mut shown = false;
+    let mut last = (0, 0);
+
+    let mut callbacks = git2::RemoteCallbacks::new();
+    callbacks.sideband_progress(|_| !interrupt::interrupted());
+    callbacks.transfer_progress(|stats| {
+        if interrupt::interrupted() {
+            return false;
+        }
+        let progress = (
+            stats.received_objects() * 100 / stats.total_objects().max(1),
+            stats.indexed_deltas() * 100 / stats.total_deltas().max(1),
+        );
+        if show && progress != last {
+            eprint!(
+                "\r  objects {}/{} ({}%), {}, deltas {}/{}",
+                stats.received_objects(),
+                stats.total_objects(),
+                progress.0,
+                format_bytes(stats.received_bytes()),
+                stats.indexed_deltas(),
+                stats.total_deltas()
+            );
+            shown = true;
+            last = progress;
+        }
+        true
+    });
+
+    // Without auto, libgit2 ignores the proxy settings that git would use
+    let mut proxy = git2::ProxyOptions::new();
+    match &r.proxy {
+        Some(url) => proxy.url(url),
+        None => proxy.auto(),
+    };
+
+    let mut fetch_options = git2::FetchOptions::new();
+    fetch_options.remote_callbacks(callbacks);
+    fetch_options.proxy_options(proxy);
+    if prune {
+        fetch_options.prune(git2::FetchPrune::On);
+    }
+    let result = repo
+        .find_remote(&r.remote)?
+        .fetch(&[branch], Some(&mut fetch_options), None);
+
+    drop(fetch_options);
+    if shown {
+        eprintln!();
+    }
+    if interrupt::interrupted() {
+        return Ok(());
+    }
+    Ok(result?)
+}
+
+fn format_bytes(bytes: usize) -> String {
+    match bytes {
+        b if b >= 1 << 30 => format!("{:.2} GiB", b as f64 / (1u64 << 30) as f64),
+        b if b >= 1 << 20 => format!("{:.2} MiB", b as f64 / (1u64 << 20) as f64),
+        b if b >= 1 << 10 => format!("{:.2} KiB", b as f64 / (1u64 << 10) as f64),
+        b => format!("{} B", b),
+    }
+}
+
+// libgit2 can't do shallow fetches, so we leave those to git.  So are fetches
+// with a timeout: libgit2 can only be stopped from its progress callbacks,
+// which a stalled connection never calls, while git can be killed.
+fn git_fetch_cli(
+    repo: &git2::Repository,
+    r: &Repository,
+    branch: &str,
+    depth: Option<u32>,
+    prune: bool,
+    timeout: Option<Duration>,
+) -> Result<(), GglError> {
+    // git shows its own progress on a terminal
+    let mut cmd = Command::new("git");
+    if let Some(proxy) = &r.proxy {
+        cmd.arg("-c").arg(format!("http.proxy={}", proxy));
+    }
+    cmd.arg("--git-dir").arg(repo.path()).arg("fetch");
+    if let Some(depth) = depth {
+        cmd.arg(format!("--depth={}", depth));
+    }
+    if prune {
+        cmd.arg("--prune");
+    }
+    let mut child = cmd.arg(&r.remote).arg(branch).spawn()?;
+    let started = Instant::now();
+    let status = loop {
+        if let Some(status) = child.try_wait()? {
+            break status;
+        }
+        if let Some(timeout) = timeout.filter(|&t| started.elapsed() > t) {
+            let _ = child.kill();
+            let _ = child.wait();
+            return Err(timed_out(r, "fetching", timeout));
+        }
+        std::thread::sleep(Duration::from_millis(100));
+    };
+
+    // git got the Ctrl-C too
+    if interrupt::interrupted() {
+        return Ok(());
+    }
+
+    if !status.success() {
+        return Err(GglError::GitError(format!(
+            "git fetch failed for {}",
+            r.name
+        )));
+    }
+    Ok(())
+}
+
+// Map every commit that a branch or tag points at to the names of those refs.
+// Tags are prefixed with "tag: " the way git does it.
+fn decorations(repo: &git2::Repository) -> Result<HashMap<git2::Oid, Vec<String>>, GglError> {
+    let mut refs: HashMap<git2::Oid, Vec<String>> = HashMap::new();
+
+    for reference in repo.references()? {
+        let reference = reference?;
+        if !(reference.is_branch() || reference.is_remote() || reference.is_tag()) {
+            continue;
+        }
+
+        // Symbolic refs like origin/HEAD, and tags of things other than commits
+        let commit = match reference.peel_to_commit() {
+            Ok(commit) if reference.symbolic_target().is_none() => commit,
+            _ => continue,
+        };
+
+        let name = reference.shorthand().unwrap_or("").to_string();
+        let name = if reference.is_tag() {
+            format!("tag: {}", name)
+        } else {
+            name
+        };
+        refs.entry(commit.id()).or_default().push(name);
+    }
+
+    Ok(refs)
+}
+
+// Fill in the things we look up on every run rather than cache with the
+// commits: refs move, keys can be added to the keyring, notes can be added,
+// and new objects can make an abbreviated hash ambiguous.
+fn annotate(
+    repo: &git2::Repository,
+    sets: &mut [CommitSet],
+    config: &Config,
+    opts: &CollectOptions,
+) -> Result<(), GglError> {
+    let min = opts.abbrev.unwrap_or(DEFAULT_ABBREV);
+    for commit in sets.iter_mut().flat_map(|set| set.commits.iter_mut()) {
+        commit.short_sha = abbreviate(repo, &commit.sha, min);
+    }
+
+    if !opts.decorate && !opts.show_signature && !opts.show_notes {
+        return Ok(());
+    }
+
+    let refs = if opts.decorate {
+        decorations(repo)?
+    } else {
+        HashMap::new()
+    };
+
+    for commit in sets.iter_mut().flat_map(|set| set.commits.iter_mut()) {
+        let id = git2::Oid::from_str(&commit.sha)?;
+        if opts.decorate {
+            commit.refs = refs.get(&id).cloned().unwrap_or_default();
+        }
+        if opts.show_signature {
+            commit.signature = Some(signature::verify(repo, id, config.keyring.as_deref()));
+        }
+        if opts.show_notes {
+            // Most commits have no note
+            commit.notes = repo
+                .find_note(None, id)
+                .ok()
+                .and_then(|note| note.message().map(|m| m.trim_end().to_string()));
+        }
+    }
+
+    Ok(())
+}
+
+// The shortest prefix of `sha`, at least `min` long, that no other object in
+// the repository starts with, like `git log --abbrev`.
+fn abbreviate(repo: &git2::Repository, sha: &str, min: usize) -> String {
+    let mut n = min.clamp(4, sha.len());
+    while n < sha.len() {
+        match repo.revparse_single(&sha[..n]) {
+            Err(e) if e.code() == git2::ErrorCode::Ambiguous => n += 1,
+            _ => break,
+        }
+    }
+    sha[..n].to_string()
+}
+
+// Drop the commits that don't touch any file matching `patterns`, and the
+// sets that end up empty.  Merges are compared to their first parent.
+fn filter_paths(
+    repo: &git2::Repository,
+    sets: Vec<CommitSet>,
+    patterns: &[String],
+) -> CommitSetResult {
+    let mut filtered = vec![];
+
+    for mut set in sets {
+        let mut keep = vec![];
+        for commit in set.commits {
+            let c = repo.find_commit(git2::Oid::from_str(&commit.sha)?)?;
+            let parent_tree = if c.parent_count() > 0 {
+                Some(c.parent(0)?.tree()?)
+            } else {
+                None
+            };
+            let diff = repo.diff_tree_to_tree(parent_tree.as_ref(), Some(&c.tree()?), None)?;
+
+            let touches = diff.deltas().any(|delta| {
+                [delta.old_file().path(), delta.new_file().path()]
+                    .iter()
+                    .flatten()
+                    .filter_map(|path| path.to_str())
+                    .any(|path| patterns.iter().any(|pattern| glob::matches(pattern, path)))
+            });
+
+            if touches {
+                keep.push(commit);
+            }
+        }
+
+        if !keep.is_empty() {
+            set.commits = keep;
+            filtered.push(set);
+        }
+    }
+
+    Ok(filtered)
+}
+
+// Drop the commits that add and delete fewer than `min` lines together, and
+// the sets that end up empty.  Merges are compared to their first parent.
+fn filter_changes(repo: &git2::Repository, sets: Vec<CommitSet>, min: usize) -> CommitSetResult {
+    let mut filtered = vec![];
+
+    for mut set in sets {
+        let mut keep = vec![];
+        for commit in set.commits {
+            let c = repo.find_commit(git2::Oid::from_str(&commit.sha)?)?;
+            let lines: usize = files::changes(repo, &c)?
+                .iter()
+                .map(|change| change.added + change.deleted)
+                .sum();
+            if lines >= min {
+                keep.push(commit);
+            }
+        }
+
+        if !keep.is_empty() {
+            set.commits = keep;
+            filtered.push(set);
+        }
+    }
+
+    Ok(filtered)
+}
+
+// Whether the email address is at one of the domains, or one of their
+// subdomains.
+fn in_domains(email: &str, domains: &[String]) -> bool {
+    let domain = match email.rsplit_once('@') {
+        Some((_, domain)) => domain.to_lowercase(),
+        None => return false,
+    };
+    domains.iter().any(|d| {
+        let d = d.to_lowercase();
+        domain == d || domain.ends_with(&format!(".{}", d))
+    })
+}
+
+fn filter_domains(sets: Vec<CommitSet>, domains: &[String]) -> Vec<CommitSet> {
+    sets.into_iter()
+        .filter_map(|mut set| {
+            set.commits
+                .retain(|commit| in_domains(&commit.email, domains));
+            if set.commits.is_empty() {
+                None
+            } else {
+                Some(set)
+            }
+        })
+        .collect()
+}
+
+// Keep the commits whose date, the one --date-source picks, isn't before
+// `until`.  Forges filter by the committer date, if at all.
+fn filter_since(sets: Vec<CommitSet>, until: git2::Time, source: DateSource) -> Vec<CommitSet> {
+    sets.into_iter()
+        .filter_map(|mut set| {
+            set.commits.retain(|commit| {
+                let date = match source {
+                    DateSource::Author => commit.date,
+                    DateSource::Committer => commit.committer_date,
+                };
+                date.unix_timestamp() >= until.seconds()
+            });
+            if set.commits.is_empty() {
+                None
+            } else {
+                Some(set)
+            }
+        })
+        .collect()
+}
+
+// Keep the commits whose authors and committer match `opts`, if it has
+// patterns for them.  The trailers have to be parsed already, for the
+// co-authors.
+fn filter_people(sets: Vec<CommitSet>, opts: &CollectOptions) -> Vec<CommitSet> {
+    if opts.authors.is_empty() && opts.committers.is_empty() {
+        return sets;
+    }
+
+    sets.into_iter()
+        .filter_map(|mut set| {
+            set.commits.retain(|commit| {
+                let committer = format!("{} <{}>", commit.committer, commit.committer_email);
+                (opts.authors.is_empty() || opts.authors.iter().any(|p| commit.author_matches(p)))
+                    && (opts.committers.is_empty()
+                        || opts.committers.iter().any(|p| p.is_match(&committer)))
+            });
+            if set.commits.is_empty() {
+                None
+            } else {
+                Some(set)
+            }
+        })
+        .collect()
+}
+
+// Parse the trailers of every commit, and keep the commits with a trailer
+// matching one of `filters`, if there are any.
+fn filter_trailers(sets: Vec<CommitSet>, filters: &[String]) -> Vec<CommitSet> {
+    sets.into_iter()
+        .filter_map(|mut set| {
+            for commit in set.commits.iter_mut() {
+                commit.trailers = trailer::parse(&commit.message);
+            }
+            if !filters.is_empty() {
+                set.commits.retain(|commit| {
+                    filters
+                        .iter()
+                        .any(|f| trailer::matches(&commit.trailers, f))
+                });
+            }
+            if set.commits.is_empty() {
+                None
+            } else {
+                Some(set)
+            }
+        })
+        .collect()
+}
+
+fn should_be_included(filters: &Vec<Filter>, changed_files: &Vec<PathBuf>) -> bool {
+    if filters.len() == 0 {
+        return true;
+    }
+    for filter in filters {
+        for filter_path in &filter.paths {
+            for file in changed_files {
+                if file.to_str().unwrap().contains(filter_path) {
+                    match filter.filter_type {
+                        FilterType::Include => {
+                            return true;
+                        }
+                        FilterType::Reject => {
+                            return false;
+                        }
+                    }
+                }
+            }
+        }
+
+        // If we didn't find a match above
+        match filter.filter_type {
+            FilterType::Include => {
+                return false;
+            }
+            FilterType::Reject => {
+                return true;
+            }
+        }
+    }
+
+    // This should never happen :)
+    true
+}
+
+/// Walk every repository in the config back to `until`, and merge the
+/// results into a single timeline.
+pub fn collect_timeline(
+    config: &Config,
+    opts: &CollectOptions,
+    until: git2::Time,
+) -> Result<Timeline, GglError> {
+    let patterns = tickets::patterns(&config.tickets)?;
+    let identities = Identities::load(config)?;
+    let seen = if opts.new_only {
+        state::read_seen()
+    } else {
+        HashMap::new()
+    };
+    let ctx = Context {
+        config,
+        opts,
+        until,
+        identities: &identities,
+        seen: &seen,
+    };
+
+    let mut timeline = Timeline::default();
+    let mut folds = HashMap::new();
+    for block in &config.blocks {
+        for r in block.repositories.iter().filter(|r| selected(r, opts)) {
+            let collected = source::source(&r.kind).collect(&ctx, Path::new(&block.root), r);
+            if let Some(collected) = skip_timed_out(collected)? {
+                timeline.heads.extend(collected.heads);
+                timeline.merge(collected.sets.into_iter().map(Entry::Commits));
+                folds.extend(collected.folds);
+            }
+        }
+    }
+    fold_remotes(&mut timeline, &folds);
+    tickets::annotate(&mut timeline, &patterns);
+    Ok(timeline)
+}
+
+/// Local clones: fetched with `--fetch`, walked from their tip, and cached.
+pub struct Local;
+
+impl Source for Local {
+    fn fetch(&self, root: &Path, r: &Repository, opts: &CollectOptions) -> Result<(), GglError> {
+        let repo = match open_repository(&root.join(&r.path)) {
+            Ok(repo) => repo,
+            Err(e) => {
+                eprintln!("error: {}: {}", r.name, e);
+                return Err(e);
+            }
+        };
+
+        let mut result = Ok(());
+        for view in remote_views(r) {
+            if let Err(e) = git_fetch(&repo, &view, opts) {
+                eprintln!("error: {}: {}", view.name, e);
+                result = Err(e);
+            }
+        }
+        result
+    }
+
+    fn collect(&self, ctx: &Context, root: &Path, r: &Repository) -> Result<Collected, GglError> {
+        let repo_path = root.join(&r.path);
+        let repo = open_repository(&repo_path)?;
+        let mut collected = Collected::default();
+
+        for view in remote_views(r) {
+            if interrupt::interrupted() {
+                return Ok(collected);
+            }
+            if ctx.opts.fetch && skip_timed_out(git_fetch(&repo, &view, ctx.opts))?.is_none() {
+                continue;
+            }
+
+            let head = resolve_tip(&repo, &view)?;
+            // Only record the head once the walk is done, as a walk that timed
+            // out didn't show everything since the last one.
+            if let Some(sets) = skip_timed_out(walk(ctx, &repo, &repo_path, &view, head))? {
+                collected.heads.insert(view.name.clone(), head.to_string());
+                collected.sets.extend(sets);
+            }
+
+            if !r.remotes.is_empty() {
+                let branch = resolve_branch(&repo, &view).unwrap_or_else(|_| "HEAD".into());
+                collected.folds.insert(
+                    view.name.clone(),
+                    (r.name.clone(), format!("{}/{}", view.remote, branch)),
+                );
+            }
+        }
+
+        if !r.include_submodules {
+            return Ok(collected);
+        }
+
+        for submodule in repo.submodules()? {
+            if interrupt::interrupted() {
+                break;
+            }
+            let sub_r = Repository {
+                name: format!("{}/{}", r.name, submodule.name().unwrap_or("")),
+                path: Path::new(&r.path)
+                    .join(submodule.path())
+                    .to_string_lossy()
+                    .to_string(),
+                kind: RepositoryType::Local,
+                url: None,
+                token: None,
+                commit_url: None,
+                clone_url: None,
+                remote: "origin".to_string(),
+                branch: None,
+                remotes: vec![],
+                fetch: r.fetch,
+                depth: r.depth,
+                prune: r.prune,
+                filters: None,
+                domains: r.domains.clone(),
+                fallback: Some(Fallback::Local),
+                include_submodules: false,
+                first_parent: r.first_parent,
+                limit: r.limit,
+                until: r.until.clone(),
+                timeout: r.timeout,
+                retries: r.retries,
+                proxy: r.proxy.clone(),
+                rate_limit: None,
+                schedule: None,
+                // What we fetch is the default branch of its remote
+                tracking: true,
+            };
+
+            let sub_repo = match submodule.open() {
+                Ok(sub_repo) => sub_repo,
+                Err(_) => {
+                    eprintln!("warning: {} isn't checked out, skipping", sub_r.name);
+                    continue;
+                }
+            };
+
+            // With --fetch, walk what we fetched; otherwise the commit the
+            // parent repository records.
+            let sub_head = if ctx.opts.fetch {
+                if skip_timed_out(git_fetch(&sub_repo, &sub_r, ctx.opts))?.is_none() {
+                    continue;
+                }
+                Some(resolve_tip(&sub_repo, &sub_r)?)
+            } else {
+                submodule.head_id().or(submodule.workdir_id())
+            };
+
+            if let Some(sub_head) = sub_head {
+                let sub_path = repo_path.join(submodule.path());
+                let walked = walk(ctx, &sub_repo, &sub_path, &sub_r, sub_head);
+                if let Some(sets) = skip_timed_out(walked)? {
+                    collected
+                        .heads
+                        .insert(sub_r.name.clone(), sub_head.to_string());
+                    collected.sets.extend(sets);
+                }
+            }
+        }
+
+        Ok(collected)
+    }
+}
+
+// Walk a local repository from `head`, or take what the cache or the last
+// --new-only run already covers, and filter and annotate the commits.
+fn walk(
+    ctx: &Context,
+    repo: &git2::Repository,
+    repo_path: &Path,
+    r: &Repository,
+    head: git2::Oid,
+) -> CommitSetResult {
+    let opts = ctx.opts;
+    let started = Instant::now();
+    let until = repo_until(r, ctx.until)?;
+
+    let seen_tip = match ctx.seen.get(&r.name).map(|sha| git2::Oid::from_str(sha)) {
+        Some(Ok(tip)) if tip == head || repo.graph_descendant_of(head, tip)? => Some(tip),
+        _ => None,
+    };
+
+    let mut sets = if seen_tip == Some(head) {
+        vec![]
+    } else if seen_tip.is_some() {
+        collect_commitsets_for_repo(repo, r, head, until, seen_tip, opts)?
+    } else if opts.use_cache && walk_limit(r, opts).is_none() {
+        collect_commitsets_cached(repo, repo_path, r, head, until, opts)?
+    } else {
+        collect_commitsets_for_repo(repo, r, head, until, None, opts)?
+    };
+
+    // The cache keeps the identities as they were committed, so that
+    // changes to the mailmap apply right away.
+    ctx.identities.apply(&mut sets, Some(repo));
+    if !opts.paths.is_empty() {
+        sets = filter_paths(repo, sets, &opts.paths)?;
+    }
+    if let Some(min) = opts.min_changes {
+        sets = filter_changes(repo, sets, min)?;
+    }
+    if !opts.domains.is_empty() {
+        sets = filter_domains(sets, &opts.domains);
+    }
+    if let Some(domains) = &r.domains {
+        sets = filter_domains(sets, domains);
+    }
+    sets = filter_trailers(sets, &opts.trailers);
+    sets = filter_people(sets, opts);
+    annotate(repo, &mut sets, ctx.config, opts)?;
+    debug!(
+        "{}: {} commits in {:.2}s",
+        r.name,
+        sets.iter().map(|set| set.commits.len()).sum::<usize>(),
+        started.elapsed().as_secs_f64()
+    );
+    Ok(sets)
+}
+
+/// The commits of the local repositories as of their last walk, read from
+/// the commit cache alone, without walking the repositories.  Repositories
+/// that were never walked with the cache on are missing, and so are
+/// submodules.
+pub fn cached_timeline(config: &Config, opts: &CollectOptions) -> Result<Timeline, GglError> {
+    let patterns = tickets::patterns(&config.tickets)?;
+    let identities = Identities::load(config)?;
+    let mut timeline = Timeline::default();
+    let mut folds = HashMap::new();
+
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local && selected(r, opts))
+        {
+            for view in remote_views(r) {
+                let cached = match cache::read_repo(&view.name) {
+                    Some(cached) => cached,
+                    None => {
+                        debug!("{}: not in the cache", view.name);
+                        continue;
+                    }
+                };
+
+                timeline.heads.insert(view.name.clone(), cached.head);
+                let mut sets = cached.sets;
+                // Only for its .mailmap; a repository that's gone is fine
+                let repo = git2::Repository::open(Path::new(&block.root).join(&r.path)).ok();
+                identities.apply(&mut sets, repo.as_ref());
+                let sets = filter_trailers(sets, &opts.trailers);
+                let sets = filter_people(sets, opts);
+                timeline.merge(sets.into_iter().map(Entry::Commits));
+
+                if !r.remotes.is_empty() {
+                    let branch = view.name[r.name.len() + 1..].to_string();
+                    folds.insert(view.name.clone(), (r.name.clone(), branch));
+                }
+            }
+        }
+    }
+
+    fold_remotes(&mut timeline, &folds);
+    tickets::annotate(&mut timeline, &patterns);
+    Ok(timeline)
+}
+
+// The repository once for each of its `remotes`, so that every remote-tracking
+// branch is fetched, walked, cached, and remembered by --new-only on its own.
+// The copies are named `name@remote/branch` until `fold_remotes`.  Without
+// `remotes`, it's the repository as it is.
+pub(crate) fn remote_views(r: &Repository) -> Vec<Repository> {
+    if r.remotes.is_empty() {
+        return vec![r.clone()];
+    }
+
+    r.remotes
+        .iter()
+        .map(|remote| Repository {
+            name: match &remote.branch {
+                Some(branch) => format!("{}@{}/{}", r.name, remote.remote, branch),
+                None => format!("{}@{}", r.name, remote.remote),
+            },
+            remote: remote.remote.clone(),
+            branch: remote.branch.clone(),
+            remotes: vec![],
+            tracking: true,
+            ..r.clone()
+        })
+        .collect()
+}
+
+// Give the commits of the `remote_views` their repository's name back, and
+// keep a commit that is on several of its branches only once, like
+// `Timeline::dedupe`.  `folds` maps the name of each view to the repository
+// name and the branch it walked.
+fn fold_remotes(timeline: &mut Timeline, folds: &HashMap<String, (String, String)>) {
+    if folds.is_empty() {
+        return;
+    }
+
+    let mut first: HashMap<(String, String), (usize, usize)> = HashMap::new();
+    let mut duplicates: Vec<(usize, usize, String)> = vec![];
+
+    for (i, entry) in timeline.entries.iter_mut().enumerate() {
+        for (j, commit) in entry.commits_mut().iter_mut().enumerate() {
+            let (repo_name, branch) = match folds.get(&commit.repo_name) {
+                Some(fold) => fold.clone(),
+                None => continue,
+            };
+            commit.repo_name = repo_name;
+
+            match first.get(&(commit.repo_name.clone(), commit.sha.clone())) {
+                Some(&(fi, fj)) => duplicates.push((fi, fj, branch)),
+                None => {
+                    commit.branches.push(branch);
+                    first.insert((commit.repo_name.clone(), commit.sha.clone()), (i, j));
+                }
+            }
+        }
+    }
+
+    if duplicates.is_empty() {
+        return;
+    }
+
+    for (i, j, branch) in duplicates {
+        let branches = &mut timeline.entries[i].commits_mut()[j].branches;
+        if !branches.contains(&branch) {
+            branches.push(branch);
+        }
+    }
+
+    for (i, entry) in timeline.entries.iter_mut().enumerate() {
+        let mut j = 0;
+        entry.commits_mut().retain(|commit| {
+            j += 1;
+            match first.get(&(commit.repo_name.clone(), commit.sha.clone())) {
+                Some(&position) => position == (i, j - 1),
+                None => true,
+            }
+        });
+    }
+    timeline.entries.retain(|entry| !entry.commits().is_empty());
+}
+
+/// Collect a repository we don't have a clone of with `collect`, e.g. from a
+/// forge's API, and filter its commits like those of a walk.  The filters
+/// that need the diff of a commit don't apply here.
+pub(crate) fn collect_remote(
+    ctx: &Context,
+    r: &Repository,
+    collect: fn(&Repository, git2::Time, Option<Duration>) -> CommitSetResult,
+) -> Result<Collected, GglError> {
+    let opts = ctx.opts;
+    let until = repo_until(r, ctx.until)?;
+    let mut sets = collect(r, until, timeout(r, opts))?;
+
+    // There's no repository to tell which abbreviations are ambiguous
+    let abbrev = opts.abbrev.unwrap_or(DEFAULT_ABBREV);
+    for commit in sets.iter_mut().flat_map(|set| set.commits.iter_mut()) {
+        commit.short_sha = commit.sha.chars().take(abbrev.max(4)).collect();
+        if let Some(template) = &r.commit_url {
+            commit.url = Some(template.replace("{hash}", &commit.sha));
+        }
+    }
+
+    sets = filter_since(sets, until, opts.date_source);
+    ctx.identities.apply(&mut sets, None);
+    if !opts.domains.is_empty() {
+        sets = filter_domains(sets, &opts.domains);
+    }
+    if let Some(domains) = &r.domains {
+        sets = filter_domains(sets, domains);
+    }
+    sets = filter_trailers(sets, &opts.trailers);
+    sets = filter_people(sets, opts);
+    if let Some(n) = walk_limit(r, opts) {
+        sets.truncate(n);
+    }
+    Ok(Collected {
+        sets,
+        ..Collected::default()
+    })
+}
+
+// Bumped when the cached commits gain fields that old caches can't fill in,
+// like the committer, so that those are walked again.
+const CACHE_FORMAT: u32 = 2;
+
+// Reuse the commit sets from the last run, and only walk the commits that
+// were added since.  We fall back to a full walk when the cache was made for a
+// different configuration, doesn't go back far enough, or when history was
+// rewritten.
+fn collect_commitsets_cached(
+    repo: &git2::Repository,
+    repo_path: &Path,
+    r: &Repository,
+    head: git2::Oid,
+    until: git2::Time,
+    opts: &CollectOptions,
+) -> CommitSetResult {
+    let key = format!(
+        "{}|{}|{:?}|{:?}|{}|{:?}",
+        CACHE_FORMAT,
+        repo_path.display(),
+        r.filters,
+        opts.date_source,
+        opts.first_parent || r.first_parent,
+        r.commit_url
+    );
+
+    let mut cached_head = None;
+    let mut cached_sets = vec![];
+
+    if let Some(cached) = cache::read_repo(&r.name) {
+        let cached_oid = git2::Oid::from_str(&cached.head)?;
+        let usable = cached.key == key
+            && cached.until <= until.seconds()
+            && (cached_oid == head || repo.graph_descendant_of(head, cached_oid)?);
+
+        if usable {
+            cached_head = Some(cached_oid);
+            cached_sets = cached.sets;
+        }
+    }
+
+    let mut commitsets = if cached_head == Some(head) {
+        vec![]
+    } else {
+        collect_commitsets_for_repo(repo, r, head, until, cached_head, opts)?
+    };
+
+    commitsets.extend(
+        cached_sets
+            .into_iter()
+            .filter(|set| set.date.unix_timestamp() >= until.seconds()),
+    );
+
+    let cached = cache::RepoCache {
+        key,
+        head: head.to_string(),
+        until: until.seconds(),
+        sets: commitsets.clone(),
+    };
+
+    // An interrupted walk is missing commits
+    if interrupt::interrupted() {
+        return Ok(commitsets);
+    }
+    if let Err(e) = cache::write_repo(&r.name, &cached) {
+        eprintln!("warning: can't write the cache for {}: {:?}", r.name, e);
+    }
+
+    Ok(commitsets)
+}
+
+// Walk the repository from `tip` until we reach the cutoff date, `stop_at` and
+// the commits it can reach, or the walk limit.  With first-parent, a merge
+// makes a set of its own, as the commits it brought in aren't walked.  When going by committer
+// date, we walk in committer date order too, so that a rebased commit with an
+// old author date doesn't end the walk early.
+fn collect_commitsets_for_repo(
+    repo: &git2::Repository,
+    r: &Repository,
+    tip: git2::Oid,
+    until: git2::Time,
+    stop_at: Option<git2::Oid>,
+    opts: &CollectOptions,
+) -> CommitSetResult {
+    let mut commitsets: Vec<CommitSet> = vec![];
+    let url_base = repo_url_base(repo, r);
+    let mut revwalk = repo.revwalk()?;
+    revwalk.push(tip)?;
+    if let Some(oid) = stop_at {
+        revwalk.hide(oid)?;
+    }
+    match opts.date_source {
+        DateSource::Author => revwalk.set_sorting(git2::Sort::TOPOLOGICAL)?,
+        DateSource::Committer => revwalk.set_sorting(git2::Sort::TOPOLOGICAL | git2::Sort::TIME)?,
+    }
+    if opts.first_parent || r.first_parent {
+        revwalk.simplify_first_parent()?;
+    }
+    let mut diffopts = git2::DiffOptions::new();
+
+    let mut commit_buffer: Vec<GlobalCommit> = vec![];
+    let mut collecting_commits = false;
+    let mut set_date: time::OffsetDateTime = time::OffsetDateTime::now_utc();
+    let mut destination_commit_id: git2::Oid = git2::Oid::zero();
+    let mut count = 0;
+    let limit = walk_limit(r, opts);
+    let timeout = timeout(r, opts);
+    let started = Instant::now();
+
+    for id in revwalk {
+        if limit.map_or(false, |n| count >= n) {
+            break;
+        }
+        if let Some(timeout) = timeout.filter(|&t| started.elapsed() > t) {
+            return Err(timed_out(r, "walking", timeout));
+        }
+        if interrupt::interrupted() {
+            break;
+        }
+
+        let id = id?;
+        let commit = repo.find_commit(id)?;
+        let commit_date = match opts.date_source {
+            DateSource::Author => commit.author().when(),
+            DateSource::Committer => commit.committer().when(),
+        };
+
+        if commit_date < until {
+            break;
+        }
+
+        let is_merge = commit.parent_count() > 1;
+
+        if !is_merge {
+            if let Some(filters) = &r.filters {
+                let mut changed_files: Vec<PathBuf> = vec![];
+                let current_tree = commit.tree()?;
+
+                let parent_tree = if commit.parent_count() == 1 {
+                    Some(commit.parent(0)?.tree()?)
+                } else {
+                    None
+                };
+
+                let diff = repo.diff_tree_to_tree(
+                    parent_tree.as_ref(),
+                    Some(&current_tree),
+                    Some(&mut diffopts),
+                )?;
+
+                for delta in diff.deltas() {
+                    let new_file = delta.new_file();
+                    changed_files.push(new_file.path().unwrap().to_owned());
+                }
+
+                if !should_be_included(filters, &changed_files) {
+                    continue;
+                }
+            }
+        }
+
+        if collecting_commits && commit.id() == destination_commit_id {
+            let set = CommitSet {
+                date: set_date,
+                commits: commit_buffer.clone(),
+            };
+
+            // reset
+            commit_buffer.clear();
+            collecting_commits = false;
+            commitsets.push(set);
+        }
+
+        let global_commit = global_commit(&commit, r, &url_base)?;
+        count += 1;
+        let commit_date = match opts.date_source {
+            DateSource::Author => global_commit.date,
+            DateSource::Committer => global_commit.committer_date,
+        };
+
+        if is_merge {
+            set_date = commit_date.clone();
+            collecting_commits = true;
+            destination_commit_id = commit.parent(0)?.id();
+
+            commit_buffer.push(global_commit);
+        } else {
+            if collecting_commits {
+                commit_buffer.push(global_commit);
+                continue;
+            }
+
+            let set = CommitSet {
+                date: commit_date,
+                commits: vec![global_commit],
+            };
+
+            commitsets.push(set);
+        }
+    }
+
+    // The walk can end before we reach the first parent of a merge, when the
+    // parent is older than the cutoff or was already seen in an earlier run.
+    if collecting_commits && !commit_buffer.is_empty() {
+        commitsets.push(CommitSet {
+            date: set_date,
+            commits: commit_buffer,
+        });
+    }
+
+    Ok(commitsets)
+}
+
+pub(crate) fn global_commit(
+    commit: &git2::Commit,
+    r: &Repository,
+    url_base: &Option<String>,
+) -> Result<GlobalCommit, GglError> {
+    Ok(GlobalCommit {
+        author: commit.author().name().unwrap().to_string(),
+        email: commit.author().email().unwrap_or("").to_string(),
+        date: git_time_to_datetime(&commit.author().when())?,
+        committer: commit.committer().name().unwrap_or("").to_string(),
+        committer_email: commit.committer().email().unwrap_or("").to_string(),
+        committer_date: git_time_to_datetime(&commit.committer().when())?,
+        message: commit.message().unwrap().to_string(),
+        sha: commit.id().to_string(),
+        repo_name: r.name.clone(),
+        url: match &r.commit_url {
+            Some(template) => Some(template.replace("{hash}", &commit.id().to_string())),
+            None => url_base
+                .as_ref()
+                .map(|base| format!("{}/commit/{}", base, commit.id())),
+        },
+        refs: vec![],
+        signature: None,
+        also_in: vec![],
+        branches: vec![],
+        trailers: vec![],
+        tickets: vec![],
+        short_sha: String::new(),
+        team: None,
+        notes: None,
+    })
+}
+
+// The web page of the repository, based on the URL of its remote.
+pub(crate) fn repo_url_base(repo: &git2::Repository, r: &Repository) -> Option<String> {
+    repo.find_remote(&r.remote)
+        .ok()
+        .and_then(|remote| remote.url().and_then(web_url_base))
+}
+
+// Turn a remote URL into the base URL of the repository's web page.  Both
+// https://host/org/repo.git and git@host:org/repo.git map to
+// https://host/org/repo.
+pub(crate) fn web_url_base(remote_url: &str) -> Option<String> {
+    let url = remote_url.trim_end_matches('/').trim_end_matches(".git");
+
+    let host_and_path = if let Some(rest) = url.strip_prefix("https://") {
+        rest.to_string()
+    } else if let Some(rest) = url.strip_prefix("http://") {
+        rest.to_string()
+    } else if let Some(rest) = url.strip_prefix("ssh://") {
+        rest.to_string()
+    } else if let Some((host, path)) = url.split_once(':') {
+        format!("{}/{}", host, path)
+    } else {
+        return None;
+    };
+
+    // Drop any user@ prefix
+    let host_and_path = match host_and_path.split_once('@') {
+        Some((_, rest)) => rest,
+        None => &host_and_path,
+    };
+
+    if !host_and_path.contains('/') {
+        return None;
+    }
+
+    Some(format!("https://{}", host_and_path))
+}
+
+/// Convert a git timestamp into a date that keeps the original offset.
+pub fn git_time_to_datetime(time: &git2::Time) -> Result<time::OffsetDateTime, GglError> {
+    let off = time::UtcOffset::from_whole_seconds(time.offset_minutes() * 60).unwrap();
+
+    let ts = time::OffsetDateTime::from_unix_timestamp(
+        time.seconds() + (time.offset_minutes() as i64) * 60,
+    )
+    .unwrap()
+    .replace_offset(off);
+
+    Ok(ts)
+}
+
+/// Parse a YYYY-MM-DD date, or a number of days ago like `30d`, into seconds
+/// since the epoch.
+pub fn parse_until(value: &str) -> Option<i64> {
+    let now = time::OffsetDateTime::now_local().unwrap();
+
+    if let Some(days) = value.strip_suffix('d') {
+        let days: i64 = days.parse().ok()?;
+        return Some(
+            now.saturating_sub(time::Duration::days(days))
+                .unix_timestamp(),
+        );
+    }
+
+    let format = time::macros::format_description!("[year]-[month]-[day]");
+    let date = time::Date::parse(value, &format).ok()?;
+    Some(
+        date.with_hms(0, 0, 0)
+            .unwrap()
+            .assume_offset(now.offset())
+            .unix_timestamp(),
+    )
+}
+
+/// Parse the --until given on the command line into seconds since the epoch.
+/// Without one, we go back one week.
+pub fn get_until(arg: &Option<String>) -> Result<i64, GglError> {
+    match arg {
+        Some(date) => parse_until(date).ok_or_else(|| {
+            GglError::IoError(format!(
+                "--until should be a date like 2022-12-31 or a number of days like 30d, not {}",
+                date
+            ))
+        }),
+        None => Ok(days_ago(7)),
+    }
+}
+
+/// The time `days` days ago, in seconds since the epoch.
+pub fn days_ago(days: i64) -> i64 {
+    time::OffsetDateTime::now_local()
+        .unwrap()
+        .saturating_sub(time::Duration::days(days))
+        .unix_timestamp()
+}
+
+// The cutoff for one repository: its own `until` from the config, or the one
+// for the whole run.
+fn repo_until(r: &Repository, until: git2::Time) -> Result<git2::Time, GglError> {
+    match &r.until {
+        None => Ok(until),
+        Some(value) => match parse_until(value) {
+            Some(seconds) => Ok(git2::Time::new(seconds, 0)),
+            None => Err(GglError::ConfigParserError(format!(
+                "{}: until should be a date like 2022-12-31 or a number of days like 30d, not {}",
+                r.name, value
+            ))),
+        },
+    }
+}
@@ -0,0 +1,196 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl compare`: commits and authors in two windows, side by side.
+
+use crate::collect::{parse_until, Timeline};
+use serde::Serialize;
+use std::collections::{HashMap, HashSet};
+use std::io;
+use std::io::Write;
+use std::str::FromStr;
+
+/// A window of time, from a date or a number of days ago up to another one,
+/// or up to now, e.g. `28d..14d` or `2024-03-01..2024-03-15`.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Window {
+    pub name: String,
+    /// Seconds since the epoch.
+    pub from: i64,
+    /// Seconds since the epoch, not included; now if `None`.
+    pub to: Option<i64>,
+}
+
+impl FromStr for Window {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let bad = || {
+            format!(
+                "{} should be a window like 28d..14d or 2024-03-01..2024-03-15, or 14d.. up to now",
+                s
+            )
+        };
+        let (from, to) = s.split_once("..").ok_or_else(bad)?;
+        let from = parse_until(from).ok_or_else(bad)?;
+        let to = match to {
+            "" => None,
+            to => Some(parse_until(to).ok_or_else(bad)?),
+        };
+        if to.map_or(false, |to| to <= from) {
+            return Err(format!("{} ends before it starts", s));
+        }
+        Ok(Window {
+            name: s.to_string(),
+            from,
+            to,
+        })
+    }
+}
+
+impl Window {
+    fn contains(&self, seconds: i64) -> bool {
+        seconds >= self.from && self.to.map_or(true, |to| seconds < to)
+    }
+}
+
+/// The commits and distinct authors of a repository, or of all of them, in
+/// both windows.
+#[derive(Debug, Default, Serialize)]
+pub struct Row {
+    pub name: String,
+    pub commits: [usize; 2],
+    pub authors: [usize; 2],
+}
+
+#[derive(Debug, Serialize)]
+pub struct Comparison {
+    pub windows: [String; 2],
+    pub total: Row,
+    pub repositories: Vec<Row>,
+}
+
+/// Compare the commits of `timeline` in the two windows, which it has to
+/// cover.  Co-authors count as authors, like in `ggl stats`.
+pub fn compare(timeline: &Timeline, windows: &[Window; 2]) -> Comparison {
+    let mut commits: HashMap<&str, [usize; 2]> = HashMap::new();
+    let mut authors: HashMap<&str, [HashSet<String>; 2]> = HashMap::new();
+    let mut all_authors: [HashSet<String>; 2] = Default::default();
+
+    for commit in timeline.commits() {
+        let date = commit.date.unix_timestamp();
+        for (i, window) in windows.iter().enumerate() {
+            if !window.contains(date) {
+                continue;
+            }
+            commits.entry(&commit.repo_name).or_default()[i] += 1;
+            let repo_authors = &mut authors.entry(&commit.repo_name).or_default()[i];
+            for (_, email) in commit.authors() {
+                repo_authors.insert(email.to_lowercase());
+                all_authors[i].insert(email.to_lowercase());
+            }
+        }
+    }
+
+    let mut repositories: Vec<Row> = commits
+        .into_iter()
+        .map(|(name, commits)| {
+            let authors = &authors[name];
+            Row {
+                name: name.to_string(),
+                commits,
+                authors: [authors[0].len(), authors[1].len()],
+            }
+        })
+        .collect();
+    // The biggest changes first
+    repositories.sort_by(|a, b| {
+        let change = |r: &Row| (r.commits[1] as i64 - r.commits[0] as i64).abs();
+        change(b).cmp(&change(a)).then(a.name.cmp(&b.name))
+    });
+
+    let total = Row {
+        name: "Total".to_string(),
+        commits: [
+            repositories.iter().map(|r| r.commits[0]).sum(),
+            repositories.iter().map(|r| r.commits[1]).sum(),
+        ],
+        authors: [all_authors[0].len(), all_authors[1].len()],
+    };
+
+    Comparison {
+        windows: [windows[0].name.clone(), windows[1].name.clone()],
+        total,
+        repositories,
+    }
+}
+
+// e.g. +6 (+43%), or -2 when there's nothing to compare against
+fn change(before: usize, after: usize) -> String {
+    let delta = after as i64 - before as i64;
+    if before == 0 {
+        format!("{:+}", delta)
+    } else {
+        format!(
+            "{:+} ({:+.0}%)",
+            delta,
+            100.0 * delta as f64 / before as f64
+        )
+    }
+}
+
+/// Write a line per repository with its commits and authors in both
+/// windows, and how they changed, and the totals at the end.
+pub fn write(w: &mut dyn Write, comparison: &Comparison) -> io::Result<()> {
+    writeln!(w, "Window 1: {}", comparison.windows[0])?;
+    writeln!(w, "Window 2: {}", comparison.windows[1])?;
+    writeln!(w)?;
+
+    let width = comparison
+        .repositories
+        .iter()
+        .map(|r| r.name.chars().count())
+        .chain(Some("Repository".len()))
+        .max()
+        .unwrap_or(0);
+
+    writeln!(
+        w,
+        "{:<width$}  Commits 1  Commits 2  {:<12}  Authors 1  Authors 2  Change",
+        "Repository",
+        "Change",
+        width = width
+    )?;
+    for row in comparison
+        .repositories
+        .iter()
+        .chain(Some(&comparison.total))
+    {
+        writeln!(
+            w,
+            "{:<width$}  {:>9}  {:>9}  {:<12}  {:>9}  {:>9}  {}",
+            row.name,
+            row.commits[0],
+            row.commits[1],
+            change(row.commits[0], row.commits[1]),
+            row.authors[0],
+            row.authors[1],
+            change(row.authors[0], row.authors[1]),
+            width = width
+        )?;
+    }
+    Ok(())
+}
@@ -0,0 +1,80 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl completion`: shell completion scripts that know the repository names.
+
+use crate::config::Config;
+use structopt::clap::Shell;
+
+/// The names `--repo` takes, in config order.
+pub fn repository_names(config: &Config) -> Vec<String> {
+    config
+        .blocks
+        .iter()
+        .flat_map(|block| block.repositories.iter().map(|r| r.name.clone()))
+        .collect()
+}
+
+/// Teach a script generated by clap to complete `--repo` with the names from
+/// the config.  The names are read by running `ggl completion --repositories`
+/// when completing, so they follow the config as it changes.
+pub fn add_repositories(script: &str, shell: Shell) -> String {
+    match shell {
+        Shell::Bash => format!("{}\n{}", script, BASH),
+        Shell::Fish => format!("{}\n{}", script, FISH),
+        Shell::Zsh => zsh(script),
+        _ => script.to_string(),
+    }
+}
+
+const BASH: &str = r#"_ggl_repositories() {
+    if [[ "${COMP_WORDS[COMP_CWORD-1]}" == "--repo" ]]; then
+        COMPREPLY=( $(compgen -W "$(ggl completion --repositories 2>/dev/null)" -- "${COMP_WORDS[COMP_CWORD]}") )
+        return 0
+    fi
+    _ggl "$@"
+}
+
+complete -F _ggl_repositories -o bashdefault -o default ggl
+"#;
+
+const FISH: &str = r#"complete -c ggl -n "__fish_use_subcommand" -l repo -x -a "(ggl completion --repositories 2>/dev/null)"
+"#;
+
+const ZSH: &str = r#"_ggl_repositories() {
+    compadd -- ${(f)"$(ggl completion --repositories 2>/dev/null)"}
+}
+"#;
+
+// clap leaves the value of --repo without an action, so point it at
+// _ggl_repositories, which has to be defined before the script's last line
+// calls _ggl.
+fn zsh(script: &str) -> String {
+    let mut out = String::new();
+    for line in script.lines() {
+        if line.trim_start().starts_with("'*--repo=[") && line.ends_with("]' \\") {
+            out.push_str(&line.replace("]' \\", "]: :_ggl_repositories' \\"));
+        } else if line == "_ggl \"$@\"" {
+            out.push_str(ZSH);
+            out.push('\n');
+            out.push_str(line);
+        } else {
+            out.push_str(line);
+        }
+        out.push('\n');
+    }
+    out
+}
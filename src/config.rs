@@ -0,0 +1,468 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! The YAML config file which lists the repositories to look at.
+
+use crate::error::GglError;
+use crate::glob;
+use serde::Deserialize;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+#[derive(Debug, Clone, PartialEq, Deserialize)]
+pub enum FilterType {
+    Include,
+    Reject,
+}
+
+#[derive(Debug, Clone, Deserialize)]
+pub struct Filter {
+    pub filter_type: FilterType,
+    pub paths: Vec<String>,
+}
+
+/// What to walk when the remote-tracking branch doesn't exist.
+#[derive(Debug, Clone, PartialEq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Fallback {
+    /// The local branch of the same name, or HEAD.
+    Local,
+}
+
+fn default_remote() -> String {
+    "origin".to_string()
+}
+
+fn default_fetch() -> bool {
+    true
+}
+
+/// Where the history of a repository comes from.
+#[derive(Debug, Clone, Default, PartialEq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum RepositoryType {
+    /// A clone on disk.
+    #[default]
+    Local,
+    /// The GitHub API; `path` is owner/repo.
+    Github,
+    /// The GitLab API; `path` is group/project.
+    Gitlab,
+    /// The API of a Gitea or Forgejo instance; `path` is owner/repo.
+    Gitea,
+}
+
+/// One of several remote-tracking branches to walk in a repository.
+#[derive(Debug, Clone, Deserialize)]
+pub struct Remote {
+    pub remote: String,
+    /// Defaults to the branch that the remote's HEAD points at.
+    #[serde(default)]
+    pub branch: Option<String>,
+}
+
+/// A single repository, relative to the root of its block.
+#[derive(Debug, Clone, Deserialize)]
+pub struct Repository {
+    /// Defaults to the path.
+    #[serde(default)]
+    pub name: String,
+    pub path: String,
+    #[serde(default, rename = "type")]
+    pub kind: RepositoryType,
+    /// Base URL of the API, for forges that aren't local.
+    #[serde(default)]
+    pub url: Option<String>,
+    /// API token, for forges that aren't local.
+    #[serde(default)]
+    pub token: Option<String>,
+    /// The web page of a commit, with `{hash}` standing for its hash.
+    /// Defaults to one derived from the remote URL or the forge.
+    #[serde(default, rename = "commit-url")]
+    pub commit_url: Option<String>,
+    /// Where `ggl sync` clones the repository from when it isn't on disk.
+    #[serde(default, rename = "clone-url")]
+    pub clone_url: Option<String>,
+    #[serde(default = "default_remote")]
+    pub remote: String,
+    /// Defaults to the branch that the remote's HEAD points at.
+    #[serde(default)]
+    pub branch: Option<String>,
+    /// Walk several remote-tracking branches instead of `remote` and `branch`.
+    #[serde(default)]
+    pub remotes: Vec<Remote>,
+    #[serde(default = "default_fetch")]
+    pub fetch: bool,
+    /// Only fetch this many commits of recent history, like `git fetch --depth`.
+    #[serde(default)]
+    pub depth: Option<u32>,
+    /// Remove remote-tracking branches that were deleted on the remote.
+    #[serde(default)]
+    pub prune: bool,
+    pub filters: Option<Vec<Filter>>,
+    /// Only keep commits authored from these email domains.
+    #[serde(default)]
+    pub domains: Option<Vec<String>>,
+    #[serde(default)]
+    pub fallback: Option<Fallback>,
+    /// Also walk the repository's submodules.
+    #[serde(default, rename = "include-submodules")]
+    pub include_submodules: bool,
+    /// Only follow the first parent of merges, for the mainline history.
+    #[serde(default, rename = "first-parent")]
+    pub first_parent: bool,
+    /// Walk at most this many commits; 0 or nothing means no limit.
+    #[serde(default)]
+    pub limit: Option<usize>,
+    /// How far back to go in this repository instead of --until: a date, or a
+    /// number of days like `30d`.
+    #[serde(default, alias = "since")]
+    pub until: Option<String>,
+    /// Give up on fetching or walking the repository after this many seconds.
+    #[serde(default)]
+    pub timeout: Option<u64>,
+    /// Try a failed fetch again this many times, waiting twice as long before
+    /// every attempt.
+    #[serde(default)]
+    pub retries: Option<u32>,
+    /// The HTTP proxy to fetch and call the API through, instead of the one
+    /// from $HTTPS_PROXY and friends or the git config.
+    #[serde(default)]
+    pub proxy: Option<String>,
+    /// Make at most this many requests a minute to the API of the forge.
+    #[serde(default, rename = "rate-limit")]
+    pub rate_limit: Option<u32>,
+    /// Walk the remote-tracking branch even without a `branch`, like the
+    /// views of `remotes` and submodules do.
+    #[serde(skip)]
+    pub tracking: bool,
+    /// When `ggl daemon` fetches the repository, as a cron expression; see
+    /// [`crate::cron`].
+    #[serde(default)]
+    pub schedule: Option<String>,
+}
+
+/// A collection of repositories that share a common root directory.
+#[derive(Debug, Deserialize)]
+pub struct Block {
+    pub root: String,
+    pub repositories: Vec<Repository>,
+}
+
+/// The mail server `ggl digest --email` sends through, e.g.
+/// smtps://smtp.example.com:465.
+#[derive(Debug, Deserialize)]
+pub struct Smtp {
+    pub url: String,
+    pub username: Option<String>,
+    pub password: Option<String>,
+    pub from: String,
+    pub to: Vec<String>,
+}
+
+/// Who may see `ggl serve`.  Requests have to send the token as
+/// `Authorization: Bearer <token>`, or the username and password with basic
+/// auth.  Without either, anyone who can reach the server can see the log.
+/// With a certificate and its key, as PEM files, it serves HTTPS.
+#[derive(Debug, Default, Deserialize)]
+pub struct Serve {
+    pub token: Option<String>,
+    pub username: Option<String>,
+    pub password: Option<String>,
+    #[serde(default, rename = "tls-cert")]
+    pub tls_cert: Option<String>,
+    #[serde(default, rename = "tls-key")]
+    pub tls_key: Option<String>,
+}
+
+#[derive(Debug, PartialEq, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum NotificationType {
+    /// A Slack incoming webhook.
+    Slack,
+    /// Any URL that takes a JSON POST of the new commits.
+    Webhook,
+}
+
+/// Where `ggl daemon` posts new commits.  Without `repositories` or
+/// `authors`, every new commit is posted.
+#[derive(Debug, Deserialize)]
+pub struct Notification {
+    #[serde(rename = "type")]
+    pub kind: NotificationType,
+    pub url: String,
+    pub repositories: Option<Vec<String>>,
+    /// Substrings of the author's name or email.
+    pub authors: Option<Vec<String>>,
+}
+
+/// New commits that `ggl daemon` looks out for, and what it does when one
+/// shows up.  Every condition that is set has to hold.
+#[derive(Debug, Deserialize)]
+pub struct Rule {
+    pub name: String,
+    /// Globs of repository names, e.g. `prod-*`.
+    #[serde(default)]
+    pub repositories: Vec<String>,
+    /// Branches, e.g. `main` or `upstream/main`.
+    #[serde(default)]
+    pub branches: Vec<String>,
+    /// An extended pattern for the commit message; see [`crate::pattern`].
+    #[serde(default)]
+    pub grep: Option<String>,
+    /// Extended patterns for the author or a co-author, as `Name <email>`.
+    #[serde(default)]
+    pub authors: Vec<String>,
+    /// Globs of the files the commit changed, e.g. `deploy/**`.
+    #[serde(default)]
+    pub paths: Vec<String>,
+    pub actions: Vec<Action>,
+}
+
+/// What to do about the commits that meet a rule.
+#[derive(Debug, Deserialize)]
+#[serde(tag = "type", rename_all = "lowercase")]
+pub enum Action {
+    /// Print them, highlighted.
+    Alert,
+    /// POST them as JSON to the URL.
+    Webhook { url: String },
+}
+
+/// Someone who commits under several names or emails, e.g. on different
+/// machines.
+#[derive(Debug, Clone, Deserialize)]
+pub struct Alias {
+    /// The name to show for their commits; the one they committed under if
+    /// not set.
+    #[serde(default)]
+    pub name: Option<String>,
+    #[serde(default)]
+    pub team: Option<String>,
+    #[serde(default)]
+    pub emails: Vec<String>,
+    #[serde(default)]
+    pub names: Vec<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct Config {
+    /// Other config files to merge into this one, relative to it.
+    #[serde(default)]
+    pub include: Vec<String>,
+    #[serde(default)]
+    pub blocks: Vec<Block>,
+    #[serde(default)]
+    pub notifications: Vec<Notification>,
+    #[serde(default)]
+    pub rules: Vec<Rule>,
+    #[serde(default)]
+    pub smtp: Option<Smtp>,
+    #[serde(default)]
+    pub serve: Option<Serve>,
+    /// When `ggl daemon` fetches the repositories without a `schedule` of
+    /// their own, instead of every --interval seconds.
+    #[serde(default)]
+    pub schedule: Option<String>,
+    /// The gpg keyring used by --show-signature, instead of the default one.
+    #[serde(default)]
+    pub keyring: Option<String>,
+    /// Patterns for the ticket IDs in commit messages, e.g. `JIRA-\d+`; see
+    /// [`crate::pattern`] for the syntax.
+    #[serde(default)]
+    pub tickets: Vec<String>,
+    /// A mailmap file, like git's `.mailmap`, for every repository.  It's
+    /// applied after the repository's own.
+    #[serde(default)]
+    pub mailmap: Option<String>,
+    /// Applied after the mailmaps, before anything else looks at the authors.
+    #[serde(default)]
+    pub authors: Vec<Alias>,
+    /// Globs of repository names to leave out, e.g. `*-mirror`.
+    #[serde(default)]
+    pub exclude: Vec<String>,
+}
+
+/// Expand a leading `~`, and `$VAR` or `${VAR}` anywhere, like the shell
+/// does.  Unlike the shell, a variable that isn't set is an error.
+pub fn expand(value: &str) -> Result<String, GglError> {
+    let mut out = String::new();
+    let mut rest = value;
+
+    if rest == "~" || rest.starts_with("~/") {
+        let home = dirs::home_dir()
+            .ok_or_else(|| GglError::ConfigParserError("can't find the home directory".into()))?;
+        out.push_str(&home.to_string_lossy());
+        rest = &rest[1..];
+    }
+
+    while let Some(start) = rest.find('$') {
+        out.push_str(&rest[..start]);
+        rest = &rest[start + 1..];
+
+        let (name, after) = if let Some(braced) = rest.strip_prefix('{') {
+            match braced.find('}') {
+                Some(end) => (&braced[..end], &braced[end + 1..]),
+                None => {
+                    return Err(GglError::ConfigParserError(format!(
+                        "missing }} in {}",
+                        value
+                    )))
+                }
+            }
+        } else {
+            let end = rest
+                .find(|c: char| !(c.is_ascii_alphanumeric() || c == '_'))
+                .unwrap_or(rest.len());
+            (&rest[..end], &rest[end..])
+        };
+
+        if name.is_empty() {
+            out.push('$');
+        } else {
+            match std::env::var(name) {
+                Ok(v) => out.push_str(&v),
+                Err(_) => {
+                    return Err(GglError::ConfigParserError(format!(
+                        "${} in {} isn't set",
+                        name, value
+                    )))
+                }
+            }
+        }
+        rest = after;
+    }
+
+    out.push_str(rest);
+    Ok(out)
+}
+
+/// Read and parse the config file at `path`, and the files it includes.
+pub fn load_config(path: PathBuf) -> Result<Config, GglError> {
+    let mut config = load_file(path, &mut vec![])?;
+    let exclude = std::mem::take(&mut config.exclude);
+    for block in config.blocks.iter_mut() {
+        block.repositories.retain(|r| !excluded(&r.name, &exclude));
+    }
+    Ok(config)
+}
+
+/// Whether the name of a repository matches one of the globs in `exclude`.
+pub fn excluded(name: &str, exclude: &[String]) -> bool {
+    exclude.iter().any(|pattern| glob::matches(pattern, name))
+}
+
+// `stack` holds the files whose includes we're in the middle of, to catch
+// files that include themselves.
+fn load_file(path: PathBuf, stack: &mut Vec<PathBuf>) -> Result<Config, GglError> {
+    let contents = fs::read_to_string(&path)
+        .map_err(|e| GglError::IoError(format!("{}: {}", path.display(), e)))?;
+    // TODO: Not sure why we can't return:
+    //    serde_yaml::from_str(&contents)?;
+    let mut config: Config = match serde_yaml::from_str(&contents) {
+        Ok(c) => c,
+        Err(e) => return Err(GglError::ConfigParserError(format!("{}", e))),
+    };
+
+    if let Some(mailmap) = &config.mailmap {
+        config.mailmap = Some(expand(mailmap)?);
+    }
+    if let Some(serve) = config.serve.as_mut() {
+        for path in [&mut serve.tls_cert, &mut serve.tls_key]
+            .into_iter()
+            .flatten()
+        {
+            *path = expand(path)?;
+        }
+    }
+    for block in config.blocks.iter_mut() {
+        block.root = expand(&block.root)?;
+        for r in block.repositories.iter_mut() {
+            if r.name.is_empty() {
+                r.name = r.path.clone();
+            }
+            if r.kind == RepositoryType::Local {
+                r.path = expand(&r.path)?;
+            }
+        }
+    }
+
+    let canonical = path.canonicalize()?;
+    if stack.contains(&canonical) {
+        return Err(GglError::ConfigParserError(format!(
+            "{} includes itself",
+            path.display()
+        )));
+    }
+
+    let dir = path.parent().unwrap_or(Path::new(".")).to_path_buf();
+    stack.push(canonical);
+    for include in std::mem::take(&mut config.include) {
+        let fragment = load_file(dir.join(expand(&include)?), stack)?;
+        config.blocks.extend(fragment.blocks);
+        config.notifications.extend(fragment.notifications);
+        config.rules.extend(fragment.rules);
+        config.tickets.extend(fragment.tickets);
+        config.authors.extend(fragment.authors);
+        config.exclude.extend(fragment.exclude);
+        if config.smtp.is_none() {
+            config.smtp = fragment.smtp;
+        }
+        if config.serve.is_none() {
+            config.serve = fragment.serve;
+        }
+        if config.schedule.is_none() {
+            config.schedule = fragment.schedule;
+        }
+        if config.keyring.is_none() {
+            config.keyring = fragment.keyring;
+        }
+        if config.mailmap.is_none() {
+            config.mailmap = fragment.mailmap;
+        }
+    }
+    stack.pop();
+
+    Ok(config)
+}
+
+/// Look for a config file in the following places in the following order:
+///   1.  --config flag
+///   2.  $XDG_CONFIG_HOME/ggl.yaml
+///   3.  config.yaml in the current directory
+pub fn get_config_path(arg_config: Option<PathBuf>) -> Result<PathBuf, GglError> {
+    if let Some(path) = arg_config {
+        if path.exists() {
+            return Ok(path);
+        } else {
+            return Err(GglError::MissingConfigFile);
+        }
+    }
+
+    if let Some(path) = dirs::config_dir() {
+        let full_path = path.join("ggl.yaml").to_path_buf();
+        if full_path.exists() {
+            return Ok(full_path);
+        }
+    }
+
+    let local_file = PathBuf::from("config.yaml");
+    if local_file.exists() {
+        return Ok(local_file);
+    }
+
+    return Err(GglError::MissingConfigFile);
+}
@@ -0,0 +1,208 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Cron expressions, for when `ggl daemon` fetches a repository.
+//!
+//! The five fields are the minute, hour, day of the month, month and day of
+//! the week, e.g. `*/5 * * * *` or `0 9 * * 1-5`.  Every field is `*`, a
+//! number, a range like `1-5`, either one with a step like `*/15` or `0-30/10`,
+//! or a list of those like `0,30`.  Sunday is 0 or 7.  `@hourly`, `@daily`,
+//! `@weekly` and `@monthly` stand for the usual expressions.
+
+use std::str::FromStr;
+
+/// A parsed cron expression.  Every field is a set of the values it matches,
+/// as bits.
+#[derive(Debug, Clone, PartialEq)]
+pub struct Schedule {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    weekdays: u64,
+    // Like cron, when both the day of the month and the day of the week are
+    // restricted, a day matching either one will do
+    any_day: bool,
+    any_weekday: bool,
+}
+
+fn parse_field(field: &str, min: u32, max: u32) -> Result<u64, String> {
+    let mut bits = 0;
+
+    for part in field.split(',') {
+        let (range, step) = match part.split_once('/') {
+            Some((range, step)) => match step.parse::<u32>() {
+                Ok(step) if step > 0 => (range, Some(step)),
+                _ => return Err(format!("invalid step: {}", part)),
+            },
+            None => (part, None),
+        };
+
+        let number = |s: &str| {
+            s.parse::<u32>()
+                .ok()
+                .filter(|n| (min..=max).contains(n))
+                .ok_or_else(|| format!("{} isn't between {} and {}", s, min, max))
+        };
+        let (from, to) = if range == "*" {
+            (min, max)
+        } else if let Some((from, to)) = range.split_once('-') {
+            (number(from)?, number(to)?)
+        } else {
+            let n = number(range)?;
+            // 5/15 is every 15 from 5 on
+            (n, if step.is_some() { max } else { n })
+        };
+        if from > to {
+            return Err(format!("invalid range: {}", range));
+        }
+
+        for value in (from..=to).step_by(step.unwrap_or(1) as usize) {
+            bits |= 1 << value;
+        }
+    }
+
+    Ok(bits)
+}
+
+impl FromStr for Schedule {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Schedule, String> {
+        let s = match s.trim() {
+            "@hourly" => "0 * * * *",
+            "@daily" => "0 0 * * *",
+            "@weekly" => "0 0 * * 0",
+            "@monthly" => "0 0 1 * *",
+            s => s,
+        };
+
+        let fields: Vec<&str> = s.split_whitespace().collect();
+        if fields.len() != 5 {
+            return Err(format!("expected 5 fields, got {}: {}", fields.len(), s));
+        }
+
+        let mut weekdays = parse_field(fields[4], 0, 7)?;
+        if weekdays & 1 << 7 != 0 {
+            weekdays = (weekdays | 1) & !(1 << 7);
+        }
+
+        Ok(Schedule {
+            minutes: parse_field(fields[0], 0, 59)?,
+            hours: parse_field(fields[1], 0, 23)?,
+            days: parse_field(fields[2], 1, 31)?,
+            months: parse_field(fields[3], 1, 12)?,
+            weekdays,
+            any_day: fields[2].starts_with('*'),
+            any_weekday: fields[4].starts_with('*'),
+        })
+    }
+}
+
+impl Schedule {
+    /// Whether the schedule says to run in the minute of `t`.
+    pub fn matches(&self, t: time::OffsetDateTime) -> bool {
+        let is_set = |bits: u64, value: u8| bits & 1 << value != 0;
+
+        let day = is_set(self.days, t.day());
+        let weekday = is_set(self.weekdays, t.weekday().number_days_from_sunday());
+        let day = match (self.any_day, self.any_weekday) {
+            (true, true) => true,
+            (false, true) => day,
+            (true, false) => weekday,
+            (false, false) => day || weekday,
+        };
+
+        day && is_set(self.minutes, t.minute())
+            && is_set(self.hours, t.hour())
+            && is_set(self.months, t.month() as u8)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use time::macros::datetime;
+
+    fn schedule(s: &str) -> Schedule {
+        s.parse().unwrap()
+    }
+
+    #[test]
+    fn steps() {
+        let every_15 = schedule("*/15 * * * *");
+        assert!(every_15.matches(datetime!(2022-11-07 10:00 UTC)));
+        assert!(every_15.matches(datetime!(2022-11-07 10:45 UTC)));
+        assert!(!every_15.matches(datetime!(2022-11-07 10:10 UTC)));
+
+        let from_5 = schedule("5/15 * * * *");
+        assert!(from_5.matches(datetime!(2022-11-07 10:05 UTC)));
+        assert!(from_5.matches(datetime!(2022-11-07 10:50 UTC)));
+        assert!(!from_5.matches(datetime!(2022-11-07 10:00 UTC)));
+        assert!(!from_5.matches(datetime!(2022-11-07 10:15 UTC)));
+    }
+
+    #[test]
+    fn ranges_and_lists() {
+        // 2022-11-06 is a Sunday
+        let workdays = schedule("0 9 * * 1-5");
+        assert!(workdays.matches(datetime!(2022-11-07 9:00 UTC)));
+        assert!(!workdays.matches(datetime!(2022-11-06 9:00 UTC)));
+        assert!(!workdays.matches(datetime!(2022-11-07 10:00 UTC)));
+
+        let half_hours = schedule("0,30 * * * *");
+        assert!(half_hours.matches(datetime!(2022-11-07 10:30 UTC)));
+        assert!(!half_hours.matches(datetime!(2022-11-07 10:15 UTC)));
+    }
+
+    #[test]
+    fn sunday_is_0_or_7() {
+        assert_eq!(schedule("0 0 * * 7"), schedule("0 0 * * 0"));
+        assert!(schedule("0 0 * * 7").matches(datetime!(2022-11-06 0:00 UTC)));
+        assert!(schedule("0 0 * * 5-7").matches(datetime!(2022-11-06 0:00 UTC)));
+    }
+
+    #[test]
+    fn either_day_field_will_do_when_both_are_restricted() {
+        // The 1st, and every Monday
+        let both = schedule("0 0 1 * 1");
+        assert!(both.matches(datetime!(2022-11-01 0:00 UTC)));
+        assert!(both.matches(datetime!(2022-11-07 0:00 UTC)));
+        assert!(!both.matches(datetime!(2022-11-08 0:00 UTC)));
+
+        assert!(!schedule("0 0 1 * *").matches(datetime!(2022-11-07 0:00 UTC)));
+        assert!(!schedule("0 0 * * 1").matches(datetime!(2022-11-01 0:00 UTC)));
+    }
+
+    #[test]
+    fn shorthands() {
+        assert_eq!(schedule("@daily"), schedule("0 0 * * *"));
+        assert_eq!(schedule("@weekly"), schedule("0 0 * * 0"));
+    }
+
+    #[test]
+    fn invalid() {
+        for s in [
+            "60 * * * *",
+            "* * *",
+            "*/0 * * * *",
+            "5-1 * * * *",
+            "* * 0 * *",
+        ] {
+            assert!(s.parse::<Schedule>().is_err(), "{}", s);
+        }
+    }
+}
@@ -0,0 +1,248 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl daemon`: fetch on a schedule and keep the timeline cache fresh.
+
+use crate::cache;
+use crate::collect::{collect_timeline, fetch_all, get_until, selected, CollectOptions, Timeline};
+use crate::config::Config;
+use crate::cron::Schedule;
+use crate::error::GglError;
+use crate::interrupt;
+use crate::metrics;
+use crate::notify::{self, Notifier};
+use crate::rules::Rules;
+use crate::{debug, info};
+use std::fs;
+use std::path::Path;
+use std::time::{Duration, Instant};
+
+// Through a temporary file, so that the node_exporter never reads half of it.
+fn write_metrics(path: &Path, timeline: &Timeline) -> Result<(), GglError> {
+    let tmp = path.with_extension("prom.tmp");
+    fs::write(&tmp, metrics::render(timeline))?;
+    fs::rename(&tmp, path)?;
+    Ok(())
+}
+
+// Every repository with its schedule: its own, or else the one in the config
+// for all of them.  None stands for every --interval seconds.
+fn schedules(
+    config: &Config,
+    opts: &CollectOptions,
+) -> Result<Vec<(String, Option<Schedule>)>, GglError> {
+    let parse = |expression: &str, of: &str| {
+        expression
+            .parse::<Schedule>()
+            .map_err(|e| GglError::ConfigParserError(format!("invalid schedule for {}: {}", of, e)))
+    };
+    let default = match &config.schedule {
+        Some(expression) => Some(parse(expression, "all repositories")?),
+        None => None,
+    };
+
+    let mut schedules = vec![];
+    for r in config
+        .blocks
+        .iter()
+        .flat_map(|block| block.repositories.iter())
+        .filter(|r| selected(r, opts))
+    {
+        let schedule = match &r.schedule {
+            Some(expression) => Some(parse(expression, &r.name)?),
+            None => default.clone(),
+        };
+        schedules.push((r.name.clone(), schedule));
+    }
+
+    Ok(schedules)
+}
+
+// The minutes after `last` up to the one of `now`, all of them, since a round
+// can take longer than a minute, or just `now` the first time.
+fn minutes_since(
+    last: Option<time::OffsetDateTime>,
+    now: time::OffsetDateTime,
+) -> Vec<time::OffsetDateTime> {
+    let now = now
+        - time::Duration::seconds(now.second() as i64)
+        - time::Duration::nanoseconds(now.nanosecond() as i64);
+    let mut minute = match last {
+        Some(last) => last + time::Duration::MINUTE,
+        None => now,
+    };
+    let mut minutes = vec![];
+    while minute <= now {
+        minutes.push(minute);
+        minute += time::Duration::MINUTE;
+    }
+    minutes
+}
+
+/// Fetch the repositories and refresh the cache every `interval` seconds, or
+/// when the `schedule` of a repository or of the config says so, posting new
+/// commits to the notifications in the config and checking them against its
+/// rules.  With `metrics_file`, the metrics are written there after every
+/// round.  Errors are reported, and we try again on the next round.  Ctrl-C or
+/// SIGTERM stop the daemon, without writing what the round it interrupts
+/// collected.
+pub fn run(
+    config: &Config,
+    opts: &CollectOptions,
+    until: &Option<String>,
+    interval: u64,
+    metrics_file: Option<&Path>,
+) -> Result<(), GglError> {
+    let schedules = schedules(config, opts)?;
+    let scheduled = schedules.iter().any(|(_, schedule)| schedule.is_some());
+    // The schedules follow the local time of when the daemon started, since
+    // the offset can't be looked up reliably once other threads run
+    let offset = time::UtcOffset::current_local_offset()
+        .map_err(|e| GglError::IoError(format!("can't determine the local time: {}", e)))?;
+    let interval = Duration::from_secs(interval);
+
+    let mut notifier = Notifier::default();
+    let mut rules = Rules::new(config)?;
+    // What the metrics count the commits of when a round fails
+    let mut last = Timeline::default();
+    // When the repositories without a schedule were last fetched
+    let mut last_round: Option<Instant> = None;
+    // The last minute the schedules were looked at
+    let mut last_minute: Option<time::OffsetDateTime> = None;
+
+    interrupt::install();
+    interrupt::catch_sigterm();
+
+    while !interrupt::interrupted() {
+        let now = time::OffsetDateTime::now_utc().to_offset(offset);
+        let minutes = minutes_since(last_minute, now);
+        if let Some(minute) = minutes.last() {
+            last_minute = Some(*minute);
+        }
+        let every = last_round.map_or(true, |t| t.elapsed() >= interval);
+        // Everything is fetched in the first round
+        let due: Vec<String> = schedules
+            .iter()
+            .filter(|(_, schedule)| match schedule {
+                _ if last_round.is_none() => true,
+                Some(schedule) => minutes.iter().any(|minute| schedule.matches(*minute)),
+                None => every,
+            })
+            .map(|(name, _)| name.clone())
+            .collect();
+        if every {
+            last_round = Some(Instant::now());
+        }
+
+        if !due.is_empty() {
+            let opts = if due.len() == schedules.len() {
+                CollectOptions {
+                    fetch: true,
+                    ..opts.clone()
+                }
+            } else {
+                debug!("Fetching {}", due.join(", "));
+                let fetch = CollectOptions {
+                    fetch: true,
+                    repos: due,
+                    ..opts.clone()
+                };
+                // It reports the errors itself
+                let _ = fetch_all(config, &fetch);
+                CollectOptions {
+                    fetch: false,
+                    ..opts.clone()
+                }
+            };
+            let cutoff = git2::Time::new(get_until(until)?, 0);
+
+            let started = Instant::now();
+            let collected = collect_timeline(config, &opts, cutoff);
+            if interrupt::interrupted() {
+                break;
+            }
+            metrics::record_collection(started.elapsed(), collected.is_ok());
+
+            let result = collected.and_then(|t| {
+                let new = notifier.new_commits(&t);
+                notify::notify(&config.notifications, &new);
+                rules.apply(&new);
+                if metrics_file.is_some() {
+                    last = t.clone();
+                }
+                cache::write_timeline(t, cutoff)
+            });
+
+            if let Err(e) = result {
+                eprintln!("error: {:?}", e);
+            }
+
+            if let Some(path) = metrics_file {
+                if let Err(e) = write_metrics(path, &last) {
+                    eprintln!("error: {}: {:?}", path.display(), e);
+                }
+            }
+        }
+
+        if scheduled {
+            // Look at the schedules again at the start of the next minute
+            let second = time::OffsetDateTime::now_utc().second();
+            interrupt::sleep(Duration::from_secs(60 - second as u64));
+        } else {
+            interrupt::sleep(interval);
+        }
+    }
+
+    info!("Stopped");
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use time::macros::datetime;
+
+    #[test]
+    fn starts_with_the_current_minute() {
+        let minutes = minutes_since(None, datetime!(2024-03-01 09:30:42 +1));
+        assert_eq!(minutes, vec![datetime!(2024-03-01 09:30 +1)]);
+    }
+
+    #[test]
+    fn catches_up_on_the_minutes_a_round_took() {
+        let minutes = minutes_since(
+            Some(datetime!(2024-03-01 09:58 +1)),
+            datetime!(2024-03-01 10:01:05 +1),
+        );
+        assert_eq!(
+            minutes,
+            vec![
+                datetime!(2024-03-01 09:59 +1),
+                datetime!(2024-03-01 10:00 +1),
+                datetime!(2024-03-01 10:01 +1),
+            ]
+        );
+    }
+
+    #[test]
+    fn looks_at_a_minute_once() {
+        let minutes = minutes_since(
+            Some(datetime!(2024-03-01 10:01 +1)),
+            datetime!(2024-03-01 10:01:59 +1),
+        );
+        assert!(minutes.is_empty());
+    }
+}
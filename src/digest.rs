@@ -0,0 +1,122 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl digest`: a summary of the window, to read or to send by email.
+
+use crate::collect::Timeline;
+use crate::config::Smtp;
+use crate::error::GglError;
+use crate::output::{write_html, write_text, DateFormat};
+use crate::stats;
+use std::fs;
+use std::io::Write;
+use std::process::{Command, Stdio};
+use time::format_description::well_known::Rfc2822;
+
+/// Render the digest: the stats of the window followed by the log, as text
+/// or as an HTML page.
+pub fn render(timeline: &Timeline, until: i64, html: bool) -> Result<Vec<u8>, GglError> {
+    let mut body = vec![];
+    if html {
+        write_html(&mut body, timeline, &DateFormat::Default)?;
+    } else {
+        stats::write_table(&mut body, &stats::compute(timeline, until))?;
+        writeln!(body)?;
+        write_text(&mut body, timeline, false, None, &DateFormat::Default)?;
+    }
+    Ok(body)
+}
+
+/// The subject line of the digest email.
+pub fn subject(timeline: &Timeline, until: i64) -> String {
+    let format = time::macros::format_description!("[year]-[month]-[day]");
+    let since = time::OffsetDateTime::from_unix_timestamp(until)
+        .ok()
+        .and_then(|t| t.format(&format).ok())
+        .unwrap_or_default();
+    format!(
+        "ggl digest: {} commits since {}",
+        timeline.commits().count(),
+        since
+    )
+}
+
+/// Send the digest through the SMTP server in the config.  curl does the
+/// talking; the credentials go to it on stdin so they don't show up in the
+/// process list.
+pub fn send(smtp: &Smtp, subject: &str, body: &[u8], html: bool) -> Result<(), GglError> {
+    let date = time::OffsetDateTime::now_utc()
+        .format(&Rfc2822)
+        .map_err(|e| GglError::IoError(format!("{}", e)))?;
+    let content_type = if html { "text/html" } else { "text/plain" };
+
+    let mut message = vec![];
+    writeln!(message, "From: {}", smtp.from)?;
+    writeln!(message, "To: {}", smtp.to.join(", "))?;
+    writeln!(message, "Subject: {}", subject)?;
+    writeln!(message, "Date: {}", date)?;
+    writeln!(message, "MIME-Version: 1.0")?;
+    writeln!(message, "Content-Type: {}; charset=utf-8", content_type)?;
+    writeln!(message, "Content-Transfer-Encoding: 8bit")?;
+    writeln!(message)?;
+    message.extend_from_slice(body);
+
+    let path = std::env::temp_dir().join(format!("ggl-digest-{}.eml", std::process::id()));
+    fs::write(&path, &message)?;
+
+    let mut cmd = Command::new("curl");
+    cmd.args(["--silent", "--show-error", "--ssl-reqd", "--crlf"])
+        .args(["--config", "-"])
+        .arg("--url")
+        .arg(&smtp.url)
+        .arg("--mail-from")
+        .arg(&smtp.from)
+        .arg("--upload-file")
+        .arg(&path);
+    for to in &smtp.to {
+        cmd.arg("--mail-rcpt").arg(to);
+    }
+
+    let result = (|| {
+        let mut child = cmd.stdin(Stdio::piped()).stderr(Stdio::piped()).spawn()?;
+        if let (Some(mut stdin), Some(username)) = (child.stdin.take(), &smtp.username) {
+            let password = smtp.password.as_deref().unwrap_or("");
+            writeln!(
+                stdin,
+                "user = \"{}:{}\"",
+                escape(username),
+                escape(password)
+            )?;
+        }
+
+        let output = child.wait_with_output()?;
+        if !output.status.success() {
+            return Err(GglError::IoError(format!(
+                "can't send the digest: {}",
+                String::from_utf8_lossy(&output.stderr).trim()
+            )));
+        }
+        Ok(())
+    })();
+
+    let _ = fs::remove_file(&path);
+    result
+}
+
+// Quote a value for a curl config file.
+fn escape(s: &str) -> String {
+    s.replace('\\', "\\\\").replace('"', "\\\"")
+}
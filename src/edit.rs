@@ -0,0 +1,365 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Changes to the config file for `ggl add` and `ggl remove`, made to the text
+//! rather than by writing the parsed config back, so that comments and order
+//! survive.
+
+use crate::config::{expand, Config};
+use crate::error::GglError;
+use std::fs;
+use std::path::{Path, PathBuf};
+
+/// What `ggl add` writes for a repository.
+#[derive(Debug)]
+pub struct Entry {
+    pub path: String,
+    pub name: Option<String>,
+    pub remote: String,
+    pub branch: Option<String>,
+}
+
+impl Entry {
+    // The lines of the list item, without indentation.
+    fn lines(&self) -> Vec<String> {
+        let mut lines = vec![format!("- path: {}", scalar(&self.path))];
+        if let Some(name) = &self.name {
+            lines.push(format!("  name: {}", scalar(name)));
+        }
+        if self.remote != "origin" {
+            lines.push(format!("  remote: {}", scalar(&self.remote)));
+        }
+        if let Some(branch) = &self.branch {
+            lines.push(format!("  branch: {}", scalar(branch)));
+        }
+        lines
+    }
+}
+
+/// Add the repository at `path` to the config file at `config_path`: to the
+/// block whose root it's under, or to a new block for its parent directory.
+/// Returns the name the repository goes by.
+pub fn add(config_path: &Path, path: &Path, name: Option<String>) -> Result<String, GglError> {
+    let repo = git2::Repository::open(path)?;
+    let dir = repo
+        .workdir()
+        .unwrap_or_else(|| repo.path())
+        .canonicalize()?;
+    let (remote, branch) = upstream(&repo);
+
+    let contents = fs::read_to_string(config_path)
+        .map_err(|e| GglError::IoError(format!("{}: {}", config_path.display(), e)))?;
+    let config: Config = serde_yaml::from_str(&contents)
+        .map_err(|e| GglError::ConfigParserError(format!("{}", e)))?;
+
+    // The block with the longest root that the repository is under
+    let mut found: Option<(usize, PathBuf)> = None;
+    for (i, block) in config.blocks.iter().enumerate() {
+        let root = match Path::new(&expand(&block.root)?).canonicalize() {
+            Ok(root) => root,
+            Err(_) => continue,
+        };
+        for r in &block.repositories {
+            if root.join(expand(&r.path)?).canonicalize().ok().as_ref() == Some(&dir) {
+                return Err(GglError::ConfigParserError(format!(
+                    "{} is already in the config",
+                    dir.display()
+                )));
+            }
+        }
+        if dir.starts_with(&root) && found.as_ref().map_or(true, |(_, f)| root.starts_with(f)) {
+            found = Some((i, root));
+        }
+    }
+
+    let (root, relative) = match &found {
+        Some((_, root)) => (root.clone(), dir.strip_prefix(root).unwrap().to_path_buf()),
+        None => (
+            dir.parent().unwrap_or(Path::new("/")).to_path_buf(),
+            PathBuf::from(dir.file_name().unwrap_or_default()),
+        ),
+    };
+    let relative = relative.to_string_lossy().to_string();
+    let dir_name = dir
+        .file_name()
+        .map(|n| n.to_string_lossy().to_string())
+        .unwrap_or_default();
+
+    // The name defaults to the path, which is only worth overriding when
+    // the path is more than the directory name
+    let name = name.or_else(|| Some(dir_name).filter(|n| n != &relative));
+    let entry = Entry {
+        path: relative.clone(),
+        name: name.clone(),
+        remote,
+        branch,
+    };
+
+    let updated = match found {
+        Some((i, _)) => add_to_block(&contents, i, &entry)?,
+        None => add_block(&contents, &home_relative(&root), &entry)?,
+    };
+    fs::write(config_path, updated)?;
+    Ok(name.unwrap_or(relative))
+}
+
+// The remote and branch that the current branch tracks; otherwise origin, or
+// the only remote, and the branch its HEAD points at.
+fn upstream(repo: &git2::Repository) -> (String, Option<String>) {
+    let tracked = repo.head().ok().and_then(|head| {
+        let branch = head.shorthand()?.to_string();
+        if !head.is_branch() {
+            return None;
+        }
+        let config = repo.config().ok()?;
+        let remote = config
+            .get_string(&format!("branch.{}.remote", branch))
+            .ok()?;
+        let merge = config
+            .get_string(&format!("branch.{}.merge", branch))
+            .ok()?;
+        let merge = merge
+            .strip_prefix("refs/heads/")
+            .unwrap_or(&merge)
+            .to_string();
+        Some((remote, Some(merge)))
+    });
+    if let Some(tracked) = tracked {
+        return tracked;
+    }
+
+    let remotes: Vec<String> = match repo.remotes() {
+        Ok(remotes) => remotes.iter().flatten().map(String::from).collect(),
+        Err(_) => vec![],
+    };
+    let remote = match remotes.as_slice() {
+        [only] => only.clone(),
+        _ => "origin".to_string(),
+    };
+    (remote, None)
+}
+
+// Write paths in the home directory with a ~, like people do by hand.
+fn home_relative(path: &Path) -> String {
+    if let Some(home) = dirs::home_dir() {
+        if let Ok(rest) = path.strip_prefix(&home) {
+            return Path::new("~").join(rest).to_string_lossy().to_string();
+        }
+    }
+    path.to_string_lossy().to_string()
+}
+
+// Quote a YAML scalar when it could be read as something else.
+fn scalar(s: &str) -> String {
+    let plain = !s.is_empty()
+        && !s.contains(": ")
+        && !s.contains(" #")
+        && !s.ends_with(':')
+        && !s.starts_with(|c: char| "-?:,[]{}#&*!|>'\"%@` ".contains(c))
+        && !s.ends_with(' ');
+    if plain {
+        s.to_string()
+    } else {
+        format!("'{}'", s.replace('\'', "''"))
+    }
+}
+
+fn indent(line: &str) -> usize {
+    line.len() - line.trim_start().len()
+}
+
+// Blank lines and comments don't end a list.
+fn is_content(line: &str) -> bool {
+    let trimmed = line.trim_start();
+    !trimmed.is_empty() && !trimmed.starts_with('#')
+}
+
+fn is_item(line: &str) -> bool {
+    let trimmed = line.trim_start();
+    trimmed == "-" || trimmed.starts_with("- ")
+}
+
+// Where the items of the list under the key at `key` (a line index) are: the
+// first line after the key, the line after the last item, and the indentation
+// of the items.  `end` bounds the search.
+fn list_range(lines: &[&str], key: usize, end: usize) -> Result<(usize, usize, usize), GglError> {
+    let line = lines[key];
+    let column = line.len() - line.trim_start_matches(|c| c == ' ' || c == '-').len();
+    let value = line.splitn(2, ':').nth(1).unwrap_or("");
+    let value = value.split(" #").next().unwrap_or("").trim();
+    if !value.is_empty() {
+        return Err(GglError::ConfigParserError(format!(
+            "can't add to `{}`, please edit it by hand",
+            line.trim()
+        )));
+    }
+
+    let mut last = key;
+    let mut item_indent = None;
+    for (i, line) in lines.iter().enumerate().take(end).skip(key + 1) {
+        if !is_content(line) {
+            continue;
+        }
+        if indent(line) < column || (indent(line) == column && !is_item(line)) {
+            break;
+        }
+        if item_indent.is_none() && is_item(line) {
+            item_indent = Some(indent(line));
+        }
+        last = i;
+    }
+    Ok((key + 1, last + 1, item_indent.unwrap_or(column + 2)))
+}
+
+// The line of `key` in the list item from `start` to `end`.
+fn find_key(lines: &[&str], key: &str, start: usize, end: usize) -> Option<usize> {
+    let first = lines[start].trim_start_matches(|c| c == ' ' || c == '-');
+    let column = lines[start].len() - first.len();
+    let is_key = |text: &str| text.strip_prefix(key).map_or(false, |r| r.starts_with(':'));
+    if is_key(first) {
+        return Some(start);
+    }
+    (start + 1..end).find(|&i| indent(lines[i]) == column && is_key(lines[i].trim_start()))
+}
+
+type Items = (Vec<(usize, usize)>, usize, usize);
+
+// The items of the list under the key at `key`, as ranges of lines, the end
+// of the list, and the indentation of the items.
+fn items(lines: &[&str], key: usize, end: usize) -> Result<Items, GglError> {
+    let (first, end, item_indent) = list_range(lines, key, end)?;
+    let starts: Vec<usize> = (first..end)
+        .filter(|&i| is_item(lines[i]) && indent(lines[i]) == item_indent)
+        .collect();
+    let items = starts
+        .iter()
+        .enumerate()
+        .map(|(n, &s)| (s, starts.get(n + 1).copied().unwrap_or(end)))
+        .collect();
+    Ok((items, end, item_indent))
+}
+
+// The items of the top-level `blocks` list.
+fn blocks(lines: &[&str]) -> Result<Option<Items>, GglError> {
+    match (0..lines.len()).find(|&i| lines[i].starts_with("blocks:")) {
+        Some(key) => Ok(Some(items(lines, key, lines.len())?)),
+        None => Ok(None),
+    }
+}
+
+fn splice(lines: &[&str], at: usize, new: Vec<String>) -> String {
+    let mut out: Vec<String> = lines[..at].iter().map(|l| l.to_string()).collect();
+    out.extend(new);
+    out.extend(lines[at..].iter().map(|l| l.to_string()));
+    out.join("\n") + "\n"
+}
+
+/// Add the entry to the repositories of the `index`th block in the text of
+/// the config.
+pub fn add_to_block(contents: &str, index: usize, entry: &Entry) -> Result<String, GglError> {
+    let lines: Vec<&str> = contents.lines().collect();
+    let unknown = || GglError::ConfigParserError("can't find the block in the config".into());
+    let (items, _, _) = blocks(&lines)?.ok_or_else(unknown)?;
+    let &(start, end) = items.get(index).ok_or_else(unknown)?;
+    let key = find_key(&lines, "repositories", start, end).ok_or_else(unknown)?;
+    let (_, at, item_indent) = list_range(&lines, key, end)?;
+
+    let pad = " ".repeat(item_indent);
+    let new = entry
+        .lines()
+        .iter()
+        .map(|l| format!("{}{}", pad, l))
+        .collect();
+    Ok(splice(&lines, at, new))
+}
+
+/// Add a block with the entry as its only repository at the end of the
+/// blocks in the text of the config.
+pub fn add_block(contents: &str, root: &str, entry: &Entry) -> Result<String, GglError> {
+    let mut lines: Vec<&str> = contents.lines().collect();
+    let (at, item_indent) = match blocks(&lines)? {
+        Some((_, end, item_indent)) => (end, item_indent),
+        None => {
+            lines.push("blocks:");
+            (lines.len(), 2)
+        }
+    };
+
+    let pad = " ".repeat(item_indent);
+    let mut new = vec![
+        format!("{}- root: {}", pad, scalar(root)),
+        format!("{}  repositories:", pad),
+    ];
+    new.extend(entry.lines().iter().map(|l| format!("{}    {}", pad, l)));
+    Ok(splice(&lines, at, new))
+}
+
+/// Remove the repository called `name` from the config file at
+/// `config_path`.  Only the file itself is searched, not the ones it includes.
+pub fn remove(config_path: &Path, name: &str) -> Result<(), GglError> {
+    let contents = fs::read_to_string(config_path)
+        .map_err(|e| GglError::IoError(format!("{}: {}", config_path.display(), e)))?;
+    let config: Config = serde_yaml::from_str(&contents)
+        .map_err(|e| GglError::ConfigParserError(format!("{}", e)))?;
+
+    for (i, block) in config.blocks.iter().enumerate() {
+        let found = block.repositories.iter().position(|r| {
+            let own_name = if r.name.is_empty() { &r.path } else { &r.name };
+            own_name == name
+        });
+        if let Some(j) = found {
+            let updated = remove_from_block(&contents, i, j)?;
+            fs::write(config_path, updated)?;
+            return Ok(());
+        }
+    }
+
+    Err(GglError::ConfigParserError(format!(
+        "there's no {} in {}",
+        name,
+        config_path.display()
+    )))
+}
+
+/// Remove the `index`th repository of the `block`th block from the text of
+/// the config.  Comments after the repository stay, as they're more likely
+/// about the one that follows.
+pub fn remove_from_block(contents: &str, block: usize, index: usize) -> Result<String, GglError> {
+    let lines: Vec<&str> = contents.lines().collect();
+    let unknown = || GglError::ConfigParserError("can't find the repository in the config".into());
+    let (blocks, _, _) = blocks(&lines)?.ok_or_else(unknown)?;
+    let &(start, end) = blocks.get(block).ok_or_else(unknown)?;
+    let key = find_key(&lines, "repositories", start, end).ok_or_else(unknown)?;
+    let (repositories, _, _) = items(&lines, key, end)?;
+    let &(from, to) = repositories.get(index).ok_or_else(unknown)?;
+    let to = (from..to)
+        .filter(|&i| is_content(lines[i]))
+        .last()
+        .unwrap_or(from)
+        + 1;
+
+    let mut out: Vec<String> = vec![];
+    for (i, line) in lines.iter().enumerate() {
+        if i == key && repositories.len() == 1 {
+            // An empty list has to be spelled out, or it's null
+            let colon = line.find(':').unwrap();
+            out.push(format!("{}: []{}", &line[..colon], &line[colon + 1..]));
+        } else if i < from || i >= to {
+            out.push(line.to_string());
+        }
+    }
+    Ok(out.join("\n") + "\n")
+}
@@ -0,0 +1,77 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! The error type shared by the whole crate.
+
+use serde::Deserialize;
+use std::fmt;
+use std::io;
+
+/// Everything that can go wrong while loading the config and collecting the
+/// log.
+#[derive(Debug, Deserialize)]
+pub enum GglError {
+    ConfigParserError(String),
+    GitError(String),
+    IoError(String),
+    CacheError(String),
+    ApiError(String),
+    TemplateError(String),
+    /// A repository took longer than its `timeout`; the others go on.
+    TimeoutError(String),
+    MissingConfigFile,
+}
+
+impl fmt::Display for GglError {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            GglError::ConfigParserError(e) => write!(f, "can't parse the config: {}", e),
+            GglError::GitError(e) => write!(f, "git: {}", e),
+            GglError::IoError(e) => write!(f, "{}", e),
+            GglError::CacheError(e) => write!(f, "cache: {}", e),
+            GglError::ApiError(e) => write!(f, "api: {}", e),
+            GglError::TemplateError(e) => write!(f, "template: {}", e),
+            GglError::TimeoutError(e) => write!(f, "{}", e),
+            GglError::MissingConfigFile => write!(f, "can't find a config file"),
+        }
+    }
+}
+
+impl std::error::Error for GglError {}
+
+impl From<git2::Error> for GglError {
+    fn from(err: git2::Error) -> Self {
+        GglError::GitError(err.message().to_owned())
+    }
+}
+
+impl From<io::Error> for GglError {
+    fn from(err: io::Error) -> Self {
+        GglError::IoError(format!("{}", err))
+    }
+}
+
+impl From<serde_yaml::Error> for GglError {
+    fn from(err: serde_yaml::Error) -> Self {
+        GglError::ConfigParserError(format!("{}", err))
+    }
+}
+
+impl From<serde_json::Error> for GglError {
+    fn from(err: serde_json::Error) -> Self {
+        GglError::CacheError(format!("{}", err))
+    }
+}
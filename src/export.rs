@@ -0,0 +1,221 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl export`: the log in a form for other tools to analyze.
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::config::{Config, RepositoryType};
+use crate::debug;
+use crate::error::GglError;
+use std::collections::HashMap;
+use std::fs;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::process::{Command, Stdio};
+use time::format_description::well_known::Rfc3339;
+
+const SCHEMA: &str = "\
+CREATE TABLE IF NOT EXISTS repositories (
+    name TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    path TEXT NOT NULL,
+    remote TEXT,
+    branch TEXT
+);
+CREATE TABLE IF NOT EXISTS commits (
+    repo TEXT NOT NULL,
+    sha TEXT NOT NULL,
+    author TEXT NOT NULL,
+    email TEXT NOT NULL,
+    date TEXT NOT NULL,
+    committer_date TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    message TEXT NOT NULL,
+    url TEXT,
+    PRIMARY KEY (repo, sha)
+);
+CREATE INDEX IF NOT EXISTS commits_date ON commits (date);
+CREATE INDEX IF NOT EXISTS commits_author ON commits (author);
+CREATE INDEX IF NOT EXISTS commits_repo ON commits (repo);
+";
+
+fn quote(s: &str) -> String {
+    format!("'{}'", s.replace('\'', "''"))
+}
+
+fn quote_option(s: Option<&str>) -> String {
+    s.map_or("NULL".to_string(), quote)
+}
+
+// Dates are stored in UTC, so that they sort as text.
+fn utc(date: &time::OffsetDateTime) -> String {
+    date.to_offset(time::UtcOffset::UTC)
+        .format(&Rfc3339)
+        .unwrap()
+}
+
+fn sqlite_script(config: &Config, timeline: &Timeline) -> String {
+    let mut sql = String::from("BEGIN;\n");
+    sql.push_str(SCHEMA);
+
+    for block in &config.blocks {
+        for r in &block.repositories {
+            sql.push_str(&format!(
+                "INSERT OR REPLACE INTO repositories VALUES ({}, {}, {}, {}, {});\n",
+                quote(&r.name),
+                quote(&format!("{:?}", r.kind).to_lowercase()),
+                quote(&Path::new(&block.root).join(&r.path).to_string_lossy()),
+                quote(&r.remote),
+                quote_option(r.branch.as_deref()),
+            ));
+        }
+    }
+
+    for commit in timeline.commits() {
+        sql.push_str(&format!(
+            "INSERT OR REPLACE INTO commits VALUES ({}, {}, {}, {}, {}, {}, {}, {}, {});\n",
+            quote(&commit.repo_name),
+            quote(&commit.sha),
+            quote(&commit.author),
+            quote(&commit.email),
+            quote(&utc(&commit.date)),
+            quote(&utc(&commit.committer_date)),
+            quote(commit.message.lines().next().unwrap_or("")),
+            quote(&commit.message),
+            quote_option(commit.url.as_deref()),
+        ));
+    }
+
+    sql.push_str("COMMIT;\n");
+    sql
+}
+
+/// Write the commits of `timeline` and the repositories of `config` into the
+/// SQLite database at `path`, creating it if needed, with the sqlite3
+/// command line tool.  Commits that are already there are replaced, so
+/// exporting every day builds up the history.
+pub fn sqlite(path: &Path, config: &Config, timeline: &Timeline) -> Result<(), GglError> {
+    let mut child = Command::new("sqlite3")
+        .arg("-bail")
+        .arg(path)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::null())
+        .stderr(Stdio::piped())
+        .spawn()
+        .map_err(|e| GglError::IoError(format!("can't run sqlite3: {}", e)))?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin.write_all(sqlite_script(config, timeline).as_bytes())?;
+    }
+
+    let output = child.wait_with_output()?;
+    if !output.status.success() {
+        return Err(GglError::IoError(format!(
+            "can't export to {}: {}",
+            path.display(),
+            String::from_utf8_lossy(&output.stderr).trim()
+        )));
+    }
+
+    Ok(())
+}
+
+// The file name `git format-patch` would give the patch: its number and its
+// subject, with anything but letters, digits, dots and underscores turned
+// into dashes.
+fn patch_name(number: usize, subject: &str) -> String {
+    let mut slug = String::new();
+    for c in subject.chars() {
+        if c.is_ascii_alphanumeric() || c == '.' || c == '_' {
+            slug.push(c);
+        } else if !slug.is_empty() && !slug.ends_with('-') {
+            slug.push('-');
+        }
+    }
+    let slug: String = slug.chars().take(52).collect();
+    format!("{:04}-{}.patch", number, slug.trim_end_matches(['-', '.']))
+}
+
+/// Write every commit of `timeline` as a patch in mbox format, like
+/// `git format-patch` does, into a directory per repository in `dir`.  The
+/// patches of a repository are numbered from the oldest.  Merges, and the
+/// commits of repositories that aren't on disk, have no patch.
+pub fn patches(dir: &Path, config: &Config, timeline: &Timeline) -> Result<(), GglError> {
+    let mut repo_paths: HashMap<&str, PathBuf> = HashMap::new();
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local)
+        {
+            repo_paths.insert(&r.name, Path::new(&block.root).join(&r.path));
+        }
+    }
+
+    let mut per_repo: Vec<(&str, Vec<&GlobalCommit>)> = vec![];
+    for commit in timeline.commits() {
+        match per_repo
+            .iter_mut()
+            .find(|(name, _)| *name == commit.repo_name)
+        {
+            Some((_, commits)) => commits.push(commit),
+            None => per_repo.push((&commit.repo_name, vec![commit])),
+        }
+    }
+
+    for (name, mut commits) in per_repo {
+        let path = match repo_paths.get(name) {
+            Some(path) => path,
+            None => {
+                debug!("{} isn't on disk, skipping its patches", name);
+                continue;
+            }
+        };
+        commits.sort_by_key(|c| c.date);
+
+        let repo_dir = dir.join(name.replace('/', "-"));
+        fs::create_dir_all(&repo_dir)?;
+
+        let mut number = 0;
+        for commit in commits {
+            let output = Command::new("git")
+                .arg("-C")
+                .arg(path)
+                .args(["format-patch", "-1", "--stdout", &commit.sha])
+                .stderr(Stdio::piped())
+                .output()
+                .map_err(|e| GglError::IoError(format!("can't run git: {}", e)))?;
+            if !output.status.success() {
+                return Err(GglError::GitError(format!(
+                    "can't format a patch of {} in {}: {}",
+                    commit.short(),
+                    name,
+                    String::from_utf8_lossy(&output.stderr).trim()
+                )));
+            }
+            // Merges come out empty
+            if output.stdout.is_empty() {
+                continue;
+            }
+
+            number += 1;
+            let subject = commit.message.lines().next().unwrap_or("");
+            fs::write(repo_dir.join(patch_name(number, subject)), &output.stdout)?;
+        }
+    }
+
+    Ok(())
+}
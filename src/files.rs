@@ -0,0 +1,224 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl files`: the files and directories that change the most, across all
+//! repositories.
+
+use crate::collect::{open_repository, Timeline};
+use crate::config::{Config, RepositoryType};
+use crate::debug;
+use crate::error::GglError;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::io;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+/// The lines a commit added to and deleted from a file.
+#[derive(Debug)]
+pub struct FileChange {
+    pub path: String,
+    pub added: usize,
+    pub deleted: usize,
+}
+
+/// What a commit changed, file by file, compared to its first parent.
+pub fn changes(
+    repo: &git2::Repository,
+    commit: &git2::Commit,
+) -> Result<Vec<FileChange>, GglError> {
+    let parent_tree = if commit.parent_count() > 0 {
+        Some(commit.parent(0)?.tree()?)
+    } else {
+        None
+    };
+    let diff = repo.diff_tree_to_tree(parent_tree.as_ref(), Some(&commit.tree()?), None)?;
+
+    let mut changes: Vec<FileChange> = vec![];
+    diff.print(git2::DiffFormat::Patch, |delta, _, line| {
+        let path = match delta.new_file().path().or_else(|| delta.old_file().path()) {
+            Some(path) => path.to_string_lossy().into_owned(),
+            None => return true,
+        };
+        if changes.last().map_or(true, |c| c.path != path) {
+            changes.push(FileChange {
+                path,
+                added: 0,
+                deleted: 0,
+            });
+        }
+        let change = changes.last_mut().unwrap();
+        match line.origin() {
+            '+' => change.added += 1,
+            '-' => change.deleted += 1,
+            _ => {}
+        }
+        true
+    })?;
+
+    Ok(changes)
+}
+
+/// The diff of a commit against its first parent, line by line, like
+/// `git show` prints it.
+pub fn patch(path: &Path, sha: &str) -> Result<Vec<String>, git2::Error> {
+    let repo = git2::Repository::open(path)?;
+    let commit = repo.find_commit(git2::Oid::from_str(sha)?)?;
+    let tree = commit.tree()?;
+    let parent_tree = if commit.parent_count() > 0 {
+        Some(commit.parent(0)?.tree()?)
+    } else {
+        None
+    };
+
+    let diff = repo.diff_tree_to_tree(parent_tree.as_ref(), Some(&tree), None)?;
+    let mut lines: Vec<String> = vec![];
+
+    diff.print(git2::DiffFormat::Patch, |_delta, _hunk, line| {
+        let content = String::from_utf8_lossy(line.content());
+        let content = content.trim_end_matches('\n');
+        match line.origin() {
+            '+' | '-' | ' ' => lines.push(format!("{}{}", line.origin(), content)),
+            _ => lines.extend(content.lines().map(String::from)),
+        }
+        true
+    })?;
+
+    Ok(lines)
+}
+
+/// How often a file or directory changed.
+#[derive(Debug, Serialize)]
+pub struct Churn {
+    pub repo: String,
+    pub path: String,
+    pub commits: usize,
+    pub added: usize,
+    pub deleted: usize,
+}
+
+// The directory of a file, with a trailing slash, `./` for the top.
+fn directory(path: &str) -> String {
+    match path.rsplit_once('/') {
+        Some((dir, _)) => format!("{}/", dir),
+        None => "./".to_string(),
+    }
+}
+
+/// Add up what the commits of the timeline changed, per file or, with
+/// `dirs`, per directory, the most often changed first.  Merges are left
+/// out, since their changes are already counted in the commits they bring
+/// in, and so are repositories that aren't on disk.
+pub fn churn(config: &Config, timeline: &Timeline, dirs: bool) -> Result<Vec<Churn>, GglError> {
+    let mut repo_paths: HashMap<&str, PathBuf> = HashMap::new();
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local)
+        {
+            repo_paths.insert(&r.name, Path::new(&block.root).join(&r.path));
+        }
+    }
+
+    let mut repos: HashMap<&str, git2::Repository> = HashMap::new();
+    let mut totals: HashMap<(String, String), Churn> = HashMap::new();
+
+    for commit in timeline.commits() {
+        let name = commit.repo_name.as_str();
+        if !repos.contains_key(name) {
+            let path = match repo_paths.get(name) {
+                Some(path) => path,
+                None => {
+                    debug!("{} isn't on disk, skipping its files", name);
+                    continue;
+                }
+            };
+            repos.insert(name, open_repository(path)?);
+        }
+        let repo = &repos[name];
+
+        let c = repo.find_commit(git2::Oid::from_str(&commit.sha)?)?;
+        if c.parent_count() > 1 {
+            continue;
+        }
+
+        let mut counted: Vec<String> = vec![];
+        for change in changes(repo, &c)? {
+            let path = if dirs {
+                directory(&change.path)
+            } else {
+                change.path
+            };
+            let churn = totals
+                .entry((name.to_string(), path.clone()))
+                .or_insert_with(|| Churn {
+                    repo: name.to_string(),
+                    path: path.clone(),
+                    commits: 0,
+                    added: 0,
+                    deleted: 0,
+                });
+            churn.added += change.added;
+            churn.deleted += change.deleted;
+            // A commit that changes several files in a directory counts once
+            if !counted.contains(&path) {
+                churn.commits += 1;
+                counted.push(path);
+            }
+        }
+    }
+
+    let mut churn: Vec<Churn> = totals.into_values().collect();
+    churn.sort_by(|a, b| {
+        b.commits
+            .cmp(&a.commits)
+            .then((b.added + b.deleted).cmp(&(a.added + a.deleted)))
+            .then(a.repo.cmp(&b.repo))
+            .then(a.path.cmp(&b.path))
+    });
+    Ok(churn)
+}
+
+/// Write a table of the files or directories, one per line.
+pub fn write(w: &mut dyn Write, churn: &[Churn]) -> io::Result<()> {
+    let width = churn
+        .iter()
+        .map(|c| c.repo.chars().count())
+        .chain(Some("Repository".len()))
+        .max()
+        .unwrap_or(0);
+
+    writeln!(
+        w,
+        "Commits    Added  Deleted  {:<width$}  Path",
+        "Repository",
+        width = width
+    )?;
+    for c in churn {
+        writeln!(
+            w,
+            "{:>7}  {:>7}  {:>7}  {:<width$}  {}",
+            c.commits,
+            c.added,
+            c.deleted,
+            c.repo,
+            c.path,
+            width = width
+        )?;
+    }
+    Ok(())
+}
@@ -0,0 +1,522 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Collecting commits from forge APIs, for repositories we don't have a clone
+//! of.  We leave HTTP to curl.
+
+use crate::collect::{CommitSet, GlobalCommit};
+use crate::config::Repository;
+use crate::error::GglError;
+use crate::info;
+use crate::interrupt;
+use serde::de::DeserializeOwned;
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::io::Write;
+use std::process::{Command, Stdio};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+use time::format_description::well_known::Rfc3339;
+use time::OffsetDateTime;
+
+const PER_PAGE: usize = 100;
+// The most Gitea returns by default
+const GITEA_PER_PAGE: usize = 50;
+
+// How many times we wait for a rate limit to pass before giving up.
+const RATE_LIMIT_WAITS: usize = 3;
+// The longest we wait for a rate limit to pass.
+const MAX_RATE_LIMIT_WAIT: u64 = 15 * 60;
+
+// When we last sent a request to each host, for `rate-limit`.
+static LAST_REQUEST: Mutex<Option<HashMap<String, Instant>>> = Mutex::new(None);
+
+struct Response {
+    status: u32,
+    headers: Vec<(String, String)>,
+    body: Vec<u8>,
+}
+
+impl Response {
+    fn header(&self, name: &str) -> Option<&str> {
+        self.headers
+            .iter()
+            .find(|(key, _)| key.eq_ignore_ascii_case(name))
+            .map(|(_, value)| value.as_str())
+    }
+
+    // How long the forge wants us to wait, if it's rate limiting us: a 429,
+    // or a 403 from GitHub once the requests of the hour are used up.
+    fn rate_limited(&self) -> Option<u64> {
+        let exhausted = self.header("x-ratelimit-remaining") == Some("0");
+        if self.status != 429 && !(self.status == 403 && exhausted) {
+            return None;
+        }
+        if let Some(seconds) = self.header("retry-after").and_then(|v| v.parse().ok()) {
+            return Some(seconds);
+        }
+        let reset = self
+            .header("x-ratelimit-reset")
+            .or_else(|| self.header("ratelimit-reset"))
+            .and_then(|v| v.parse::<i64>().ok());
+        let now = OffsetDateTime::now_utc().unix_timestamp();
+        Some(reset.map_or(60, |reset| (reset - now).max(1) as u64))
+    }
+}
+
+// The scheme and host of a URL, which share a rate limit.
+fn host(url: &str) -> &str {
+    let start = url.find("://").map_or(0, |i| i + 3);
+    let end = url[start..].find('/').map_or(url.len(), |i| start + i);
+    &url[..end]
+}
+
+// Wait until the repository's `rate-limit` allows another request to the host.
+fn throttle(url: &str, r: &Repository) {
+    let interval = match r.rate_limit.filter(|&n| n > 0) {
+        Some(n) => Duration::from_secs(60) / n,
+        None => return,
+    };
+    let wait = {
+        let mut last = LAST_REQUEST.lock().unwrap();
+        let last = last.get_or_insert_with(HashMap::new);
+        let now = Instant::now();
+        let next = last
+            .get(host(url))
+            .map_or(now, |&t| (t + interval).max(now));
+        last.insert(host(url).to_string(), next);
+        next - now
+    };
+    interrupt::sleep(wait);
+}
+
+// GET `url` with curl.  Headers go to curl on stdin, so that tokens don't
+// show up in the process list.  `timeout` limits the request, and the
+// repository's `proxy` is used for it.
+fn request(
+    url: &str,
+    headers: &[String],
+    r: &Repository,
+    timeout: Option<Duration>,
+) -> Result<Response, GglError> {
+    let mut cmd = Command::new("curl");
+    cmd.args(["--silent", "--show-error", "--location"])
+        .args(["--dump-header", "-"])
+        .args(["--write-out", "\n%{http_code}"])
+        .args(["--header", "@-"]);
+    if let Some(timeout) = timeout {
+        cmd.arg("--max-time").arg(timeout.as_secs().to_string());
+    }
+    // curl finds the proxy in $HTTPS_PROXY by itself
+    if let Some(proxy) = &r.proxy {
+        cmd.arg("--proxy").arg(proxy);
+    }
+    let mut child = cmd
+        .arg(url)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        for header in headers {
+            writeln!(stdin, "{}", header)?;
+        }
+    }
+
+    let output = child.wait_with_output()?;
+    // curl's exit code for --max-time
+    if output.status.code() == Some(28) {
+        return Err(GglError::TimeoutError(format!(
+            "{} took longer than {}s",
+            url,
+            timeout.map_or(0, |t| t.as_secs())
+        )));
+    }
+    if !output.status.success() {
+        return Err(GglError::ApiError(format!(
+            "{}: {}",
+            url,
+            String::from_utf8_lossy(&output.stderr).trim()
+        )));
+    }
+
+    // The headers of every response on the way, when redirected, then the
+    // body, then the status code of the last response
+    let mut rest = &output.stdout[..];
+    let split = rest.iter().rposition(|&b| b == b'\n').unwrap_or(0);
+    let status = String::from_utf8_lossy(&rest[split..])
+        .trim()
+        .parse()
+        .unwrap_or(0);
+    rest = &rest[..split];
+
+    let mut headers = vec![];
+    while rest.starts_with(b"HTTP/") {
+        let end = rest
+            .windows(4)
+            .position(|w| w == b"\r\n\r\n")
+            .map_or(rest.len(), |i| i + 4);
+        headers = String::from_utf8_lossy(&rest[..end])
+            .lines()
+            .skip(1)
+            .filter_map(|line| line.split_once(':'))
+            .map(|(key, value)| (key.trim().to_string(), value.trim().to_string()))
+            .collect();
+        rest = &rest[end..];
+    }
+
+    Ok(Response {
+        status,
+        headers,
+        body: rest.to_vec(),
+    })
+}
+
+// GET `url` and parse the JSON response.  When the forge says we're making
+// too many requests, we wait as long as it asks us to, and try again.
+fn get_json<T: DeserializeOwned>(
+    url: &str,
+    headers: &[String],
+    r: &Repository,
+    timeout: Option<Duration>,
+) -> Result<T, GglError> {
+    let mut waits = 0;
+    let response = loop {
+        throttle(url, r);
+        let response = request(url, headers, r, timeout)?;
+        match response.rate_limited() {
+            Some(wait) if waits < RATE_LIMIT_WAITS && wait <= MAX_RATE_LIMIT_WAIT => {
+                info!("{}: rate limited, waiting {}s", r.name, wait);
+                interrupt::sleep(Duration::from_secs(wait));
+                if interrupt::interrupted() {
+                    break response;
+                }
+                waits += 1;
+            }
+            _ => break response,
+        }
+    };
+
+    if !(200..300).contains(&response.status) {
+        let body = String::from_utf8_lossy(&response.body);
+        return Err(GglError::ApiError(format!(
+            "{}: HTTP {}: {}",
+            url,
+            response.status,
+            body.trim().chars().take(200).collect::<String>()
+        )));
+    }
+
+    serde_json::from_slice(&response.body)
+        .map_err(|e| GglError::ApiError(format!("{}: {}", url, e)))
+}
+
+fn parse_date(s: &str) -> Result<OffsetDateTime, GglError> {
+    OffsetDateTime::parse(s, &Rfc3339).map_err(|e| GglError::ApiError(format!("{}: {}", s, e)))
+}
+
+fn rfc3339(t: i64) -> Result<String, GglError> {
+    OffsetDateTime::from_unix_timestamp(t)
+        .ok()
+        .and_then(|t| t.format(&Rfc3339).ok())
+        .ok_or_else(|| GglError::ApiError(format!("invalid cutoff: {}", t)))
+}
+
+// Every commit from the API becomes its own set; we don't know which commits
+// a merge brought in without walking the history ourselves.
+fn into_sets(commits: Vec<GlobalCommit>) -> Vec<CommitSet> {
+    commits
+        .into_iter()
+        .map(|commit| CommitSet {
+            date: commit.date,
+            commits: vec![commit],
+        })
+        .collect()
+}
+
+fn token(r: &Repository, env: &str) -> Option<String> {
+    r.token.clone().or_else(|| std::env::var(env).ok())
+}
+
+#[derive(Deserialize)]
+struct GithubCommit {
+    sha: String,
+    html_url: String,
+    commit: GithubCommitDetails,
+}
+
+#[derive(Deserialize)]
+struct GithubCommitDetails {
+    author: GithubSignature,
+    committer: GithubSignature,
+    message: String,
+}
+
+#[derive(Deserialize)]
+struct GithubSignature {
+    name: String,
+    email: String,
+    date: String,
+}
+
+/// Collect the commits of `owner/repo` (the repository's `path`) on GitHub
+/// since `until`, on `branch` or the default branch.  The token comes from
+/// the config, or from $GITHUB_TOKEN.
+pub fn collect_github(
+    r: &Repository,
+    until: git2::Time,
+    timeout: Option<Duration>,
+) -> Result<Vec<CommitSet>, GglError> {
+    let base = r.url.as_deref().unwrap_or("https://api.github.com");
+    let mut headers = vec![
+        "Accept: application/vnd.github+json".to_string(),
+        "User-Agent: ggl".to_string(),
+    ];
+    if let Some(token) = token(r, "GITHUB_TOKEN") {
+        headers.push(format!("Authorization: Bearer {}", token));
+    }
+
+    let mut url = format!(
+        "{}/repos/{}/commits?per_page={}&since={}",
+        base.trim_end_matches('/'),
+        r.path,
+        PER_PAGE,
+        rfc3339(until.seconds())?
+    );
+    if let Some(branch) = &r.branch {
+        url.push_str(&format!("&sha={}", encode_path(branch)));
+    }
+
+    let mut commits = vec![];
+    for page in 1.. {
+        // curl got the Ctrl-C too, and fails
+        let batch: Vec<GithubCommit> =
+            match get_json(&format!("{}&page={}", url, page), &headers, r, timeout) {
+                Ok(batch) => batch,
+                Err(_) if interrupt::interrupted() => break,
+                Err(e) => return Err(e),
+            };
+        let done = batch.len() < PER_PAGE;
+
+        for c in batch {
+            commits.push(GlobalCommit {
+                author: c.commit.author.name,
+                email: c.commit.author.email,
+                date: parse_date(&c.commit.author.date)?,
+                committer: c.commit.committer.name,
+                committer_email: c.commit.committer.email,
+                committer_date: parse_date(&c.commit.committer.date)?,
+                message: c.commit.message,
+                repo_name: r.name.clone(),
+                sha: c.sha,
+                url: Some(c.html_url),
+                refs: vec![],
+                signature: None,
+                also_in: vec![],
+                branches: vec![],
+                trailers: vec![],
+                tickets: vec![],
+                short_sha: String::new(),
+                team: None,
+                notes: None,
+            });
+        }
+
+        if done {
+            break;
+        }
+    }
+
+    Ok(into_sets(commits))
+}
+
+#[derive(Deserialize)]
+struct GitlabCommit {
+    id: String,
+    message: String,
+    author_name: String,
+    author_email: String,
+    authored_date: String,
+    #[serde(default)]
+    committer_name: String,
+    #[serde(default)]
+    committer_email: String,
+    committer_date: String,
+    web_url: String,
+}
+
+// Encode a project path like group/project for use as a single URL segment.
+fn encode_path(path: &str) -> String {
+    let mut encoded = String::with_capacity(path.len());
+    for b in path.bytes() {
+        match b {
+            b'A'..=b'Z' | b'a'..=b'z' | b'0'..=b'9' | b'-' | b'_' | b'.' | b'~' => {
+                encoded.push(b as char)
+            }
+            _ => encoded.push_str(&format!("%{:02X}", b)),
+        }
+    }
+    encoded
+}
+
+/// Collect the commits of the project `group/project` (the repository's
+/// `path`) on GitLab since `until`.  `url` is the GitLab instance, gitlab.com
+/// by default, and the token comes from the config or from $GITLAB_TOKEN.
+pub fn collect_gitlab(
+    r: &Repository,
+    until: git2::Time,
+    timeout: Option<Duration>,
+) -> Result<Vec<CommitSet>, GglError> {
+    let base = r.url.as_deref().unwrap_or("https://gitlab.com");
+    let mut headers = vec![];
+    if let Some(token) = token(r, "GITLAB_TOKEN") {
+        headers.push(format!("PRIVATE-TOKEN: {}", token));
+    }
+
+    let mut url = format!(
+        "{}/api/v4/projects/{}/repository/commits?per_page={}&since={}",
+        base.trim_end_matches('/'),
+        encode_path(&r.path),
+        PER_PAGE,
+        encode_path(&rfc3339(until.seconds())?)
+    );
+    if let Some(branch) = &r.branch {
+        url.push_str(&format!("&ref_name={}", encode_path(branch)));
+    }
+
+    let mut commits = vec![];
+    for page in 1.. {
+        // curl got the Ctrl-C too, and fails
+        let batch: Vec<GitlabCommit> =
+            match get_json(&format!("{}&page={}", url, page), &headers, r, timeout) {
+                Ok(batch) => batch,
+                Err(_) if interrupt::interrupted() => break,
+                Err(e) => return Err(e),
+            };
+        let done = batch.len() < PER_PAGE;
+
+        for c in batch {
+            commits.push(GlobalCommit {
+                author: c.author_name,
+                email: c.author_email,
+                date: parse_date(&c.authored_date)?,
+                committer: c.committer_name,
+                committer_email: c.committer_email,
+                committer_date: parse_date(&c.committer_date)?,
+                message: c.message,
+                repo_name: r.name.clone(),
+                sha: c.id,
+                url: Some(c.web_url),
+                refs: vec![],
+                signature: None,
+                also_in: vec![],
+                branches: vec![],
+                trailers: vec![],
+                tickets: vec![],
+                short_sha: String::new(),
+                team: None,
+                notes: None,
+            });
+        }
+
+        if done {
+            break;
+        }
+    }
+
+    Ok(into_sets(commits))
+}
+
+/// Collect the commits of `owner/repo` (the repository's `path`) on a Gitea
+/// or Forgejo instance at `url`, since `until`.  The token comes from the
+/// config or from $GITEA_TOKEN.
+pub fn collect_gitea(
+    r: &Repository,
+    until: git2::Time,
+    timeout: Option<Duration>,
+) -> Result<Vec<CommitSet>, GglError> {
+    let base = r
+        .url
+        .as_deref()
+        .ok_or_else(|| GglError::ApiError(format!("{} needs the url of the instance", r.name)))?;
+    let mut headers = vec![];
+    if let Some(token) = token(r, "GITEA_TOKEN") {
+        headers.push(format!("Authorization: token {}", token));
+    }
+
+    // Older versions don't filter by date, so we page until we're past the
+    // cutoff ourselves.  The commits come newest committed first, and the
+    // author date is no later than that, so the committer date tells when
+    // we're done whichever date --date-source picks.  Skipping the stats and files makes this much faster.
+    let mut url = format!(
+        "{}/api/v1/repos/{}/commits?limit={}&stat=false&verification=false&files=false",
+        base.trim_end_matches('/'),
+        r.path,
+        GITEA_PER_PAGE
+    );
+    if let Some(branch) = &r.branch {
+        url.push_str(&format!("&sha={}", encode_path(branch)));
+    }
+
+    let mut commits = vec![];
+    for page in 1.. {
+        // curl got the Ctrl-C too, and fails
+        let batch: Vec<GithubCommit> =
+            match get_json(&format!("{}&page={}", url, page), &headers, r, timeout) {
+                Ok(batch) => batch,
+                Err(_) if interrupt::interrupted() => break,
+                Err(e) => return Err(e),
+            };
+        let mut done = batch.len() < GITEA_PER_PAGE;
+
+        for c in batch {
+            let committer_date = parse_date(&c.commit.committer.date)?;
+            if committer_date.unix_timestamp() < until.seconds() {
+                done = true;
+                break;
+            }
+
+            commits.push(GlobalCommit {
+                author: c.commit.author.name,
+                email: c.commit.author.email,
+                date: parse_date(&c.commit.author.date)?,
+                committer: c.commit.committer.name,
+                committer_email: c.commit.committer.email,
+                committer_date,
+                message: c.commit.message,
+                repo_name: r.name.clone(),
+                sha: c.sha,
+                url: Some(c.html_url),
+                refs: vec![],
+                signature: None,
+                also_in: vec![],
+                branches: vec![],
+                trailers: vec![],
+                tickets: vec![],
+                short_sha: String::new(),
+                team: None,
+                notes: None,
+            });
+        }
+
+        if done {
+            break;
+        }
+    }
+
+    Ok(into_sets(commits))
+}
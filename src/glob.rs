@@ -0,0 +1,238 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Matching file paths against shell-style glob patterns.
+
+/// Whether `path` matches `pattern`.  `*` and `?` match within a single path
+/// component, `[a-z]` and `[!a-z]` match a character in or out of the class,
+/// and `**` matches any number of components, including none, so
+/// `**/Dockerfile` matches both `Dockerfile` and `a/b/Dockerfile`.
+pub fn matches(pattern: &str, path: &str) -> bool {
+    let pattern: Vec<Vec<Token>> = pattern.split('/').map(tokens).collect();
+    let path: Vec<Vec<char>> = path.split('/').map(|c| c.chars().collect()).collect();
+    match_components(&pattern, &path)
+}
+
+enum Token {
+    Star,
+    Any,
+    Char(char),
+    Class {
+        negated: bool,
+        ranges: Vec<(char, char)>,
+    },
+}
+
+// `**` on its own spans components; anywhere else it's just two `*`s.
+fn is_globstar(component: &[Token]) -> bool {
+    matches!(component, [Token::Star, Token::Star])
+}
+
+fn tokens(component: &str) -> Vec<Token> {
+    let chars: Vec<char> = component.chars().collect();
+    let mut tokens = Vec::new();
+    let mut i = 0;
+
+    while i < chars.len() {
+        match chars[i] {
+            '*' => tokens.push(Token::Star),
+            '?' => tokens.push(Token::Any),
+            '[' => match class(&chars[i + 1..]) {
+                Some((token, len)) => {
+                    tokens.push(token);
+                    i += len;
+                }
+                // Without a closing `]`, `[` is just a character
+                None => tokens.push(Token::Char('[')),
+            },
+            c => tokens.push(Token::Char(c)),
+        }
+        i += 1;
+    }
+
+    tokens
+}
+
+// The class at the start of `chars`, just after its `[`, and how many
+// characters it takes up to and including the `]`.  A `]` right at the start
+// is part of the class.
+fn class(chars: &[char]) -> Option<(Token, usize)> {
+    let negated = matches!(chars.first(), Some('!') | Some('^'));
+    let mut i = negated as usize;
+    let mut ranges = Vec::new();
+
+    loop {
+        let c = *chars.get(i)?;
+        if c == ']' && i > negated as usize {
+            return Some((Token::Class { negated, ranges }, i + 1));
+        }
+        match (chars.get(i + 1), chars.get(i + 2)) {
+            (Some('-'), Some(&end)) if end != ']' => {
+                ranges.push((c, end));
+                i += 3;
+            }
+            _ => {
+                ranges.push((c, c));
+                i += 1;
+            }
+        }
+    }
+}
+
+// Both matchers below remember only the last star and where it started to
+// match, and on a mismatch give it one more component or character.  Since
+// everything else matches exactly one, a later star can always take over what
+// an earlier one would have, so this takes time proportional to the product of
+// the lengths rather than exponential in the number of stars.
+
+fn match_components(pattern: &[Vec<Token>], path: &[Vec<char>]) -> bool {
+    let (mut p, mut n) = (0, 0);
+    let mut star: Option<(usize, usize)> = None;
+
+    while n < path.len() {
+        if p < pattern.len() && is_globstar(&pattern[p]) {
+            star = Some((p, n));
+            p += 1;
+        } else if p < pattern.len() && match_component(&pattern[p], &path[n]) {
+            p += 1;
+            n += 1;
+        } else if let Some((star_p, star_n)) = star {
+            star = Some((star_p, star_n + 1));
+            p = star_p + 1;
+            n = star_n + 1;
+        } else {
+            return false;
+        }
+    }
+
+    pattern[p..].iter().all(|component| is_globstar(component))
+}
+
+fn match_component(pattern: &[Token], name: &[char]) -> bool {
+    let (mut p, mut n) = (0, 0);
+    let mut star: Option<(usize, usize)> = None;
+
+    while n < name.len() {
+        match pattern.get(p) {
+            Some(Token::Star) => {
+                star = Some((p, n));
+                p += 1;
+                continue;
+            }
+            Some(token) if token.matches(name[n]) => {
+                p += 1;
+                n += 1;
+                continue;
+            }
+            _ => {}
+        }
+        match star {
+            Some((star_p, star_n)) => {
+                star = Some((star_p, star_n + 1));
+                p = star_p + 1;
+                n = star_n + 1;
+            }
+            None => return false,
+        }
+    }
+
+    pattern[p..]
+        .iter()
+        .all(|token| matches!(token, Token::Star))
+}
+
+impl Token {
+    fn matches(&self, c: char) -> bool {
+        match self {
+            Token::Star => true,
+            Token::Any => true,
+            Token::Char(expected) => c == *expected,
+            Token::Class { negated, ranges } => {
+                ranges
+                    .iter()
+                    .any(|(start, end)| (*start..=*end).contains(&c))
+                    != *negated
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn stars_stay_in_a_component() {
+        assert!(matches("*-mirror", "linux-mirror"));
+        assert!(matches("*-mirror", "-mirror"));
+        assert!(matches("a*b*c", "aXbYbZc"));
+        assert!(!matches("*-mirror", "linux-mirror-old"));
+        assert!(!matches("*.rs", "src/main.rs"));
+        assert!(matches("src/*.rs", "src/main.rs"));
+    }
+
+    #[test]
+    fn question_marks_match_one_character() {
+        assert!(matches("v?", "v1"));
+        assert!(!matches("v?", "v"));
+        assert!(!matches("v?", "v10"));
+        assert!(!matches("a?b", "a/b"));
+    }
+
+    #[test]
+    fn globstars_match_any_number_of_components() {
+        assert!(matches("**/Dockerfile", "Dockerfile"));
+        assert!(matches("**/Dockerfile", "a/b/Dockerfile"));
+        assert!(matches("deploy/**", "deploy/a/b.yaml"));
+        assert!(matches("deploy/**", "deploy"));
+        assert!(matches("a/**/b/**/c", "a/x/b/y/z/c"));
+        assert!(matches("**", "anything/at/all"));
+        assert!(!matches("deploy/**", "src/deploy.rs"));
+        assert!(!matches("a/**/c", "a/b/d"));
+    }
+
+    #[test]
+    fn classes() {
+        assert!(matches("v[0-9]", "v7"));
+        assert!(!matches("v[0-9]", "vx"));
+        assert!(matches("[!.]*", "README"));
+        assert!(!matches("[!.]*", ".git"));
+        assert!(matches("[^a-c]", "d"));
+        assert!(matches("[]x]", "]"));
+        assert!(matches("[a-]", "-"));
+        assert!(matches("a[b", "a[b"));
+    }
+
+    #[test]
+    fn non_ascii_names() {
+        assert!(matches("caf?", "café"));
+        assert!(matches("*é", "café"));
+        assert!(matches("[à-ž]*", "émigré"));
+        assert!(matches("日本/*.md", "日本/読んで.md"));
+        assert!(!matches("caf?", "cafée"));
+    }
+
+    #[test]
+    fn pathological_patterns_are_fast() {
+        let name = "a".repeat(100);
+        let pattern = "a*".repeat(30) + "b";
+        assert!(!matches(&pattern, &name));
+
+        let path = vec!["a"; 100].join("/");
+        let pattern = "**/a/".repeat(30) + "b";
+        assert!(!matches(&pattern, &path));
+    }
+}
@@ -0,0 +1,126 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl heatmap`: a calendar of commits per day, like the one on GitHub
+//! profiles.
+
+use crate::collect::Timeline;
+use colored::Colorize;
+use std::collections::HashMap;
+use std::io;
+use std::io::Write;
+
+// From no commits to the busiest days
+const LEVELS: [char; 5] = ['·', '░', '▒', '▓', '█'];
+
+/// Count the commits of every day, in the timezone of the dates in the
+/// timeline.  With `author`, only the commits whose author's or co-author's
+/// name or email contains it, ignoring case.
+pub fn counts(timeline: &Timeline, author: Option<&str>) -> HashMap<time::Date, usize> {
+    let mut counts = HashMap::new();
+
+    for commit in timeline.commits() {
+        if let Some(author) = author {
+            if !commit.authored_by(author) {
+                continue;
+            }
+        }
+        *counts.entry(commit.date.date()).or_insert(0) += 1;
+    }
+
+    counts
+}
+
+// 0 for no commits, up to 4 for the busiest days.
+fn level(count: usize, max: usize) -> usize {
+    if count == 0 {
+        0
+    } else {
+        (4 * count).div_ceil(max).clamp(1, 4)
+    }
+}
+
+/// Write a grid with a column per week and a row per weekday, from the week
+/// of `from` up to `today`, with the months above it.
+pub fn write(
+    w: &mut dyn Write,
+    counts: &HashMap<time::Date, usize>,
+    from: time::Date,
+    today: time::Date,
+    color: bool,
+) -> io::Result<()> {
+    let start = from - time::Duration::days(from.weekday().number_days_from_monday() as i64);
+    let weeks = (today - start).whole_weeks() + 1;
+    let max = counts.values().copied().max().unwrap_or(0);
+
+    // A month's name goes above the first week that starts in it, unless
+    // the previous name is still in the way
+    let mut months = String::new();
+    let mut previous = None;
+    for week in 0..weeks {
+        let month = (start + time::Duration::weeks(week)).month();
+        let column = 2 * week as usize;
+        if previous != Some(month) && months.len() <= column {
+            months.push_str(&" ".repeat(column - months.len()));
+            months.push_str(&month.to_string()[..3]);
+        }
+        previous = Some(month);
+    }
+    writeln!(w, "    {}", months)?;
+
+    for weekday in 0..7 {
+        let label = match weekday {
+            0 => "Mon",
+            2 => "Wed",
+            4 => "Fri",
+            _ => "",
+        };
+        let mut row = format!("{:<4}", label);
+
+        for week in 0..weeks {
+            let day = start + time::Duration::days(7 * week + weekday);
+            if day > today {
+                break;
+            }
+            let count = counts.get(&day).copied().unwrap_or(0);
+            let cell = LEVELS[level(count, max)].to_string();
+            if color && count > 0 {
+                row.push_str(&cell.green().to_string());
+            } else {
+                row.push_str(&cell);
+            }
+            row.push(' ');
+        }
+        writeln!(w, "{}", row.trim_end())?;
+    }
+
+    let total: usize = counts
+        .iter()
+        .filter(|(day, _)| **day >= start && **day <= today)
+        .map(|(_, count)| count)
+        .sum();
+    writeln!(w)?;
+    writeln!(
+        w,
+        "{} commits    Less {} More",
+        total,
+        LEVELS
+            .iter()
+            .map(|c| c.to_string())
+            .collect::<Vec<_>>()
+            .join(" ")
+    )
+}
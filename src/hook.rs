@@ -0,0 +1,104 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Push webhooks from GitHub and GitLab, which `ggl serve` takes as a cue to
+//! fetch the repository right away instead of on the next round.
+
+use crate::collect::{open_repository, remote_views};
+use crate::config::{Config, RepositoryType};
+use crate::error::GglError;
+use std::path::Path;
+
+/// The URLs a push payload gives for its repository.  GitHub has them under
+/// `repository`, GitLab under `project` and `repository`.
+pub fn payload_urls(body: &[u8]) -> Result<Vec<String>, GglError> {
+    let payload: serde_json::Value = serde_json::from_slice(body)
+        .map_err(|e| GglError::ApiError(format!("can't parse the payload: {}", e)))?;
+
+    let keys = [
+        "clone_url",
+        "ssh_url",
+        "git_url",
+        "html_url",
+        "git_http_url",
+        "git_ssh_url",
+        "web_url",
+        "homepage",
+    ];
+    let mut urls = vec![];
+    for object in ["repository", "project"] {
+        for key in keys {
+            if let Some(url) = payload[object][key].as_str() {
+                urls.push(url.to_string());
+            }
+        }
+    }
+    Ok(urls)
+}
+
+/// Reduce the many ways of writing the URL of a repository to one, so that
+/// `git@github.com:honza/ggl.git` and `https://github.com/honza/ggl` are the
+/// same: no scheme, user, or `.git`, and `/` after the host.
+pub fn normalize_url(url: &str) -> String {
+    let mut rest = url.trim().trim_end_matches('/');
+    let scp_like = !rest.contains("://");
+    if let Some((_, after)) = rest.split_once("://") {
+        rest = after;
+    }
+    if let Some((user, after)) = rest.split_once('@') {
+        if !user.contains('/') {
+            rest = after;
+        }
+    }
+    let rest = rest.trim_end_matches(".git");
+    let (host, path) = if scp_like {
+        rest.split_once(':').unwrap_or((rest, ""))
+    } else {
+        rest.split_once('/').unwrap_or((rest, ""))
+    };
+    format!("{}/{}", host.to_lowercase(), path.trim_start_matches('/'))
+}
+
+/// The names of the local repositories in the config with a remote at one of
+/// `urls`.
+pub fn repositories(config: &Config, urls: &[String]) -> Vec<String> {
+    let urls: Vec<String> = urls.iter().map(|url| normalize_url(url)).collect();
+    let mut names = vec![];
+
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local)
+        {
+            let repo = match open_repository(&Path::new(&block.root).join(&r.path)) {
+                Ok(repo) => repo,
+                Err(_) => continue,
+            };
+            let pushed = remote_views(r).iter().any(|view| {
+                repo.find_remote(&view.remote)
+                    .ok()
+                    .and_then(|remote| remote.url().map(normalize_url))
+                    .map_or(false, |url| urls.contains(&url))
+            });
+            if pushed {
+                names.push(r.name.clone());
+            }
+        }
+    }
+
+    names
+}
@@ -0,0 +1,73 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Ctrl-C while collecting: instead of dying halfway through, the walks stop
+//! where they are, and the log shows what was collected up to then.  A second
+//! Ctrl-C kills ggl as usual.
+//!
+//! `ggl serve` and `ggl daemon` also take SIGTERM this way, to shut down
+//! cleanly when their container is stopped.
+
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::time::{Duration, Instant};
+
+static INTERRUPTED: AtomicBool = AtomicBool::new(false);
+
+#[cfg(unix)]
+extern "C" fn on_signal(signal: libc::c_int) {
+    INTERRUPTED.store(true, Ordering::SeqCst);
+    unsafe {
+        libc::signal(signal, libc::SIG_DFL);
+    }
+}
+
+/// Catch Ctrl-C from now on, until [`restore`].
+pub fn install() {
+    #[cfg(unix)]
+    unsafe {
+        libc::signal(libc::SIGINT, on_signal as libc::sighandler_t);
+    }
+}
+
+/// Catch SIGTERM like Ctrl-C from now on.
+pub fn catch_sigterm() {
+    #[cfg(unix)]
+    unsafe {
+        libc::signal(libc::SIGTERM, on_signal as libc::sighandler_t);
+    }
+}
+
+/// Let Ctrl-C kill ggl again, e.g. before handing the terminal to the user.
+pub fn restore() {
+    #[cfg(unix)]
+    unsafe {
+        libc::signal(libc::SIGINT, libc::SIG_DFL);
+    }
+}
+
+/// Whether Ctrl-C was pressed since [`install`].  Long operations check this
+/// to stop early.
+pub fn interrupted() -> bool {
+    INTERRUPTED.load(Ordering::SeqCst)
+}
+
+/// Sleep for `duration`, or until Ctrl-C is pressed.
+pub fn sleep(duration: Duration) {
+    let started = Instant::now();
+    while started.elapsed() < duration && !interrupted() {
+        std::thread::sleep(Duration::from_millis(100).min(duration));
+    }
+}
@@ -0,0 +1,80 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! ggl shows a log of git commits from multiple repositories ordered by time.
+//!
+//! The command line tool is a thin wrapper around this library, so the same
+//! aggregation can be embedded in other programs:
+//!
+//! ```no_run
+//! let path = ggl::config::get_config_path(None)?;
+//! let config = ggl::config::load_config(path)?;
+//! let opts = ggl::collect::CollectOptions::default();
+//! let until = git2::Time::new(ggl::collect::get_until(&None)?, 0);
+//! let timeline = ggl::collect::collect_timeline(&config, &opts, until)?;
+//!
+//! for commit in timeline.commits() {
+//!     println!("{} {}", commit.repo_name, commit.sha);
+//! }
+//! # Ok::<(), ggl::GglError>(())
+//! ```
+
+pub mod cache;
+pub mod changelog;
+pub mod collect;
+pub mod compare;
+pub mod completion;
+pub mod config;
+pub mod cron;
+pub mod daemon;
+pub mod digest;
+pub mod edit;
+pub mod error;
+pub mod export;
+pub mod files;
+pub mod forge;
+pub mod glob;
+pub mod heatmap;
+pub mod hook;
+pub mod interrupt;
+pub mod logger;
+pub mod mailmap;
+pub mod metrics;
+pub mod notify;
+pub mod output;
+pub mod pattern;
+pub mod query;
+pub mod report;
+pub mod repos;
+pub mod rules;
+pub mod search;
+pub mod serve;
+pub mod signature;
+pub mod source;
+pub mod standup;
+pub mod state;
+pub mod stats;
+pub mod sync;
+pub mod template;
+pub mod tickets;
+pub mod trailer;
+#[cfg(unix)]
+pub mod tui;
+pub mod ui;
+
+pub use collect::{collect_timeline, CollectOptions, CommitSet, Entry, GlobalCommit, Timeline};
+pub use config::Config;
+pub use error::GglError;
@@ -0,0 +1,60 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! A small leveled logger for the messages we print while working, on stderr
+//! so they stay out of piped output.  Errors and warnings are always printed.
+
+use std::sync::atomic::{AtomicU8, Ordering};
+
+#[derive(Debug, Clone, Copy, PartialEq, PartialOrd)]
+pub enum Level {
+    /// Only errors and warnings.
+    Quiet = 0,
+    /// What we're doing, e.g. which repository we're fetching.
+    Normal = 1,
+    /// How long things take, and which refs we walk.
+    Verbose = 2,
+}
+
+static LEVEL: AtomicU8 = AtomicU8::new(Level::Normal as u8);
+
+pub fn set_level(level: Level) {
+    LEVEL.store(level as u8, Ordering::Relaxed);
+}
+
+pub fn enabled(level: Level) -> bool {
+    LEVEL.load(Ordering::Relaxed) >= level as u8
+}
+
+/// Print a message unless we're quiet.
+#[macro_export]
+macro_rules! info {
+    ($($arg:tt)*) => {
+        if $crate::logger::enabled($crate::logger::Level::Normal) {
+            eprintln!($($arg)*);
+        }
+    };
+}
+
+/// Print a message only when we're verbose.
+#[macro_export]
+macro_rules! debug {
+    ($($arg:tt)*) => {
+        if $crate::logger::enabled($crate::logger::Level::Verbose) {
+            eprintln!($($arg)*);
+        }
+    };
+}
@@ -0,0 +1,98 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Map the names and emails people committed under to the ones they go by:
+//! the repositories' `.mailmap` files, the `mailmap` in the config, and then
+//! the `authors` in the config.
+
+use crate::collect::CommitSet;
+use crate::config::{Alias, Config};
+use crate::debug;
+use crate::error::GglError;
+use std::fs;
+
+/// What the config says about identities, read once for all repositories.
+pub struct Identities {
+    global: Option<git2::Mailmap>,
+    aliases: Vec<Alias>,
+}
+
+impl Identities {
+    pub fn load(config: &Config) -> Result<Self, GglError> {
+        let global = match &config.mailmap {
+            Some(path) => {
+                let contents = fs::read_to_string(path)
+                    .map_err(|e| GglError::IoError(format!("{}: {}", path, e)))?;
+                Some(git2::Mailmap::from_buffer(&contents)?)
+            }
+            None => None,
+        };
+        Ok(Identities {
+            global,
+            aliases: config.authors.clone(),
+        })
+    }
+
+    /// Apply the repository's own mailmap, then the global one, so that the
+    /// global one has the last word, and then the aliases.
+    pub fn apply(&self, sets: &mut [CommitSet], repo: Option<&git2::Repository>) {
+        if let Some(repo) = repo {
+            match repo.mailmap() {
+                Ok(mailmap) => apply_mailmap(sets, &mailmap),
+                Err(e) => debug!("can't read the mailmap: {}", e),
+            }
+        }
+        if let Some(mailmap) = &self.global {
+            apply_mailmap(sets, mailmap);
+        }
+        if !self.aliases.is_empty() {
+            apply_aliases(sets, &self.aliases);
+        }
+    }
+}
+
+/// Rewrite the author of every commit in the sets.  Commits that the mailmap
+/// doesn't mention are left alone.
+pub fn apply_mailmap(sets: &mut [CommitSet], mailmap: &git2::Mailmap) {
+    for commit in sets.iter_mut().flat_map(|set| set.commits.iter_mut()) {
+        let resolved = git2::Signature::now(&commit.author, &commit.email)
+            .and_then(|sig| mailmap.resolve_signature(&sig));
+        if let Ok(sig) = resolved {
+            commit.author = sig.name().unwrap_or(&commit.author).to_string();
+            commit.email = sig.email().unwrap_or(&commit.email).to_string();
+        }
+    }
+}
+
+/// Give the commits of every alias its name and team.  The first alias that
+/// matches wins.
+pub fn apply_aliases(sets: &mut [CommitSet], aliases: &[Alias]) {
+    for commit in sets.iter_mut().flat_map(|set| set.commits.iter_mut()) {
+        let alias = aliases.iter().find(|alias| {
+            alias
+                .emails
+                .iter()
+                .any(|e| e.eq_ignore_ascii_case(&commit.email))
+                || alias.names.iter().any(|n| n == &commit.author)
+        });
+        if let Some(alias) = alias {
+            if let Some(name) = &alias.name {
+                commit.author = name.clone();
+            }
+            commit.team = alias.team.clone();
+        }
+    }
+}
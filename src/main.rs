@@ -14,432 +14,956 @@
 // You should have received a copy of the GNU General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-use colored::*;
-use dirs;
-use git2;
-use serde::{Deserialize, Serialize};
+use ggl::collect::{
+    collect_timeline, days_ago, fetch_all, get_until, CollectOptions, DateSource, SortOrder,
+};
+use ggl::compare::{self, Window};
+use ggl::config::{excluded, get_config_path, load_config, Config};
+use ggl::logger::{self, Level};
+use ggl::output::{
+    convert_dates, group_by_week, limit_bodies, write_output, write_split, write_weeks, DateFormat,
+    DateZone, GroupBy, Output, OutputFormat, Style, Width,
+};
+use ggl::pattern::Pattern;
+use ggl::report::{self, Month};
+use ggl::template::Template;
+use ggl::{
+    cache, changelog, completion, daemon, digest, edit, export, files, heatmap, interrupt, query,
+    repos, search, serve, standup, state, stats, sync, tickets, GglError,
+};
 use std::fs;
-use std::path::{Path, PathBuf};
-use std::str;
+use std::io;
+use std::io::{IsTerminal, Write};
+use std::path::PathBuf;
+use std::process;
+use structopt::clap::Shell;
 use structopt::StructOpt;
-use time;
-
-// git format: Wed Nov 16 11:05:18 2022 -0400
-static DATETIME: &str = "[weekday repr:short] [month repr:short] \
-                         [day padding:none] [hour]:[minute]:[second] \
-                         [year] [offset_hour sign:mandatory][offset_minute]";
 
 #[derive(StructOpt)]
 struct Args {
     #[structopt(name = "until", long, short)]
-    /// How far into the past should we go?  e.g. 2022-12-31; defaults to one week ago
+    /// How far into the past should we go?  e.g. 2022-12-31 or 30d; defaults to one week ago
     until: Option<String>,
 
     #[structopt(name = "fetch", long, short)]
     /// Run git fetch
     fetch: bool,
 
+    #[structopt(name = "depth", long)]
+    /// With --fetch, only fetch this many commits of recent history
+    depth: Option<u32>,
+
+    #[structopt(name = "first-parent", long)]
+    /// Only follow the first parent of merges, for the mainline history
+    first_parent: bool,
+
+    #[structopt(name = "fetch-only", long)]
+    /// Run git fetch and exit without printing the log
+    fetch_only: bool,
+
     #[structopt(name = "json", long, short)]
     /// Print JSON
     json: bool,
 
+    #[structopt(name = "check", long)]
+    /// Exit with 0 when there are commits in the window, and with 1 when there are none
+    check: bool,
+
+    #[structopt(name = "quiet", long, short)]
+    /// Don't print the log or what we're doing; --output files are still written
+    quiet: bool,
+
+    #[structopt(name = "verbose", long, short)]
+    /// Also print how long each repository takes, and which refs we walk
+    verbose: bool,
+
+    #[structopt(name = "output", long, short, number_of_values = 1)]
+    /// Where to write the log: a format (text, json, markdown, html, csv, tsv, org) for
+    /// stdout, `-` for text on stdout, or a file path whose extension picks
+    /// the format.  May be given several times.
+    output: Vec<Output>,
+
+    #[structopt(
+        name = "template",
+        long,
+        parse(from_os_str),
+        conflicts_with = "split-by-repo"
+    )]
+    /// Render the log through this template instead, see the README for its syntax
+    template: Option<PathBuf>,
+
+    #[structopt(name = "output-file", long, parse(from_os_str))]
+    /// Write what would go to stdout to this file instead, in the same format
+    output_file: Option<PathBuf>,
+
+    #[structopt(name = "split-by-repo", long, parse(from_os_str))]
+    /// Write what would go to stdout to a file per repository in this directory instead
+    split_by_repo: Option<PathBuf>,
+
+    #[structopt(name = "sort", long)]
+    /// How to order the log: author-date, committer-date, or repo; defaults to the
+    /// --date-source
+    sort: Option<SortOrder>,
+
+    #[structopt(name = "date", long, default_value = "default")]
+    /// How to show dates in the text and HTML logs: default, iso, rfc, short, unix, relative,
+    /// or format:<layout>, e.g. format:[year]-[month]-[day]
+    date: DateFormat,
+
+    #[structopt(name = "absolute-dates", long)]
+    /// Show dates in the one-line views of search and summary, instead of how long ago they were
+    absolute_dates: bool,
+
+    #[structopt(name = "date-source", long, default_value = "author")]
+    /// Which date of a commit counts for --until: author or committer
+    date_source: DateSource,
+
+    #[structopt(name = "group-by", long)]
+    /// Group the log: ticket shows the commits of every ticket that `tickets` in the
+    /// config finds in the messages, week those of every ISO week
+    group_by: Option<GroupBy>,
+
+    #[structopt(name = "date-zone", long, default_value = "original")]
+    /// Which timezone to show dates in: local, utc, or original (the author's)
+    date_zone: DateZone,
+
+    #[structopt(name = "prune", long)]
+    /// With --fetch, remove remote-tracking branches that were deleted on the remote
+    prune: bool,
+
     #[structopt(name = "reverse", long, short)]
     /// Reverse the result
     reverse: bool,
 
+    #[structopt(name = "repo", long, number_of_values = 1)]
+    /// Only show the repository with this name.  May be given several times.
+    repo: Vec<String>,
+
+    #[structopt(name = "exclude-repo", long, number_of_values = 1)]
+    /// Leave out the repositories whose names match this glob, e.g. '*-mirror'.  May be given
+    /// several times.
+    exclude_repo: Vec<String>,
+
+    #[structopt(name = "author", long, number_of_values = 1)]
+    /// Only show commits whose author or a co-author, as "Name <email>", matches this
+    /// pattern, e.g. 'Alice' or '@example\.com>'.  May be given several times.
+    author: Vec<String>,
+
+    #[structopt(name = "committer", long, number_of_values = 1)]
+    /// Only show commits whose committer, as "Name <email>", matches this pattern.  May be
+    /// given several times.
+    committer: Vec<String>,
+
+    #[structopt(name = "fixed-strings", long, short = "F", global = true)]
+    /// Match the values of --author, --committer and --grep literally
+    fixed_strings: bool,
+
+    #[structopt(
+        name = "extended-regexp",
+        long,
+        short = "E",
+        global = true,
+        conflicts_with = "fixed-strings"
+    )]
+    /// Read the values of --author, --committer and --grep as extended patterns, with +, ?,
+    /// {n,m}, |, (), ^ and $
+    extended_regexp: bool,
+
+    #[structopt(name = "max-body-lines", long, conflicts_with = "no-body")]
+    /// Only show this many lines of commit messages after the subject
+    max_body_lines: Option<usize>,
+
+    #[structopt(name = "min-changes", long)]
+    /// Only show commits that add and delete at least this many lines together
+    min_changes: Option<usize>,
+
+    #[structopt(name = "path", long, number_of_values = 1)]
+    /// Only show commits touching files that match this glob, e.g. **/Dockerfile.
+    /// May be given several times.
+    path: Vec<String>,
+
+    #[structopt(name = "domain", long, number_of_values = 1)]
+    /// Only show commits authored from this email domain, e.g. example.com.  May be
+    /// given several times.
+    domain: Vec<String>,
+
+    #[structopt(name = "trailer", long, number_of_values = 1)]
+    /// Only show commits with this trailer, e.g. Reviewed-by=alice to match part of the
+    /// value, or Reviewed-by for any value.  May be given several times.
+    trailer: Vec<String>,
+
+    #[structopt(name = "max-count", long, short = "n")]
+    /// Show at most this many commits, the most recent ones.  Without --until, this
+    /// looks back as far as it takes.
+    max_count: Option<usize>,
+
+    #[structopt(name = "limit", long)]
+    /// Walk at most this many commits in each repository, overriding `limit` in the
+    /// config; 0 means no limit
+    limit: Option<usize>,
+
+    #[structopt(name = "timeout", long)]
+    /// Give up on fetching or walking a repository after this many seconds, overriding
+    /// `timeout` in the config; 0 means no timeout
+    timeout: Option<u64>,
+
+    #[structopt(name = "retries", long)]
+    /// Try a failed fetch again this many times, waiting 1s, 2s, 4s and so on in
+    /// between, overriding `retries` in the config
+    retries: Option<u32>,
+
     #[structopt(name = "config", long, short)]
     /// Path to config file
     config: Option<PathBuf>,
-}
 
-#[derive(Debug, Deserialize)]
-enum GglError {
-    ConfigParserError(String),
-    GitError(String),
-    MissingConfigFile,
-}
+    #[structopt(name = "abbrev", long)]
+    /// Show at least this many characters of abbreviated hashes, more where it takes
+    /// that to make them unambiguous; defaults to 7
+    abbrev: Option<usize>,
 
-impl From<git2::Error> for GglError {
-    fn from(err: git2::Error) -> Self {
-        GglError::GitError(err.message().to_owned())
-    }
-}
+    #[structopt(name = "cached", long)]
+    /// Read the log from the cache kept by `ggl daemon` instead of the repositories
+    cached: bool,
 
-impl From<serde_yaml::Error> for GglError {
-    fn from(err: serde_yaml::Error) -> Self {
-        GglError::ConfigParserError(format!("{}", err))
-    }
-}
+    #[structopt(name = "no-cache", long)]
+    /// Walk every repository from scratch instead of reusing the commit cache
+    no_cache: bool,
 
-#[derive(Debug, PartialEq, Deserialize)]
-enum FilterType {
-    Include,
-    Reject,
-}
+    #[structopt(name = "decorate", long)]
+    /// Show the branches and tags pointing at each commit
+    decorate: bool,
 
-#[derive(Debug, Deserialize)]
-struct Filter {
-    filter_type: FilterType,
-    paths: Vec<String>,
-}
+    #[structopt(name = "show-signature", long)]
+    /// Verify commit signatures with gpg, against `keyring` from the config if set
+    show_signature: bool,
 
-#[derive(Debug, Deserialize)]
-struct Repository {
-    name: String,
-    path: String,
-    remote: String,
-    branch: String,
-    fetch: bool,
-    filters: Option<Vec<Filter>>,
-}
+    #[structopt(name = "no-body", long)]
+    /// Only show the subject of commit messages, not the rest
+    no_body: bool,
 
-#[derive(Debug, Deserialize)]
-struct Block {
-    root: String,
-    repositories: Vec<Repository>,
+    #[structopt(name = "wrap", long, alias = "width")]
+    /// Wrap lines of commit messages in the text log to this many columns, or to the width of
+    /// the terminal with `auto`
+    wrap: Option<Width>,
+
+    #[structopt(name = "show-notes", long)]
+    /// Show the notes of commits from refs/notes/commits, like git log --notes
+    show_notes: bool,
+
+    #[structopt(name = "dedupe", long)]
+    /// Show commits that are in several repositories (forks, mirrors) only once
+    dedupe: bool,
+
+    #[structopt(name = "interactive", long)]
+    /// Pick the repositories to show from a list, instead of --repo
+    interactive: bool,
+
+    #[structopt(name = "summary", long)]
+    /// End the log with the number of commits, per repository too, and of authors
+    summary: bool,
+
+    #[structopt(name = "new-only", long, alias = "since-last-run")]
+    /// Only show commits that weren't shown by the last run with --new-only, also known as
+    /// --since-last-run
+    new_only: bool,
+
+    #[structopt(subcommand)]
+    cmd: Option<Command>,
 }
 
-#[derive(Debug, Deserialize)]
-struct Config {
-    blocks: Vec<Block>,
+#[derive(StructOpt)]
+enum Command {
+    /// Serve the log as a web page
+    Serve {
+        #[structopt(name = "port", long, short, default_value = "8080")]
+        /// Port to listen on, on 127.0.0.1
+        port: u16,
+
+        #[structopt(name = "listen", long)]
+        /// Address and port to listen on instead of --port, e.g. 0.0.0.0:8080
+        listen: Option<String>,
+
+        #[structopt(name = "interval", long, short, default_value = "300")]
+        /// How often to collect the log again, in seconds
+        interval: u64,
+
+        #[structopt(name = "hook-token", long)]
+        /// The secret of the push webhooks to /hook: GitLab's secret token, or what GitHub and
+        /// Gitea sign the payload with
+        hook_token: Option<String>,
+
+        #[structopt(name = "tls-cert", long, requires = "tls-key")]
+        /// Serve HTTPS with this certificate chain, a PEM file
+        tls_cert: Option<String>,
+
+        #[structopt(name = "tls-key", long, requires = "tls-cert")]
+        /// The private key of --tls-cert, a PEM file
+        tls_key: Option<String>,
+    },
+
+    #[cfg(unix)]
+    /// Browse the log interactively
+    Tui,
+
+    /// Clone the repositories that aren't on disk as mirrors, and fetch all of the others
+    Sync,
+
+    /// Add the repository at a path to the config, next to the others under the same root
+    Add {
+        #[structopt(name = "path", parse(from_os_str))]
+        /// The repository, with its remote and branch taken from what the current
+        /// branch tracks
+        path: PathBuf,
+
+        #[structopt(name = "name", long)]
+        /// The name to show for it; defaults to the name of its directory
+        name: Option<String>,
+    },
+
+    /// Write a changelog for every repository, between the latest two tags
+    Changelog {
+        #[structopt(name = "from", long)]
+        /// Tag to start from instead; the changelog then runs up to HEAD
+        from: Option<String>,
+    },
+
+    /// Compare the commits and authors of two windows, per repository
+    Compare {
+        #[structopt(name = "window1", long)]
+        /// The first window, e.g. 28d..14d or 2024-03-01..2024-03-15
+        window1: Window,
+
+        #[structopt(name = "window2", long)]
+        /// The second window, e.g. 14d.. for the last two weeks
+        window2: Window,
+
+        #[structopt(name = "json", long)]
+        /// Print JSON
+        json: bool,
+    },
+
+    /// Print a completion script for bash, zsh or fish
+    Completion {
+        #[structopt(name = "shell", possible_values = &Shell::variants())]
+        #[structopt(required_unless = "repositories")]
+        /// The shell to complete in
+        shell: Option<Shell>,
+
+        #[structopt(name = "repositories", long, hidden = true)]
+        /// Print the repository names from the config, for the completion scripts
+        repositories: bool,
+    },
+
+    /// Fetch on a schedule and keep the cache used by --cached up to date
+    Daemon {
+        #[structopt(name = "interval", long, short, default_value = "300")]
+        /// How often to fetch and collect the log, in seconds, for repositories without a
+        /// `schedule`
+        interval: u64,
+
+        #[structopt(name = "metrics-file", long, parse(from_os_str))]
+        /// Write metrics for Prometheus to this file after every round, for the textfile
+        /// collector of the node_exporter
+        metrics_file: Option<PathBuf>,
+    },
+
+    /// Summarize the window: stats followed by the log
+    Digest {
+        #[structopt(name = "email", long)]
+        /// Send the digest to the `smtp` recipients in the config instead of printing it
+        email: bool,
+
+        #[structopt(name = "html", long)]
+        /// Render the digest as HTML
+        html: bool,
+    },
+
+    /// Check every repository for problems that keep ggl from walking or fetching it
+    Doctor,
+
+    /// Write the log somewhere for other tools to analyze
+    Export {
+        #[structopt(name = "sqlite", long)]
+        /// Add the commits and repositories to this SQLite database, creating it if needed
+        sqlite: Option<PathBuf>,
+
+        #[structopt(name = "patches", long)]
+        /// Write every commit as a patch into a directory per repository in this directory
+        patches: Option<PathBuf>,
+    },
+
+    /// Show the files that changed in the most commits, across all repositories
+    Files {
+        #[structopt(name = "dirs", long)]
+        /// Add up the files of every directory
+        dirs: bool,
+
+        #[structopt(name = "top", long, default_value = "20")]
+        /// Show this many; 0 shows all of them
+        top: usize,
+
+        #[structopt(name = "json", long)]
+        /// Print JSON
+        json: bool,
+    },
+
+    /// Show a calendar of commits per day; defaults to the last year
+    Heatmap {
+        #[structopt(name = "author", long)]
+        /// Only count the commits whose author's name or email contains this
+        author: Option<String>,
+    },
+
+    /// List the repositories in the config, with their paths, remotes and branches
+    List,
+
+    /// Remove a repository from the config
+    Remove {
+        #[structopt(name = "name")]
+        /// The name of the repository, as `ggl list` shows it
+        name: String,
+    },
+
+    /// Search the commits in the cache, without touching the repositories
+    Query {
+        #[structopt(name = "author", long, number_of_values = 1)]
+        /// Only commits whose author's name or email contains this.  May be given
+        /// several times.
+        author: Vec<String>,
+
+        #[structopt(name = "grep", long, number_of_values = 1)]
+        /// Only commits whose message contains this.  May be given several times.
+        grep: Vec<String>,
+
+        #[structopt(name = "after", long)]
+        /// Only commits from this date on, e.g. 2022-12-01 or 30d
+        after: Option<String>,
+
+        #[structopt(name = "before", long)]
+        /// Only commits before this date
+        before: Option<String>,
+    },
+
+    /// Find commits by the words in their messages, through an index of the cache
+    Search {
+        #[structopt(name = "query")]
+        /// Words that the messages have, or start of words
+        query: Vec<String>,
+
+        #[structopt(name = "json", long)]
+        /// Print JSON
+        json: bool,
+    },
+
+    /// Show how far every repository's local branch is ahead of or behind the remote one
+    Status,
+
+    /// Show my commits since the previous work day, grouped by repository
+    Standup {
+        #[structopt(name = "email", long, short)]
+        /// My email address; defaults to user.email from the git config
+        email: Option<String>,
+    },
+
+    /// Write a Markdown report of one calendar month, per repository and author
+    Report {
+        #[structopt(name = "month", long)]
+        /// The month, e.g. 2024-03; defaults to the previous one
+        month: Option<Month>,
+
+        #[structopt(name = "json", long)]
+        /// Print JSON
+        json: bool,
+    },
+
+    /// Show commits per repository and author, and other numbers
+    Stats {
+        #[structopt(name = "json", long, short)]
+        /// Print JSON
+        json: bool,
+    },
+
+    /// Show the last commit, number of commits and top author of every repository
+    Summary {
+        #[structopt(name = "json", long, short)]
+        /// Print JSON
+        json: bool,
+    },
 }
 
-#[derive(Debug, Serialize, Clone)]
-struct GlobalCommit {
-    author: String,
-    date: time::OffsetDateTime,
-    message: String,
-    repo_name: String,
-    sha: String,
+// Compile the values of --author and the like as -F and -E say.
+fn patterns(values: &[String], args: &Args) -> Result<Vec<Pattern>, GglError> {
+    values
+        .iter()
+        .map(|value| {
+            if args.fixed_strings {
+                Ok(Pattern::fixed(value))
+            } else {
+                Pattern::parse(value, args.extended_regexp).map_err(GglError::IoError)
+            }
+        })
+        .collect()
 }
 
-/// A CommitSet represents a unit of change to a repo.  It's either:
-///
-/// 1.  A single commit committed to your selected branch
-/// 2.  One or more commits introduced to your branch by a merge commit
-///
-/// The purpose of this tool is to find commits that broke things.
-///
-/// Here is how we create these sets:
-///
-/// For every repository, we walk in topological order.
-///
-/// If we see a commit that isn't a merge, we create a set with a single item.
-/// The date is the date of that commit.
-///
-/// If we see a commit that is a merge, we collect commits until we hit the
-/// SHA of the first parent of that commit.  The date is the date of the
-/// merge commit.
-///
-/// These CommitSets can then be sorted by date, and printed.
-#[derive(Debug)]
-struct CommitSet {
-    date: time::OffsetDateTime,
-    commits: Vec<GlobalCommit>,
+fn collect_options(args: &Args) -> Result<CollectOptions, GglError> {
+    Ok(CollectOptions {
+        fetch: args.fetch,
+        use_cache: !args.no_cache,
+        new_only: args.new_only,
+        decorate: args.decorate,
+        show_signature: args.show_signature,
+        show_notes: args.show_notes,
+        paths: args.path.clone(),
+        domains: args.domain.clone(),
+        authors: patterns(&args.author, args)?,
+        committers: patterns(&args.committer, args)?,
+        min_changes: args.min_changes,
+        date_source: args.date_source,
+        depth: args.depth,
+        prune: args.prune,
+        repos: args.repo.clone(),
+        exclude_repos: args.exclude_repo.clone(),
+        limit: args.limit,
+        first_parent: args.first_parent,
+        trailers: args.trailer.clone(),
+        abbrev: args.abbrev,
+        timeout: args.timeout,
+        retries: args.retries,
+    })
 }
 
-type CommitSetResult = Result<Vec<CommitSet>, GglError>;
+#[cfg(unix)]
+fn pick_repositories(config: &Config, selected: &[String]) -> Result<Vec<String>, GglError> {
+    ggl::tui::pick(&completion::repository_names(config), selected)
+}
 
-fn load_config(path: PathBuf) -> Result<Config, GglError> {
-    let contents = fs::read_to_string(path).unwrap();
-    // TODO: Not sure why we can't return:
-    //    serde_yaml::from_str(&contents)?;
-    match serde_yaml::from_str(&contents) {
-        Ok(c) => Ok(c),
-        Err(e) => Err(GglError::ConfigParserError(format!("{}", e))),
-    }
+#[cfg(not(unix))]
+fn pick_repositories(_config: &Config, _selected: &[String]) -> Result<Vec<String>, GglError> {
+    Err(GglError::IoError(
+        "--interactive isn't supported on this platform".to_string(),
+    ))
 }
 
-fn git_fetch(repo: &git2::Repository, r: &Repository) -> Result<(), git2::Error> {
-    if !r.fetch {
+fn run(args: &Args) -> Result<(), GglError> {
+    logger::set_level(if args.quiet {
+        Level::Quiet
+    } else if args.verbose {
+        Level::Verbose
+    } else {
+        Level::Normal
+    });
+
+    // The script doesn't need a config, only the repository names do
+    if let Some(Command::Completion {
+        shell: Some(shell), ..
+    }) = &args.cmd
+    {
+        let mut script = vec![];
+        Args::clap().gen_completions_to("ggl", *shell, &mut script);
+        let script = completion::add_repositories(&String::from_utf8_lossy(&script), *shell);
+        io::stdout().write_all(script.as_bytes())?;
         return Ok(());
     }
 
-    println!("Fetching {} {}/{}", &r.name, &r.remote, &r.branch);
-    repo.find_remote(&r.remote)?.fetch(&[&r.branch], None, None)
-}
+    // Serve and the daemon parse it again every round, and shouldn't find out
+    // it's wrong only then
+    get_until(&args.until)?;
+
+    let config_path = get_config_path(args.config.clone())?;
 
-fn should_be_included(filters: &Vec<Filter>, changed_files: &Vec<PathBuf>) -> bool {
-    if filters.len() == 0 {
-        return true;
+    if let Some(Command::Add { path, name }) = &args.cmd {
+        let name = edit::add(&config_path, path, name.clone())?;
+        println!("Added {} to {}", name, config_path.display());
+        return Ok(());
+    }
+    if let Some(Command::Remove { name }) = &args.cmd {
+        edit::remove(&config_path, name)?;
+        println!("Removed {} from {}", name, config_path.display());
+        return Ok(());
     }
-    for filter in filters {
-        for filter_path in &filter.paths {
-            for file in changed_files {
-                if file.to_str().unwrap().contains(filter_path) {
-                    match filter.filter_type {
-                        FilterType::Include => {
-                            return true;
-                        }
-                        FilterType::Reject => {
-                            return false;
-                        }
-                    }
-                }
-            }
-        }
 
-        // If we didn't find a match above
-        match filter.filter_type {
-            FilterType::Include => {
-                return false;
-            }
-            FilterType::Reject => {
-                return true;
-            }
+    let config = load_config(config_path)?;
+    let mut opts = collect_options(args)?;
+
+    if args.interactive {
+        opts.repos = pick_repositories(&config, &args.repo)?;
+        if opts.repos.is_empty() {
+            return Ok(());
         }
     }
 
-    // This should never happen :)
-    true
-}
-
-fn collect_commitsets(config: &Config, fetch: bool, until: git2::Time) -> CommitSetResult {
-    let mut commitsets: Vec<CommitSet> = vec![];
-    for block in &config.blocks {
-        for r in &block.repositories {
-            let repo_path = Path::new(&block.root).join(&r.path);
-            let repo = git2::Repository::open(repo_path)?;
+    if args.fetch_only {
+        return fetch_all(&config, &opts);
+    }
 
-            if fetch {
-                git_fetch(&repo, r)?;
+    match &args.cmd {
+        Some(Command::Serve {
+            port,
+            listen,
+            interval,
+            hook_token,
+            tls_cert,
+            tls_key,
+        }) => {
+            let listen = listen
+                .clone()
+                .unwrap_or_else(|| format!("127.0.0.1:{}", port));
+            return serve::serve(
+                config,
+                opts,
+                args.until.clone(),
+                &listen,
+                *interval,
+                hook_token.clone(),
+                tls_cert.clone().zip(tls_key.clone()),
+            );
+        }
+        Some(Command::Daemon {
+            interval,
+            metrics_file,
+        }) => {
+            return daemon::run(
+                &config,
+                &opts,
+                &args.until,
+                *interval,
+                metrics_file.as_deref(),
+            );
+        }
+        Some(Command::Completion { .. }) => {
+            for name in completion::repository_names(&config) {
+                println!("{}", name);
             }
-
-            let sets = collect_commitsets_for_repo(repo, &r, until)?;
-            commitsets.extend(sets);
+            return Ok(());
         }
-    }
-    commitsets.sort_by_key(|set| set.date);
-    commitsets.reverse();
-    Ok(commitsets)
-}
-
-fn collect_commitsets_for_repo(
-    repo: git2::Repository,
-    r: &Repository,
-    until: git2::Time,
-) -> CommitSetResult {
-    let mut commitsets: Vec<CommitSet> = vec![];
-    let mut revwalk = repo.revwalk()?;
-    revwalk.push_head()?;
-    revwalk.set_sorting(git2::Sort::TOPOLOGICAL)?;
-    let mut diffopts = git2::DiffOptions::new();
-
-    let mut commit_buffer: Vec<GlobalCommit> = vec![];
-    let mut collecting_commits = false;
-    let mut set_date: time::OffsetDateTime = time::OffsetDateTime::now_utc();
-    let mut destination_commit_id: git2::Oid = git2::Oid::zero();
-
-    for id in revwalk {
-        let id = id?;
-        let commit = repo.find_commit(id)?;
-        let commit_date = commit.author().when();
-
-        if commit_date < until {
-            break;
+        Some(Command::List) => {
+            return Ok(repos::list(&mut io::stdout(), &config)?);
         }
-
-        let is_merge = commit.parent_count() > 1;
-
-        if !is_merge {
-            if let Some(filters) = &r.filters {
-                let mut changed_files: Vec<PathBuf> = vec![];
-                let current_tree = commit.tree()?;
-
-                let parent_tree = if commit.parent_count() == 1 {
-                    Some(commit.parent(0)?.tree()?)
-                } else {
-                    None
-                };
-
-                let diff = repo.diff_tree_to_tree(
-                    parent_tree.as_ref(),
-                    Some(&current_tree),
-                    Some(&mut diffopts),
-                )?;
-
-                for delta in diff.deltas() {
-                    let new_file = delta.new_file();
-                    changed_files.push(new_file.path().unwrap().to_owned());
-                }
-
-                if !should_be_included(filters, &changed_files) {
-                    continue;
-                }
+        Some(Command::Doctor) => {
+            let broken = repos::doctor(&mut io::stdout(), &config, &opts)?;
+            if broken > 0 {
+                return Err(GglError::IoError(format!(
+                    "{} repositories have problems",
+                    broken
+                )));
             }
+            return Ok(());
         }
-
-        if collecting_commits && commit.id() == destination_commit_id {
-            let set = CommitSet {
-                date: set_date,
-                commits: commit_buffer.clone(),
-            };
-
-            // reset
-            commit_buffer.clear();
-            collecting_commits = false;
-            commitsets.push(set);
+        Some(Command::Sync) => {
+            return sync::sync(&config, &opts);
         }
-
-        let commit_date = git_time_to_datetime(&commit.author().when())?;
-
-        let global_commit = GlobalCommit {
-            author: commit.author().name().unwrap().to_string(),
-            date: commit_date.clone(),
-            message: commit.message().unwrap().to_string(),
-            sha: commit.id().to_string(),
-            repo_name: r.name.clone(),
-        };
-
-        if is_merge {
-            set_date = commit_date.clone();
-            collecting_commits = true;
-            destination_commit_id = commit.parent(0)?.id();
-
-            commit_buffer.push(global_commit);
-        } else {
-            if collecting_commits {
-                commit_buffer.push(global_commit);
-                continue;
+        Some(Command::Status) => {
+            if args.fetch {
+                fetch_all(&config, &opts)?;
             }
-
-            let set = CommitSet {
-                date: commit_date,
-                commits: vec![global_commit],
-            };
-
-            commitsets.push(set);
+            return Ok(repos::status(&mut io::stdout(), &config, &opts)?);
         }
+        Some(Command::Search { query, json }) => {
+            let hits = search::search(&config, &opts, &query.join(" "))?;
+            if *json || args.json {
+                println!("{}", serde_json::to_string(&hits)?);
+            } else {
+                search::write(&mut io::stdout(), &hits, args.absolute_dates)?;
+            }
+            if args.check && hits.is_empty() {
+                process::exit(1);
+            }
+            return Ok(());
+        }
+        Some(Command::Changelog { from }) => {
+            let changelogs = changelog::collect(&config, from)?;
+            return Ok(changelog::write(&mut io::stdout(), &changelogs)?);
+        }
+        _ => {}
     }
 
-    Ok(commitsets)
-}
-
-fn print_commit_set(set: &mut CommitSet, reverse: bool) {
-    if reverse {
-        set.commits.reverse();
-    }
+    let until = match &args.cmd {
+        Some(Command::Standup { .. }) => git2::Time::new(standup::previous_work_day()?, 0),
+        Some(Command::Compare {
+            window1, window2, ..
+        }) => git2::Time::new(window1.from.min(window2.from), 0),
+        Some(Command::Report { month, .. }) => {
+            let month = match month {
+                Some(month) => *month,
+                None => Month::previous()?,
+            };
+            git2::Time::new(month.range()?.0, 0)
+        }
+        Some(Command::Heatmap { .. }) if args.until.is_none() => git2::Time::new(days_ago(365), 0),
+        _ if args.max_count.is_some() && args.until.is_none() => git2::Time::new(0, 0),
+        _ => git2::Time::new(get_until(&args.until)?, 0),
+    };
+    let mut timeline = if let Some(Command::Query {
+        author,
+        grep,
+        after,
+        before,
+    }) = &args.cmd
+    {
+        // As for the log, but ignoring case
+        let ignoring_case = |values: &[String]| -> Result<Vec<Pattern>, GglError> {
+            let patterns = patterns(values, args)?;
+            Ok(patterns.into_iter().map(Pattern::ignore_case).collect())
+        };
+        let q = query::Query {
+            authors: ignoring_case(author)?,
+            grep: ignoring_case(grep)?,
+            after: after.clone(),
+            before: before.clone(),
+        };
+        query::run(&config, &opts, &q)?
+    } else if args.cached {
+        cache::read_timeline(until)?
+    } else {
+        interrupt::install();
+        collect_timeline(&config, &opts, until)?
+    };
 
-    for commit in &set.commits {
-        print_global_commit(commit);
+    if interrupt::interrupted() {
+        eprintln!("warning: interrupted, the log is missing what wasn't collected yet");
     }
-}
-
-fn print_global_commit(commit: &GlobalCommit) {
-    let commit_line = format!("commit {}", commit.sha);
-    println!("{}", commit_line.yellow());
-    println!("Repo:   {}", commit.repo_name);
-    println!("Author: {}", commit.author);
-    print_time(&commit.date);
-    println!();
 
-    for line in commit.message.lines() {
-        println!("    {}", line);
+    if args.dedupe {
+        timeline.dedupe();
     }
 
-    println!();
-}
-
-fn git_time_to_datetime(time: &git2::Time) -> Result<time::OffsetDateTime, GglError> {
-    let off = time::UtcOffset::from_whole_seconds(time.offset_minutes() * 60).unwrap();
-
-    let ts = time::OffsetDateTime::from_unix_timestamp(
-        time.seconds() + (time.offset_minutes() as i64) * 60,
-    )
-    .unwrap()
-    .replace_offset(off);
-
-    Ok(ts)
-}
+    timeline.sort(args.sort.unwrap_or(match args.date_source {
+        DateSource::Author => SortOrder::AuthorDate,
+        DateSource::Committer => SortOrder::CommitterDate,
+    }));
 
-fn print_time(t: &time::OffsetDateTime) {
-    // Not sure how to do a global const that reqires a function call
-    let f = time::format_description::parse(DATETIME).unwrap();
-    let s = t.format(&f).unwrap();
-    println!("Date:   {}", s);
-}
+    let truncated = match args.max_count {
+        Some(n) => timeline.truncate(n),
+        None => false,
+    };
 
-fn get_until(arg: &Option<String>) -> i64 {
-    match arg {
-        Some(date) => {
-            let format = time::macros::format_description!("[year]-[month]-[day]");
-            let offset = time::UtcOffset::current_local_offset().unwrap();
-            time::Date::parse(date, &format)
-                .unwrap()
-                .with_hms(0, 0, 0)
-                .unwrap()
-                .assume_offset(offset)
-                .unix_timestamp()
-        }
-        None => time::OffsetDateTime::now_local()
-            .unwrap()
-            .saturating_sub(time::Duration::days(7))
-            .unix_timestamp(),
+    if args.reverse {
+        timeline.reverse();
     }
-}
 
-// Look for a config file in the following places in the following order:
-//   1.  --config flag
-//   2.  $XDG_CONFIG_HOME/ggl.yaml
-//   3.  config.yaml in the current directory
-fn get_config_path(arg_config: Option<PathBuf>) -> Result<PathBuf, GglError> {
-    if let Some(path) = arg_config {
-        if path.exists() {
-            return Ok(path);
-        } else {
-            return Err(GglError::MissingConfigFile);
-        }
+    convert_dates(&mut timeline, args.date_zone);
+    if args.no_body {
+        limit_bodies(&mut timeline, 0);
+    } else if let Some(n) = args.max_body_lines {
+        limit_bodies(&mut timeline, n);
     }
 
-    if let Some(path) = dirs::config_dir() {
-        let full_path = path.join("ggl.yaml").to_path_buf();
-        if full_path.exists() {
-            return Ok(full_path);
+    match &args.cmd {
+        #[cfg(unix)]
+        Some(Command::Tui) => {
+            interrupt::restore();
+            return ggl::tui::browse(&config, &timeline);
+        }
+        Some(Command::Standup { email }) => {
+            let email = match email {
+                Some(e) => e.clone(),
+                None => standup::default_email()?,
+            };
+            standup::write(&mut io::stdout(), &timeline, &email)?;
+            return Ok(());
+        }
+        Some(Command::Compare {
+            window1,
+            window2,
+            json,
+        }) => {
+            let comparison = compare::compare(&timeline, &[window1.clone(), window2.clone()]);
+            if *json || args.json {
+                println!("{}", serde_json::to_string(&comparison)?);
+            } else {
+                compare::write(&mut io::stdout(), &comparison)?;
+            }
+            return Ok(());
+        }
+        Some(Command::Report { month, json }) => {
+            let month = match month {
+                Some(month) => *month,
+                None => Month::previous()?,
+            };
+            let (_, end) = month.range()?;
+            timeline.retain(|commit| commit.date.unix_timestamp() < end);
+            let report = report::build(&timeline, month);
+            if *json || args.json {
+                println!("{}", serde_json::to_string(&report)?);
+            } else {
+                report::write(&mut io::stdout(), &report)?;
+            }
+            return Ok(());
+        }
+        Some(Command::Digest { email, html }) => {
+            let body = digest::render(&timeline, until.seconds(), *html)?;
+            if !*email {
+                io::stdout().write_all(&body)?;
+                return Ok(());
+            }
+            let smtp = config.smtp.as_ref().ok_or_else(|| {
+                GglError::ConfigParserError("--email needs smtp settings".to_string())
+            })?;
+            let subject = digest::subject(&timeline, until.seconds());
+            return digest::send(smtp, &subject, &body, *html);
         }
+        Some(Command::Heatmap { author }) => {
+            let counts = heatmap::counts(&timeline, author.as_deref());
+            let today = time::OffsetDateTime::now_local()
+                .map_err(|e| GglError::IoError(format!("can't determine the local time: {}", e)))?
+                .date();
+            let from = time::OffsetDateTime::from_unix_timestamp(until.seconds())
+                .map_err(|e| GglError::IoError(format!("{}", e)))?
+                .date();
+            let color = io::stdout().is_terminal();
+            heatmap::write(&mut io::stdout(), &counts, from, today, color)?;
+            return Ok(());
+        }
+        Some(Command::Export { sqlite, patches }) => {
+            if sqlite.is_none() && patches.is_none() {
+                return Err(GglError::IoError(
+                    "export needs --sqlite and a database, or --patches and a directory"
+                        .to_string(),
+                ));
+            }
+            if let Some(path) = sqlite {
+                export::sqlite(path, &config, &timeline)?;
+            }
+            if let Some(dir) = patches {
+                export::patches(dir, &config, &timeline)?;
+            }
+            return Ok(());
+        }
+        Some(Command::Files { dirs, top, json }) => {
+            let mut churn = files::churn(&config, &timeline, *dirs)?;
+            if *top > 0 {
+                churn.truncate(*top);
+            }
+            if *json || args.json {
+                println!("{}", serde_json::to_string(&churn)?);
+            } else {
+                files::write(&mut io::stdout(), &churn)?;
+            }
+            return Ok(());
+        }
+        Some(Command::Stats { json }) => {
+            let stats = stats::compute(&timeline, until.seconds());
+            if *json || args.json {
+                println!("{}", serde_json::to_string(&stats)?);
+            } else {
+                stats::write_table(&mut io::stdout(), &stats)?;
+            }
+            return Ok(());
+        }
+        Some(Command::Summary { json }) => {
+            let names: Vec<String> = completion::repository_names(&config)
+                .into_iter()
+                .filter(|name| {
+                    (args.repo.is_empty() || args.repo.contains(name))
+                        && !excluded(name, &args.exclude_repo)
+                })
+                .collect();
+            let repositories = stats::per_repository(&timeline, &names);
+            if *json || args.json {
+                println!("{}", serde_json::to_string(&repositories)?);
+            } else {
+                stats::write_repositories(&mut io::stdout(), &repositories, args.absolute_dates)?;
+            }
+            return Ok(());
+        }
+        _ => {}
     }
 
-    let local_file = PathBuf::from("config.yaml");
-    if local_file.exists() {
-        return Ok(local_file);
+    match args.group_by {
+        Some(GroupBy::Ticket) => {
+            let groups = tickets::group(&timeline);
+            if args.json {
+                println!("{}", serde_json::to_string(&groups)?);
+            } else {
+                tickets::write(&mut io::stdout(), &groups)?;
+            }
+            return Ok(());
+        }
+        Some(GroupBy::Week) => {
+            let weeks = group_by_week(&timeline);
+            if args.json {
+                println!("{}", serde_json::to_string(&weeks)?);
+            } else {
+                write_weeks(&mut io::stdout(), &weeks)?;
+            }
+            return Ok(());
+        }
+        None => {}
     }
 
-    return Err(GglError::MissingConfigFile);
-}
+    let style = Style {
+        wrap: args.wrap,
+        date: args.date.clone(),
+    };
+    let default_output = Output {
+        format: if args.json {
+            OutputFormat::Json
+        } else {
+            OutputFormat::Text
+        },
+        path: None,
+    };
 
-fn print_json(sets: &mut Vec<CommitSet>, reverse: bool) {
-    let mut commits: Vec<&GlobalCommit> = vec![];
+    for output in args.output.iter().filter(|o| o.path.is_some()) {
+        write_output(output, &timeline, &style)?;
+    }
 
-    for set in sets {
-        if reverse {
-            set.commits.reverse();
+    // What would go to stdout, which --output-file and --split-by-repo send
+    // elsewhere
+    let redirected = args.output_file.is_some() || args.split_by_repo.is_some();
+    let formats: Vec<OutputFormat> = if args.template.is_some() {
+        vec![]
+    } else if args.output.is_empty() {
+        vec![default_output.format]
+    } else {
+        args.output
+            .iter()
+            .filter(|o| o.path.is_none())
+            .map(|o| o.format)
+            .collect()
+    };
+    // The summary would break anything but text, like JSON or CSV, and we
+    // can't tell what a template renders
+    let summary = args.summary
+        && !args.quiet
+        && !redirected
+        && args.template.is_none()
+        && formats.iter().all(|f| *f == OutputFormat::Text);
+    if let Some(path) = &args.template {
+        let rendered = Template::load(path)?.render(&timeline)?;
+        if let Some(file) = &args.output_file {
+            fs::write(file, rendered)?;
+        } else if !args.quiet {
+            io::stdout().write_all(rendered.as_bytes())?;
         }
-        for commit in &set.commits {
-            commits.push(commit);
+    }
+    for format in formats {
+        if let Some(dir) = &args.split_by_repo {
+            write_split(dir, format, &timeline, &style)?;
+        } else if let Some(path) = &args.output_file {
+            let output = Output {
+                format,
+                path: Some(path.clone()),
+            };
+            write_output(&output, &timeline, &style)?;
+        } else if !args.quiet {
+            write_output(&Output { format, path: None }, &timeline, &style)?;
         }
     }
 
-    match serde_json::to_string(&commits) {
-        Ok(c) => println!("{}", c),
-        Err(e) => println!("Errror {:?}", e),
+    if summary {
+        let stats = stats::compute(&timeline, until.seconds());
+        stats::write_summary(&mut io::stdout(), &stats)?;
     }
-}
 
-fn run(args: &Args) -> Result<(), GglError> {
-    let config_path = get_config_path(args.config.clone())?;
-    let config = load_config(config_path)?;
-    let until = git2::Time::new(get_until(&args.until), 0);
-    let mut commitsets = collect_commitsets(&config, args.fetch, until)?;
-
-    if args.reverse {
-        commitsets.reverse();
+    // The heads of an interrupted run weren't walked all the way, and the
+    // commits --max-count left out haven't been shown yet
+    if args.new_only && !interrupt::interrupted() && !truncated {
+        state::write_seen(&timeline.heads)?;
     }
 
-    if args.json {
-        print_json(&mut commitsets, args.reverse);
-    } else {
-        for set in commitsets.iter_mut() {
-            print_commit_set(set, args.reverse);
-        }
+    if args.check && timeline.commits().next().is_none() {
+        process::exit(1);
     }
 
     Ok(())
@@ -449,6 +973,10 @@ fn main() {
     let args = Args::from_args();
     match run(&args) {
         Ok(()) => {}
-        Err(e) => println!("error: {:?}", e),
+        Err(e) => {
+            println!("error: {}", e);
+            // 1 is taken by --check
+            process::exit(2);
+        }
     }
 }
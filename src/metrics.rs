@@ -0,0 +1,189 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Numbers about the log and about ggl itself, in the text format of
+//! Prometheus, for `ggl serve` at /metrics and `ggl daemon --metrics-file`.
+
+use crate::collect::Timeline;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use std::sync::Mutex;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+
+#[derive(Default)]
+struct Fetches {
+    total: u64,
+    errors: u64,
+    /// Seconds since the epoch.
+    last: u64,
+}
+
+struct Metrics {
+    fetches: BTreeMap<String, Fetches>,
+    collections: u64,
+    collection_errors: u64,
+    collection_seconds: f64,
+}
+
+static METRICS: Mutex<Metrics> = Mutex::new(Metrics {
+    fetches: BTreeMap::new(),
+    collections: 0,
+    collection_errors: 0,
+    collection_seconds: 0.0,
+});
+
+fn now() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map(|d| d.as_secs())
+        .unwrap_or(0)
+}
+
+/// Count a fetch of the repository, and whether it worked.
+pub fn record_fetch(repo: &str, ok: bool) {
+    let mut metrics = METRICS.lock().unwrap();
+    let fetches = metrics.fetches.entry(repo.to_string()).or_default();
+    fetches.total += 1;
+    fetches.last = now();
+    if !ok {
+        fetches.errors += 1;
+    }
+}
+
+/// Count a collection of the log, how long it took, and whether it worked.
+pub fn record_collection(duration: Duration, ok: bool) {
+    let mut metrics = METRICS.lock().unwrap();
+    metrics.collections += 1;
+    metrics.collection_seconds = duration.as_secs_f64();
+    if !ok {
+        metrics.collection_errors += 1;
+    }
+}
+
+fn escape_label(value: &str) -> String {
+    value
+        .replace('\\', "\\\\")
+        .replace('"', "\\\"")
+        .replace('\n', "\\n")
+}
+
+fn header(out: &mut String, name: &str, kind: &str, help: &str) {
+    let _ = writeln!(out, "# HELP {} {}", name, help);
+    let _ = writeln!(out, "# TYPE {} {}", name, kind);
+}
+
+/// Render the metrics, with the commits per repository in `timeline`.
+pub fn render(timeline: &Timeline) -> String {
+    let mut commits: BTreeMap<&str, usize> = BTreeMap::new();
+    for commit in timeline.commits() {
+        *commits.entry(&commit.repo_name).or_default() += 1;
+    }
+
+    let metrics = METRICS.lock().unwrap();
+    let mut out = String::new();
+
+    header(
+        &mut out,
+        "ggl_commits",
+        "gauge",
+        "Commits in the window, per repository.",
+    );
+    for (repo, n) in &commits {
+        let _ = writeln!(
+            out,
+            "ggl_commits{{repository=\"{}\"}} {}",
+            escape_label(repo),
+            n
+        );
+    }
+
+    header(
+        &mut out,
+        "ggl_fetches_total",
+        "counter",
+        "Fetches, per repository.",
+    );
+    for (repo, fetches) in &metrics.fetches {
+        let _ = writeln!(
+            out,
+            "ggl_fetches_total{{repository=\"{}\"}} {}",
+            escape_label(repo),
+            fetches.total
+        );
+    }
+
+    header(
+        &mut out,
+        "ggl_fetch_errors_total",
+        "counter",
+        "Fetches that failed, per repository.",
+    );
+    for (repo, fetches) in &metrics.fetches {
+        let _ = writeln!(
+            out,
+            "ggl_fetch_errors_total{{repository=\"{}\"}} {}",
+            escape_label(repo),
+            fetches.errors
+        );
+    }
+
+    header(
+        &mut out,
+        "ggl_last_fetch_timestamp_seconds",
+        "gauge",
+        "When the repository was last fetched.",
+    );
+    for (repo, fetches) in &metrics.fetches {
+        let _ = writeln!(
+            out,
+            "ggl_last_fetch_timestamp_seconds{{repository=\"{}\"}} {}",
+            escape_label(repo),
+            fetches.last
+        );
+    }
+
+    header(
+        &mut out,
+        "ggl_collections_total",
+        "counter",
+        "Collections of the log.",
+    );
+    let _ = writeln!(out, "ggl_collections_total {}", metrics.collections);
+    header(
+        &mut out,
+        "ggl_collection_errors_total",
+        "counter",
+        "Collections of the log that failed.",
+    );
+    let _ = writeln!(
+        out,
+        "ggl_collection_errors_total {}",
+        metrics.collection_errors
+    );
+    header(
+        &mut out,
+        "ggl_collection_duration_seconds",
+        "gauge",
+        "How long the last collection of the log took.",
+    );
+    let _ = writeln!(
+        out,
+        "ggl_collection_duration_seconds {}",
+        metrics.collection_seconds
+    );
+
+    out
+}
@@ -0,0 +1,162 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Posting new commits to Slack or other webhooks, from `ggl daemon`.
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::config::{Notification, NotificationType};
+use crate::error::GglError;
+use serde::Serialize;
+use std::collections::HashSet;
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+/// Remembers which commits we've seen, so that only new ones are posted.
+#[derive(Default)]
+pub struct Notifier {
+    seen: Option<HashSet<String>>,
+}
+
+impl Notifier {
+    /// The commits that weren't in the previous timeline.  The first
+    /// timeline only sets the baseline, so starting the daemon doesn't post
+    /// the whole window.
+    pub fn new_commits<'a>(&mut self, timeline: &'a Timeline) -> Vec<&'a GlobalCommit> {
+        let shas: HashSet<String> = timeline.commits().map(|c| c.sha.clone()).collect();
+
+        let new = match &self.seen {
+            Some(seen) => timeline
+                .commits()
+                .filter(|c| !seen.contains(&c.sha))
+                .collect(),
+            None => vec![],
+        };
+
+        self.seen = Some(shas);
+        new
+    }
+}
+
+/// Post the new commits to every notification they match.  Errors are
+/// reported, and don't keep the others from being posted.
+pub fn notify(notifications: &[Notification], new: &[&GlobalCommit]) {
+    for notification in notifications {
+        let commits: Vec<&GlobalCommit> = new
+            .iter()
+            .copied()
+            .filter(|c| matches(notification, c))
+            .collect();
+
+        if commits.is_empty() {
+            continue;
+        }
+
+        if let Err(e) = post(notification, &commits) {
+            eprintln!("error: {:?}", e);
+        }
+    }
+}
+
+fn matches(notification: &Notification, commit: &GlobalCommit) -> bool {
+    let repo_matches = match &notification.repositories {
+        Some(names) => names.contains(&commit.repo_name),
+        None => true,
+    };
+    let author_matches = match &notification.authors {
+        Some(authors) => authors.iter().any(|a| commit.authored_by(a)),
+        None => true,
+    };
+    repo_matches && author_matches
+}
+
+#[derive(Serialize)]
+struct SlackMessage {
+    text: String,
+}
+
+#[derive(Serialize)]
+struct WebhookMessage<'a> {
+    commits: &'a [&'a GlobalCommit],
+}
+
+// Slack's mrkdwn only needs these escaped.
+fn escape_slack(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+}
+
+fn slack_text(commits: &[&GlobalCommit]) -> String {
+    let mut lines = vec![format!("{} new commits", commits.len())];
+    for commit in commits {
+        let short_sha = commit.short();
+        let sha = match &commit.url {
+            Some(url) => format!("<{}|{}>", url, short_sha),
+            None => format!("`{}`", short_sha),
+        };
+        let subject = commit.message.lines().next().unwrap_or("");
+        lines.push(format!(
+            "*{}* {} {} ({})",
+            escape_slack(&commit.repo_name),
+            sha,
+            escape_slack(subject),
+            escape_slack(&commit.author)
+        ));
+    }
+    lines.join("\n")
+}
+
+fn post(notification: &Notification, commits: &[&GlobalCommit]) -> Result<(), GglError> {
+    let body = match notification.kind {
+        NotificationType::Slack => serde_json::to_vec(&SlackMessage {
+            text: slack_text(commits),
+        })?,
+        NotificationType::Webhook => serde_json::to_vec(&WebhookMessage { commits })?,
+    };
+    post_json(&notification.url, &body)
+}
+
+/// POST `body` to `url` as JSON, with curl.
+pub(crate) fn post_json(url: &str, body: &[u8]) -> Result<(), GglError> {
+    let mut child = Command::new("curl")
+        .args([
+            "--silent",
+            "--show-error",
+            "--fail",
+            "--output",
+            "/dev/null",
+        ])
+        .args(["--header", "Content-Type: application/json"])
+        .args(["--data-binary", "@-"])
+        .arg(url)
+        .stdin(Stdio::piped())
+        .stderr(Stdio::piped())
+        .spawn()?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        stdin.write_all(body)?;
+    }
+
+    let output = child.wait_with_output()?;
+    if !output.status.success() {
+        return Err(GglError::ApiError(format!(
+            "can't post to {}: {}",
+            url,
+            String::from_utf8_lossy(&output.stderr).trim()
+        )));
+    }
+    Ok(())
+}
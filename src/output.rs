@@ -0,0 +1,1041 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Rendering a [`Timeline`] as text, JSON, Markdown, or HTML.
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::error::GglError;
+use colored::*;
+use serde::Serialize;
+use std::fs;
+use std::io;
+use std::io::{IsTerminal, Write};
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+
+// git format: Wed Nov 16 11:05:18 2022 -0400
+static DATETIME: &str = "[weekday repr:short] [month repr:short] \
+                         [day padding:none] [hour]:[minute]:[second] \
+                         [year] [offset_hour sign:mandatory][offset_minute]";
+
+/// The formats we can render the log in.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum OutputFormat {
+    Text,
+    Json,
+    Markdown,
+    Html,
+    Csv,
+    Tsv,
+    Org,
+}
+
+impl FromStr for OutputFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "text" => Ok(OutputFormat::Text),
+            "json" => Ok(OutputFormat::Json),
+            "markdown" => Ok(OutputFormat::Markdown),
+            "html" => Ok(OutputFormat::Html),
+            "csv" => Ok(OutputFormat::Csv),
+            "tsv" => Ok(OutputFormat::Tsv),
+            "org" => Ok(OutputFormat::Org),
+            _ => Err(format!("unknown output format: {}", s)),
+        }
+    }
+}
+
+impl OutputFormat {
+    /// The file extension for the format, without the dot.
+    pub fn extension(&self) -> &'static str {
+        match self {
+            OutputFormat::Text => "txt",
+            OutputFormat::Json => "json",
+            OutputFormat::Markdown => "md",
+            OutputFormat::Html => "html",
+            OutputFormat::Csv => "csv",
+            OutputFormat::Tsv => "tsv",
+            OutputFormat::Org => "org",
+        }
+    }
+}
+
+/// How `--group-by` groups the log.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum GroupBy {
+    /// By the tickets the commits mention, see [`crate::tickets`].
+    Ticket,
+    /// By ISO week, see [`group_by_week`].
+    Week,
+}
+
+impl FromStr for GroupBy {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "ticket" => Ok(GroupBy::Ticket),
+            "week" => Ok(GroupBy::Week),
+            _ => Err(format!("unknown grouping: {}", s)),
+        }
+    }
+}
+
+/// Which timezone to show dates in.  `Original` keeps the offset the commit
+/// was made with.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum DateZone {
+    Local,
+    Utc,
+    Original,
+}
+
+impl FromStr for DateZone {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "local" => Ok(DateZone::Local),
+            "utc" => Ok(DateZone::Utc),
+            "original" => Ok(DateZone::Original),
+            _ => Err(format!("unknown date zone: {}", s)),
+        }
+    }
+}
+
+fn to_zone(t: time::OffsetDateTime, zone: DateZone) -> time::OffsetDateTime {
+    match zone {
+        DateZone::Original => t,
+        DateZone::Utc => t.to_offset(time::UtcOffset::UTC),
+        // The local offset can differ from date to date because of DST.
+        DateZone::Local => match time::UtcOffset::local_offset_at(t) {
+            Ok(offset) => t.to_offset(offset),
+            Err(_) => t,
+        },
+    }
+}
+
+/// Move the dates of all commits into `zone`, so that every format shows
+/// them the same way.
+pub fn convert_dates(timeline: &mut Timeline, zone: DateZone) {
+    for entry in timeline.entries.iter_mut() {
+        for commit in entry.commits_mut() {
+            commit.date = to_zone(commit.date, zone);
+            commit.committer_date = to_zone(commit.committer_date, zone);
+        }
+    }
+}
+
+// The subject, and at most `max_lines` lines of the body, followed by how many
+// were left out.
+fn limit_body(message: &str, max_lines: usize) -> String {
+    let mut lines = message.trim_end().lines();
+    let subject = lines.next().unwrap_or("");
+    let body: Vec<&str> = lines.skip_while(|line| line.trim().is_empty()).collect();
+
+    if max_lines == 0 {
+        return format!("{}\n", subject);
+    }
+    if body.len() <= max_lines {
+        return message.to_string();
+    }
+
+    let mut limited = format!("{}\n\n", subject);
+    for line in &body[..max_lines] {
+        limited.push_str(line);
+        limited.push('\n');
+    }
+    limited.push_str(&format!("[{} more lines]\n", body.len() - max_lines));
+    limited
+}
+
+/// Cut the messages of all commits down to the subject and at most
+/// `max_lines` lines of the body, so that every format shows them the same
+/// way.  0 leaves the subject alone.
+pub fn limit_bodies(timeline: &mut Timeline, max_lines: usize) {
+    for entry in timeline.entries.iter_mut() {
+        for commit in entry.commits_mut() {
+            commit.message = limit_body(&commit.message, max_lines);
+        }
+    }
+}
+
+/// How `--date` shows the dates of commits in the text and HTML logs.
+#[derive(Debug, Clone, PartialEq, Default)]
+pub enum DateFormat {
+    /// Like `git log`, see [`format_time`].
+    #[default]
+    Default,
+    /// ISO 8601, e.g. 2022-11-16T11:05:18-04:00
+    Iso,
+    /// RFC 2822, e.g. Wed, 16 Nov 2022 11:05:18 -0400
+    Rfc,
+    /// Only the day, e.g. 2022-11-16
+    Short,
+    /// Seconds since the epoch
+    Unix,
+    /// How long ago, e.g. 3 hours ago
+    Relative,
+    /// A layout in the syntax of the time crate, e.g. `[year]-[month]-[day]`
+    Format(String),
+}
+
+impl FromStr for DateFormat {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "default" => Ok(DateFormat::Default),
+            "iso" => Ok(DateFormat::Iso),
+            "rfc" => Ok(DateFormat::Rfc),
+            "short" => Ok(DateFormat::Short),
+            "unix" => Ok(DateFormat::Unix),
+            "relative" => Ok(DateFormat::Relative),
+            _ => match s.strip_prefix("format:") {
+                Some(layout) => match time::format_description::parse(layout) {
+                    Ok(_) => Ok(DateFormat::Format(layout.to_string())),
+                    Err(e) => Err(format!("bad date format {:?}: {}", layout, e)),
+                },
+                None => Err(format!("unknown date format: {}", s)),
+            },
+        }
+    }
+}
+
+impl DateFormat {
+    /// Show `t` in this format.
+    pub fn format(&self, t: &time::OffsetDateTime) -> String {
+        let iso = time::macros::format_description!(
+            "[year]-[month]-[day]T[hour]:[minute]:[second][offset_hour sign:mandatory]:[offset_minute]"
+        );
+        let short = time::macros::format_description!("[year]-[month]-[day]");
+        match self {
+            DateFormat::Default => format_time(t),
+            DateFormat::Iso => t.format(&iso).unwrap(),
+            DateFormat::Rfc => t
+                .format(&time::format_description::well_known::Rfc2822)
+                .unwrap_or_else(|_| format_time(t)),
+            DateFormat::Short => t.format(&short).unwrap(),
+            DateFormat::Unix => t.unix_timestamp().to_string(),
+            DateFormat::Relative => relative_time(t, &time::OffsetDateTime::now_utc()),
+            // Checked when parsing the option
+            DateFormat::Format(layout) => time::format_description::parse(layout)
+                .ok()
+                .and_then(|f| t.format(&f).ok())
+                .unwrap_or_default(),
+        }
+    }
+}
+
+// How long `seconds` is in the largest unit that still gives a useful
+// number, rounded the way `git log --date=relative` does.
+fn elapsed(seconds: i64) -> (i64, &'static str) {
+    let minutes = (seconds + 30) / 60;
+    let hours = (minutes + 30) / 60;
+    let days = (hours + 12) / 24;
+
+    if seconds < 90 {
+        (seconds, "second")
+    } else if minutes < 90 {
+        (minutes, "minute")
+    } else if hours < 36 {
+        (hours, "hour")
+    } else if days < 14 {
+        (days, "day")
+    } else if days < 70 {
+        ((days + 3) / 7, "week")
+    } else if days < 365 {
+        ((days + 15) / 30, "month")
+    } else {
+        (days / 365, "year")
+    }
+}
+
+/// How long before `now` `t` was, e.g. 3 hours ago or 2 weeks ago.
+pub fn relative_time(t: &time::OffsetDateTime, now: &time::OffsetDateTime) -> String {
+    let seconds = now.unix_timestamp() - t.unix_timestamp();
+    if seconds < 0 {
+        return "in the future".to_string();
+    }
+
+    match elapsed(seconds) {
+        (1, unit) => format!("1 {} ago", unit),
+        (n, unit) => format!("{} {}s ago", n, unit),
+    }
+}
+
+/// Like [`relative_time`], but short enough for a column, e.g. 3h ago or
+/// 2w ago.
+pub fn short_relative_time(t: &time::OffsetDateTime, now: &time::OffsetDateTime) -> String {
+    let seconds = now.unix_timestamp() - t.unix_timestamp();
+    if seconds < 0 {
+        return "future".to_string();
+    }
+
+    let (n, unit) = elapsed(seconds);
+    let unit = match unit {
+        "second" => "s",
+        "minute" => "m",
+        "hour" => "h",
+        "day" => "d",
+        "week" => "w",
+        "month" => "mo",
+        _ => "y",
+    };
+    format!("{}{} ago", n, unit)
+}
+
+/// How the text and HTML logs show commits, apart from the format itself.
+#[derive(Debug, Clone, Default)]
+pub struct Style {
+    /// Wrap lines of commit messages in the text log, see [`Width`].
+    pub wrap: Option<Width>,
+    /// How to show dates.
+    pub date: DateFormat,
+}
+
+/// How wide `--wrap` makes the text log.  `Auto` is the width of the
+/// terminal, and leaves the log alone when it doesn't go to one.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum Width {
+    Auto,
+    Columns(usize),
+}
+
+impl FromStr for Width {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        match s {
+            "auto" => Ok(Width::Auto),
+            _ => match s.parse() {
+                Ok(n) if n > 0 => Ok(Width::Columns(n)),
+                _ => Err(format!("not a width: {}", s)),
+            },
+        }
+    }
+}
+
+impl Width {
+    // The number of columns for a log going to `path`, or stdout.
+    fn columns(&self, path: Option<&Path>) -> Option<usize> {
+        match self {
+            Width::Columns(n) => Some(*n),
+            Width::Auto if path.is_none() => terminal_width(),
+            Width::Auto => None,
+        }
+    }
+}
+
+/// The number of columns of the terminal on stdout, if it is one.
+#[cfg(unix)]
+pub fn terminal_width() -> Option<usize> {
+    if !io::stdout().is_terminal() {
+        return None;
+    }
+    let mut ws: libc::winsize = unsafe { std::mem::zeroed() };
+    let ok = unsafe { libc::ioctl(libc::STDOUT_FILENO, libc::TIOCGWINSZ, &mut ws) } == 0;
+    if ok && ws.ws_col > 0 {
+        Some(ws.ws_col as usize)
+    } else {
+        None
+    }
+}
+
+/// The number of columns of the terminal on stdout, if it is one.
+#[cfg(not(unix))]
+pub fn terminal_width() -> Option<usize> {
+    None
+}
+
+// How many columns a terminal gives the character: none for combining marks
+// and zero width spaces, two for East Asian wide and fullwidth characters
+// and most emoji.
+fn char_width(c: char) -> usize {
+    match c as u32 {
+        0x0300..=0x036f
+        | 0x0483..=0x0489
+        | 0x0591..=0x05bd
+        | 0x0610..=0x061a
+        | 0x064b..=0x065f
+        | 0x0e31
+        | 0x0e34..=0x0e3a
+        | 0x0e47..=0x0e4e
+        | 0x1ab0..=0x1aff
+        | 0x1dc0..=0x1dff
+        | 0x200b..=0x200f
+        | 0x20d0..=0x20ff
+        | 0xfe00..=0xfe0f
+        | 0xfe20..=0xfe2f
+        | 0xfeff => 0,
+        0x1100..=0x115f
+        | 0x231a..=0x231b
+        | 0x2329..=0x232a
+        | 0x23e9..=0x23ec
+        | 0x23f0
+        | 0x23f3
+        | 0x25fd..=0x25fe
+        | 0x2614..=0x2615
+        | 0x2648..=0x2653
+        | 0x267f
+        | 0x2693
+        | 0x26a1
+        | 0x26aa..=0x26ab
+        | 0x26bd..=0x26be
+        | 0x26c4..=0x26c5
+        | 0x26ce
+        | 0x26d4
+        | 0x26ea
+        | 0x26f2..=0x26f3
+        | 0x26f5
+        | 0x26fa
+        | 0x26fd
+        | 0x2705
+        | 0x270a..=0x270b
+        | 0x2728
+        | 0x274c
+        | 0x274e
+        | 0x2753..=0x2755
+        | 0x2757
+        | 0x2795..=0x2797
+        | 0x27b0
+        | 0x27bf
+        | 0x2b1b..=0x2b1c
+        | 0x2b50
+        | 0x2b55
+        | 0x2e80..=0x303e
+        | 0x3041..=0x33ff
+        | 0x3400..=0x4dbf
+        | 0x4e00..=0x9fff
+        | 0xa000..=0xa4cf
+        | 0xa960..=0xa97f
+        | 0xac00..=0xd7a3
+        | 0xf900..=0xfaff
+        | 0xfe10..=0xfe19
+        | 0xfe30..=0xfe6f
+        | 0xff00..=0xff60
+        | 0xffe0..=0xffe6
+        | 0x1f004
+        | 0x1f0cf
+        | 0x1f18e
+        | 0x1f191..=0x1f19a
+        | 0x1f200..=0x1f251
+        | 0x1f300..=0x1f64f
+        | 0x1f680..=0x1f6ff
+        | 0x1f7e0..=0x1f7eb
+        | 0x1f900..=0x1f9ff
+        | 0x1fa70..=0x1faff
+        | 0x20000..=0x2fffd
+        | 0x30000..=0x3fffd => 2,
+        _ => 1,
+    }
+}
+
+/// How many columns `s` takes up in a terminal.
+pub fn display_width(s: &str) -> usize {
+    s.chars().map(char_width).sum()
+}
+
+// Break a line into lines of at most `width` columns, at spaces where it can
+// and in the middle of words that are longer than that.  The lines it adds
+// keep the indentation of the first one, so that lists stay lists.
+fn wrap_line(line: &str, width: usize) -> Vec<String> {
+    let line = line.trim_end();
+    if display_width(line) <= width {
+        return vec![line.to_string()];
+    }
+
+    let rest = line.trim_start();
+    let indent = &line[..line.len() - rest.len()];
+    // Don't let a deep indentation leave no room for the text
+    let indent = if display_width(indent) * 2 > width {
+        ""
+    } else {
+        indent
+    };
+
+    let mut lines = vec![];
+    let mut current = indent.to_string();
+    let mut used = display_width(indent);
+    let mut empty = true;
+
+    for word in rest.split(' ').filter(|w| !w.is_empty()) {
+        let needed = display_width(word);
+        if !empty && used + 1 + needed <= width {
+            current.push(' ');
+            current.push_str(word);
+            used += 1 + needed;
+            continue;
+        }
+        if !empty {
+            lines.push(std::mem::replace(&mut current, indent.to_string()));
+            used = display_width(indent);
+        }
+        empty = false;
+        for c in word.chars() {
+            let w = char_width(c);
+            if used + w > width && used > display_width(indent) {
+                lines.push(std::mem::replace(&mut current, indent.to_string()));
+                used = display_width(indent);
+            }
+            current.push(c);
+            used += w;
+        }
+    }
+    lines.push(current);
+    lines
+}
+
+/// The commits of an ISO week.
+#[derive(Debug, Serialize)]
+pub struct Week<'a> {
+    /// e.g. 2024-W10
+    pub week: String,
+    /// The Monday and the Sunday of the week.
+    pub from: String,
+    pub to: String,
+    pub commits: Vec<&'a GlobalCommit>,
+}
+
+/// Group the commits by the ISO week of their date, in the order the weeks
+/// first appear in the timeline.
+pub fn group_by_week(timeline: &Timeline) -> Vec<Week<'_>> {
+    let week = time::macros::format_description!("[year repr:full base:iso_week]-W[week_number]");
+    let day = time::macros::format_description!("[year]-[month]-[day]");
+    let mut weeks: Vec<Week> = vec![];
+
+    for commit in timeline.commits() {
+        let name = commit.date.format(&week).unwrap();
+        match weeks.iter_mut().find(|w| w.week == name) {
+            Some(week) => week.commits.push(commit),
+            None => {
+                let date = commit.date.date();
+                let monday =
+                    date - time::Duration::days(date.weekday().number_days_from_monday() as i64);
+                let sunday = monday + time::Duration::days(6);
+                weeks.push(Week {
+                    week: name,
+                    from: monday.format(&day).unwrap(),
+                    to: sunday.format(&day).unwrap(),
+                    commits: vec![commit],
+                });
+            }
+        }
+    }
+
+    weeks
+}
+
+/// Write a heading for every week, with its number of commits, and then one
+/// line per commit.
+pub fn write_weeks(w: &mut dyn Write, weeks: &[Week]) -> io::Result<()> {
+    for week in weeks {
+        let count = match week.commits.len() {
+            1 => "1 commit".to_string(),
+            n => format!("{} commits", n),
+        };
+        writeln!(w, "{} ({} to {}): {}", week.week, week.from, week.to, count)?;
+        for commit in &week.commits {
+            let subject = commit.message.lines().next().unwrap_or("");
+            writeln!(
+                w,
+                "    {} {:<12} {}",
+                commit.short(),
+                commit.repo_name,
+                subject
+            )?;
+        }
+        writeln!(w)?;
+    }
+
+    Ok(())
+}
+
+/// A single rendering of the log.  `path` is `None` for stdout.
+#[derive(Debug)]
+pub struct Output {
+    pub format: OutputFormat,
+    pub path: Option<PathBuf>,
+}
+
+impl FromStr for Output {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        if s == "-" {
+            return Ok(Output {
+                format: OutputFormat::Text,
+                path: None,
+            });
+        }
+
+        if let Ok(format) = OutputFormat::from_str(s) {
+            return Ok(Output { format, path: None });
+        }
+
+        let path = PathBuf::from(s);
+        let format = match path.extension().and_then(|ext| ext.to_str()) {
+            Some("txt") => OutputFormat::Text,
+            Some("json") => OutputFormat::Json,
+            Some("md") | Some("markdown") => OutputFormat::Markdown,
+            Some("html") | Some("htm") => OutputFormat::Html,
+            Some("csv") => OutputFormat::Csv,
+            Some("tsv") => OutputFormat::Tsv,
+            Some("org") => OutputFormat::Org,
+            _ => return Err(format!("can't tell the output format of {}", s)),
+        };
+
+        Ok(Output {
+            format,
+            path: Some(path),
+        })
+    }
+}
+
+/// Write the log like `git log` does, with dates in `date`.  With `width`,
+/// lines of commit messages and notes are wrapped to fit into that many
+/// columns.
+pub fn write_text(
+    w: &mut dyn Write,
+    timeline: &Timeline,
+    color: bool,
+    width: Option<usize>,
+    date: &DateFormat,
+) -> io::Result<()> {
+    let links = color && hyperlinks_supported();
+    for commit in timeline.commits() {
+        write_global_commit(w, commit, color, links, width, date)?;
+    }
+    Ok(())
+}
+
+// Whether stdout is a terminal that we can send OSC 8 hyperlinks to.
+// Terminals that don't know them show the text and ignore the rest, so we
+// only leave out the dumb ones.
+fn hyperlinks_supported() -> bool {
+    io::stdout().is_terminal() && std::env::var("TERM").map_or(true, |term| term != "dumb")
+}
+
+fn write_global_commit(
+    w: &mut dyn Write,
+    commit: &GlobalCommit,
+    color: bool,
+    links: bool,
+    width: Option<usize>,
+    date: &DateFormat,
+) -> io::Result<()> {
+    let commit_line = match &commit.url {
+        Some(url) if links => format!("commit \x1b]8;;{}\x1b\\{}\x1b]8;;\x1b\\", url, commit.sha),
+        _ => format!("commit {}", commit.sha),
+    };
+    let refs = if commit.refs.is_empty() {
+        String::new()
+    } else {
+        format!(" ({})", commit.refs.join(", "))
+    };
+    if color {
+        writeln!(w, "{}{}", commit_line.yellow(), refs.green())?;
+    } else {
+        writeln!(w, "{}{}", commit_line, refs)?;
+    }
+    writeln!(w, "Repo:   {}", commit.repo_names())?;
+    if !commit.branches.is_empty() {
+        writeln!(w, "Branch: {}", commit.branches.join(", "))?;
+    }
+    writeln!(w, "Author: {}", commit.author)?;
+    writeln!(w, "Date:   {}", date.format(&commit.date))?;
+    if let Some(signature) = &commit.signature {
+        writeln!(w, "Sig:    {}", signature)?;
+    }
+    if !commit.tickets.is_empty() {
+        writeln!(w, "Ticket: {}", commit.tickets.join(", "))?;
+    }
+    writeln!(w)?;
+
+    write_indented(w, &commit.message, width)?;
+
+    if let Some(notes) = &commit.notes {
+        writeln!(w)?;
+        writeln!(w, "Notes:")?;
+        write_indented(w, notes, width)?;
+    }
+
+    writeln!(w)
+}
+
+// Write the lines of `text` indented by four spaces, wrapped to `width`
+// columns including the indentation.
+fn write_indented(w: &mut dyn Write, text: &str, width: Option<usize>) -> io::Result<()> {
+    for line in text.lines() {
+        match width {
+            Some(width) => {
+                for part in wrap_line(line, width.saturating_sub(4).max(1)) {
+                    writeln!(w, "    {}", part)?;
+                }
+            }
+            None => writeln!(w, "    {}", line)?,
+        }
+    }
+    Ok(())
+}
+
+/// Format a date the way `git log` does, e.g. Wed Nov 16 11:05:18 2022 -0400
+pub fn format_time(t: &time::OffsetDateTime) -> String {
+    // Not sure how to do a global const that reqires a function call
+    let f = time::format_description::parse(DATETIME).unwrap();
+    t.format(&f).unwrap()
+}
+
+/// Write the commits as a JSON array.
+pub fn write_json(w: &mut dyn Write, timeline: &Timeline) -> io::Result<()> {
+    let commits: Vec<&GlobalCommit> = timeline.commits().collect();
+    serde_json::to_writer(&mut *w, &commits)?;
+    writeln!(w)
+}
+
+/// Write one line per commit with the columns repo, hash, author, email,
+/// date and subject, separated by `separator`: a comma for CSV, quoted as
+/// in RFC 4180, or a tab for TSV, where tabs in the values become spaces.
+pub fn write_delimited(w: &mut dyn Write, timeline: &Timeline, separator: char) -> io::Result<()> {
+    let field = |value: &str| -> String {
+        if separator == '\t' {
+            value.replace(['\t', '\n', '\r'], " ")
+        } else if value.contains([separator, '"', '\n', '\r']) {
+            format!("\"{}\"", value.replace('"', "\"\""))
+        } else {
+            value.to_string()
+        }
+    };
+    let line = |values: &[&str]| -> String {
+        let fields: Vec<String> = values.iter().map(|v| field(v)).collect();
+        fields.join(&separator.to_string())
+    };
+
+    writeln!(
+        w,
+        "{}",
+        line(&["repo", "hash", "author", "email", "date", "subject"])
+    )?;
+    for commit in timeline.commits() {
+        let date = commit
+            .date
+            .format(&time::format_description::well_known::Rfc3339)
+            .unwrap();
+        writeln!(
+            w,
+            "{}",
+            line(&[
+                &commit.repo_name,
+                &commit.sha,
+                &commit.author,
+                &commit.email,
+                &date,
+                commit.message.lines().next().unwrap_or(""),
+            ])
+        )?;
+    }
+    Ok(())
+}
+
+// Render the commits as an Org document with a heading per repository, like
+// the Markdown output, and a heading per commit under it.  The commit's date
+// is an active timestamp so that it shows up in the agenda, and the rest of
+// its message goes into a BODY drawer.
+pub fn write_org(w: &mut dyn Write, timeline: &Timeline) -> io::Result<()> {
+    let commits: Vec<&GlobalCommit> = timeline.commits().collect();
+    let format = time::macros::format_description!(
+        "[year]-[month]-[day] [weekday repr:short] [hour]:[minute]"
+    );
+
+    let mut repo_names: Vec<&str> = vec![];
+    for commit in &commits {
+        if !repo_names.contains(&commit.repo_name.as_str()) {
+            repo_names.push(&commit.repo_name);
+        }
+    }
+
+    for repo_name in repo_names {
+        writeln!(w, "* {}", repo_name)?;
+
+        for commit in commits.iter().filter(|c| c.repo_name == repo_name) {
+            let mut lines = commit.message.lines();
+            writeln!(w, "** {}", lines.next().unwrap_or(""))?;
+
+            // Org only takes the drawer as properties right after the heading
+            writeln!(w, ":PROPERTIES:")?;
+            writeln!(w, ":COMMIT: {}", commit.sha)?;
+            writeln!(w, ":AUTHOR: {} <{}>", commit.author, commit.email)?;
+            if let Some(url) = &commit.url {
+                writeln!(w, ":URL: {}", url)?;
+            }
+            if !commit.tickets.is_empty() {
+                writeln!(w, ":TICKETS: {}", commit.tickets.join(" "))?;
+            }
+            writeln!(w, ":END:")?;
+            writeln!(w, "<{}>", commit.date.format(&format).unwrap())?;
+
+            let body: Vec<&str> = lines.skip_while(|line| line.trim().is_empty()).collect();
+            if !body.is_empty() {
+                writeln!(w, ":BODY:")?;
+                for line in body {
+                    // Indented, a line can't start a heading, but it can still
+                    // end the drawer
+                    if line.trim() == ":END:" {
+                        writeln!(w, "  ,{}", line.trim())?;
+                    } else {
+                        writeln!(w, "  {}", line)?;
+                    }
+                }
+                writeln!(w, ":END:")?;
+            }
+        }
+    }
+
+    Ok(())
+}
+
+fn escape_markdown(s: &str) -> String {
+    let mut escaped = String::with_capacity(s.len());
+    for c in s.chars() {
+        if "\\`*_[]<>#|".contains(c) {
+            escaped.push('\\');
+        }
+        escaped.push(c);
+    }
+    escaped
+}
+
+// Render the commits as a Markdown document with one section per
+// repository.  Repositories are listed in the order in which their first
+// commit appears in the log.
+pub fn write_markdown(w: &mut dyn Write, timeline: &Timeline) -> io::Result<()> {
+    let commits: Vec<&GlobalCommit> = timeline.commits().collect();
+    let format = time::macros::format_description!("[year]-[month]-[day]");
+
+    let mut repo_names: Vec<&str> = vec![];
+    for commit in &commits {
+        if !repo_names.contains(&commit.repo_name.as_str()) {
+            repo_names.push(&commit.repo_name);
+        }
+    }
+
+    for repo_name in repo_names {
+        writeln!(w, "## {}", escape_markdown(repo_name))?;
+        writeln!(w)?;
+
+        for commit in commits.iter().filter(|c| c.repo_name == repo_name) {
+            let short_sha = commit.short();
+            let hash = match &commit.url {
+                Some(url) => format!("[`{}`]({})", short_sha, url),
+                None => format!("`{}`", short_sha),
+            };
+            let hash = if commit.refs.is_empty() {
+                hash
+            } else {
+                format!("{} (`{}`)", hash, commit.refs.join("`, `"))
+            };
+            let subject = commit.message.lines().next().unwrap_or("");
+            let date = commit.date.format(&format).unwrap();
+            let date = match &commit.signature {
+                Some(signature) => format!("{}, signature: {}", date, signature),
+                None => date,
+            };
+            let date = if commit.also_in.is_empty() {
+                date
+            } else {
+                format!(
+                    "{}, also in {}",
+                    date,
+                    escape_markdown(&commit.also_in.join(", "))
+                )
+            };
+            let date = if commit.branches.is_empty() {
+                date
+            } else {
+                format!(
+                    "{}, on {}",
+                    date,
+                    escape_markdown(&commit.branches.join(", "))
+                )
+            };
+            let date = if commit.tickets.is_empty() {
+                date
+            } else {
+                format!("{}, {}", date, escape_markdown(&commit.tickets.join(", ")))
+            };
+
+            writeln!(
+                w,
+                "- {} {} ({}, {})",
+                hash,
+                escape_markdown(subject),
+                escape_markdown(&commit.author),
+                date
+            )?;
+        }
+
+        writeln!(w)?;
+    }
+
+    Ok(())
+}
+
+pub(crate) fn escape_html(s: &str) -> String {
+    s.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+        .replace('"', "&quot;")
+}
+
+pub(crate) static HTML_HEAD: &str = "<!DOCTYPE html>
+<html>
+<head>
+<meta charset=\"utf-8\">
+<title>ggl</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: 2em auto; }
+.commit { margin-bottom: 2em; }
+.sha { font-family: monospace; color: #a07000; }
+pre { margin-left: 2em; }
+</style>
+</head>
+<body>
+";
+
+// Render the commits as a standalone HTML page that mirrors the text output.
+pub fn write_html(w: &mut dyn Write, timeline: &Timeline, date: &DateFormat) -> io::Result<()> {
+    let commits: Vec<&GlobalCommit> = timeline.commits().collect();
+
+    write!(w, "{}", HTML_HEAD)?;
+    write_html_commits(w, &commits, date)?;
+    writeln!(w, "</body>\n</html>")
+}
+
+pub(crate) fn write_html_commits(
+    w: &mut dyn Write,
+    commits: &[&GlobalCommit],
+    date: &DateFormat,
+) -> io::Result<()> {
+    for commit in commits {
+        let sha = match &commit.url {
+            Some(url) => format!("<a href=\"{}\">{}</a>", escape_html(url), commit.sha),
+            None => commit.sha.clone(),
+        };
+        let sha = if commit.refs.is_empty() {
+            sha
+        } else {
+            format!("{} ({})", sha, escape_html(&commit.refs.join(", ")))
+        };
+
+        writeln!(w, "<div class=\"commit\">")?;
+        writeln!(w, "<div class=\"sha\">commit {}</div>", sha)?;
+        writeln!(
+            w,
+            "<div>Repo:   {}</div>",
+            escape_html(&commit.repo_names())
+        )?;
+        if !commit.branches.is_empty() {
+            writeln!(
+                w,
+                "<div>Branch: {}</div>",
+                escape_html(&commit.branches.join(", "))
+            )?;
+        }
+        writeln!(w, "<div>Author: {}</div>", escape_html(&commit.author))?;
+        writeln!(
+            w,
+            "<div>Date:   {}</div>",
+            escape_html(&date.format(&commit.date))
+        )?;
+        if let Some(signature) = &commit.signature {
+            writeln!(w, "<div>Sig:    {}</div>", signature)?;
+        }
+        if !commit.tickets.is_empty() {
+            writeln!(
+                w,
+                "<div>Ticket: {}</div>",
+                escape_html(&commit.tickets.join(", "))
+            )?;
+        }
+        writeln!(w, "<pre>{}</pre>", escape_html(commit.message.trim_end()))?;
+        if let Some(notes) = &commit.notes {
+            writeln!(
+                w,
+                "<pre class=\"notes\">Notes:\n{}</pre>",
+                escape_html(notes)
+            )?;
+        }
+        writeln!(w, "</div>")?;
+    }
+
+    Ok(())
+}
+
+/// Render the timeline in the requested format to stdout or a file.
+pub fn write_output(output: &Output, timeline: &Timeline, style: &Style) -> Result<(), GglError> {
+    let stdout = io::stdout();
+    let mut w: Box<dyn Write> = match &output.path {
+        Some(path) => Box::new(io::BufWriter::new(fs::File::create(path)?)),
+        None => Box::new(stdout.lock()),
+    };
+
+    match output.format {
+        OutputFormat::Text => {
+            let width = style
+                .wrap
+                .and_then(|wrap| wrap.columns(output.path.as_deref()));
+            write_text(&mut w, timeline, output.path.is_none(), width, &style.date)?
+        }
+        OutputFormat::Json => write_json(&mut w, timeline)?,
+        OutputFormat::Markdown => write_markdown(&mut w, timeline)?,
+        OutputFormat::Html => write_html(&mut w, timeline, &style.date)?,
+        OutputFormat::Csv => write_delimited(&mut w, timeline, ',')?,
+        OutputFormat::Tsv => write_delimited(&mut w, timeline, '\t')?,
+        OutputFormat::Org => write_org(&mut w, timeline)?,
+    }
+
+    w.flush()?;
+    Ok(())
+}
+
+/// Write the log of every repository to a file of its own in `dir`, named
+/// after the repository, with `/` in the name turned into `-`.
+pub fn write_split(
+    dir: &Path,
+    format: OutputFormat,
+    timeline: &Timeline,
+    style: &Style,
+) -> Result<(), GglError> {
+    fs::create_dir_all(dir)?;
+
+    let mut names: Vec<&str> = timeline.commits().map(|c| c.repo_name.as_str()).collect();
+    names.sort();
+    names.dedup();
+
+    for name in names {
+        let mut own = timeline.clone();
+        own.retain(|commit| commit.repo_name == name);
+        let file = format!("{}.{}", name.replace('/', "-"), format.extension());
+        let output = Output {
+            format,
+            path: Some(dir.join(file)),
+        };
+        write_output(&output, &own, style)?;
+    }
+    Ok(())
+}
@@ -0,0 +1,597 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! A small subset of regular expressions, enough for ticket IDs like
+//! `JIRA-\d+` or `#[0-9]+`.
+//!
+//! Supported are literal characters, `.`, the classes `\d`, `\w` and `\s`,
+//! bracket classes like `[A-Z]` or `[^ ]`, and the quantifier `*`.  As in
+//! grep's basic patterns, `\+`, `\?` and `\{n,m\}` repeat too; other
+//! characters after a backslash stand for themselves.
+//!
+//! Extended patterns, like `grep -E` takes, have the quantifiers `+`, `?`,
+//! `{n}`, `{n,}` and `{n,m}` without the backslash, and add alternatives
+//! `a|b`, groups `(...)`, and the anchors `^` and `$`.  In basic patterns,
+//! those characters stand for themselves.  Patterns in the config are
+//! extended.
+
+use std::iter::Peekable;
+use std::str::{Chars, FromStr};
+
+#[derive(Debug, Clone)]
+enum Atom {
+    Any,
+    Char(char),
+    Digit,
+    Word,
+    Space,
+    Class(Vec<(char, char)>, bool),
+}
+
+impl Atom {
+    fn matches(&self, c: char, ignore_case: bool) -> bool {
+        if ignore_case {
+            return c
+                .to_lowercase()
+                .chain(c.to_uppercase())
+                .any(|c| self.matches(c, false));
+        }
+        match self {
+            Atom::Any => true,
+            Atom::Char(expected) => c == *expected,
+            Atom::Digit => c.is_ascii_digit(),
+            Atom::Word => c.is_alphanumeric() || c == '_',
+            Atom::Space => c.is_whitespace(),
+            Atom::Class(ranges, negated) => {
+                ranges.iter().any(|(lo, hi)| (*lo..=*hi).contains(&c)) != *negated
+            }
+        }
+    }
+}
+
+#[derive(Debug, Clone)]
+enum Node {
+    Atom(Atom),
+    Start,
+    End,
+    /// Alternatives, each a sequence of pieces.
+    Group(Vec<Vec<Piece>>),
+}
+
+#[derive(Debug, Clone)]
+struct Piece {
+    node: Node,
+    min: usize,
+    max: usize,
+}
+
+// What patterns compile to: a program for a Pike VM, which runs every way the
+// pattern could match in lockstep over the text.  Matching takes time linear
+// in the text, whatever the pattern, and nothing recurses.
+#[derive(Debug, Clone)]
+enum Inst {
+    Atom(Atom),
+    Start,
+    End,
+    /// Go on at both.
+    Split(usize, usize),
+    Jump(usize),
+    Match,
+}
+
+// Counted repetition copies what it repeats, so `(a{1000}){1000}` would take a
+// million instructions.
+const MAX_PROGRAM: usize = 100_000;
+
+/// A compiled pattern.
+#[derive(Debug, Clone)]
+pub struct Pattern {
+    program: Vec<Inst>,
+    ignore_case: bool,
+}
+
+impl FromStr for Pattern {
+    type Err = String;
+
+    // For the config, like `tickets`
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        Pattern::parse(s, true)
+    }
+}
+
+impl Pattern {
+    /// Parse a basic pattern, or an extended one.
+    pub fn parse(s: &str, extended: bool) -> Result<Pattern, String> {
+        let mut parser = Parser {
+            source: s,
+            chars: s.chars().peekable(),
+            extended,
+        };
+        let alternatives = parser.alternatives()?;
+        if parser.chars.next().is_some() {
+            return Err(format!("{}: unmatched )", s));
+        }
+        compile(&alternatives).ok_or_else(|| format!("{}: too many repetitions", s))
+    }
+
+    /// A pattern that matches `s` literally.
+    pub fn fixed(s: &str) -> Pattern {
+        let pieces = s
+            .chars()
+            .map(|c| Piece {
+                node: Node::Atom(Atom::Char(c)),
+                min: 1,
+                max: 1,
+            })
+            .collect::<Vec<_>>();
+        // Only counted repetition can make a program too long
+        compile(&[pieces]).expect("literal patterns compile")
+    }
+
+    /// The same pattern, ignoring the case of letters.
+    pub fn ignore_case(self) -> Pattern {
+        Pattern {
+            ignore_case: true,
+            ..self
+        }
+    }
+
+    /// Every match in `text`, from left to right, without overlaps.  Each
+    /// match is as long as it can be.
+    pub fn find_all(&self, text: &str) -> Vec<String> {
+        let chars: Vec<char> = text.chars().collect();
+        let mut found = vec![];
+        let mut from = 0;
+
+        while let Some((start, end)) = self.find(&chars, from, false) {
+            found.push(chars[start..end].iter().collect());
+            from = end;
+        }
+
+        found
+    }
+
+    /// Whether the pattern matches anywhere in `text`.
+    pub fn is_match(&self, text: &str) -> bool {
+        let chars: Vec<char> = text.chars().collect();
+        self.find(&chars, 0, true).is_some()
+    }
+
+    // The leftmost match in `text` that starts at `from` or later, and the
+    // longest of those, as its start and end.  Empty matches only count with
+    // `empty`.
+    fn find(&self, text: &[char], from: usize, empty: bool) -> Option<(usize, usize)> {
+        let mut current = Threads::new(self.program.len());
+        let mut next = Threads::new(self.program.len());
+        let mut found: Option<(usize, usize)> = None;
+        let mut pos = from;
+
+        loop {
+            // A match that starts here would be further right than one found
+            // already.  The threads that started earlier come first, so that
+            // they win where two get to the same instruction.
+            if found.is_none() && pos <= text.len() {
+                self.add(&mut current, 0, pos, pos, text.len());
+            }
+            if current.pcs.is_empty() {
+                return found;
+            }
+
+            for &pc in &current.pcs {
+                let start = current.starts[pc].expect("threads have a start");
+                if found.map_or(false, |(leftmost, _)| start > leftmost) {
+                    continue;
+                }
+                match &self.program[pc] {
+                    Inst::Match if empty || pos > start => {
+                        if found.map_or(true, |(leftmost, end)| start < leftmost || pos > end) {
+                            found = Some((start, pos));
+                        }
+                    }
+                    Inst::Atom(atom) => match text.get(pos) {
+                        Some(c) if atom.matches(*c, self.ignore_case) => {
+                            self.add(&mut next, pc + 1, start, pos + 1, text.len())
+                        }
+                        _ => {}
+                    },
+                    _ => {}
+                }
+            }
+
+            std::mem::swap(&mut current, &mut next);
+            next.clear();
+            pos += 1;
+        }
+    }
+
+    // Add a thread at `pc` that started at `start`, and all the threads it
+    // leads to at `pos` without taking a character.
+    fn add(&self, threads: &mut Threads, pc: usize, start: usize, pos: usize, len: usize) {
+        let mut stack = vec![pc];
+        while let Some(pc) = stack.pop() {
+            if threads.starts[pc].is_some() {
+                continue;
+            }
+            threads.starts[pc] = Some(start);
+            threads.pcs.push(pc);
+            match self.program[pc] {
+                Inst::Jump(to) => stack.push(to),
+                Inst::Split(first, second) => {
+                    stack.push(second);
+                    stack.push(first);
+                }
+                Inst::Start if pos == 0 => stack.push(pc + 1),
+                Inst::End if pos == len => stack.push(pc + 1),
+                _ => {}
+            }
+        }
+    }
+}
+
+// The threads at one position in the text: the instructions they're at, in the
+// order they were added, and where each started.
+struct Threads {
+    pcs: Vec<usize>,
+    starts: Vec<Option<usize>>,
+}
+
+impl Threads {
+    fn new(size: usize) -> Threads {
+        Threads {
+            pcs: vec![],
+            starts: vec![None; size],
+        }
+    }
+
+    fn clear(&mut self) {
+        for pc in self.pcs.drain(..) {
+            self.starts[pc] = None;
+        }
+    }
+}
+
+struct Parser<'a> {
+    source: &'a str,
+    chars: Peekable<Chars<'a>>,
+    extended: bool,
+}
+
+impl Parser<'_> {
+    fn alternatives(&mut self) -> Result<Vec<Vec<Piece>>, String> {
+        let mut alternatives = vec![self.sequence()?];
+        while self.extended && self.chars.peek() == Some(&'|') {
+            self.chars.next();
+            alternatives.push(self.sequence()?);
+        }
+        Ok(alternatives)
+    }
+
+    fn sequence(&mut self) -> Result<Vec<Piece>, String> {
+        let s = self.source;
+        let mut pieces: Vec<Piece> = vec![];
+
+        while let Some(&c) = self.chars.peek() {
+            if self.extended && (c == '|' || c == ')') {
+                break;
+            }
+            self.chars.next();
+
+            let node = match c {
+                '.' => Node::Atom(Atom::Any),
+                '\\' if !self.extended && matches!(self.chars.peek(), Some('+' | '?' | '{')) => {
+                    let c = self.chars.next().unwrap_or(c);
+                    let (min, max) = match c {
+                        '+' => (1, usize::MAX),
+                        '?' => (0, 1),
+                        _ => self.bounds()?,
+                    };
+                    repeat(&mut pieces, min, max, s, c)?;
+                    continue;
+                }
+                '\\' => Node::Atom(match self.chars.next() {
+                    Some('d') => Atom::Digit,
+                    Some('w') => Atom::Word,
+                    Some('s') => Atom::Space,
+                    Some(c) => Atom::Char(c),
+                    None => return Err(format!("{}: trailing backslash", s)),
+                }),
+                '[' => Node::Atom(self.class()?),
+                '^' if self.extended => Node::Start,
+                '$' if self.extended => Node::End,
+                '(' if self.extended => {
+                    let group = self.alternatives()?;
+                    if self.chars.next() != Some(')') {
+                        return Err(format!("{}: missing )", s));
+                    }
+                    Node::Group(group)
+                }
+                '*' | '+' | '?' if c == '*' || self.extended => {
+                    let (min, max) = match c {
+                        '*' => (0, usize::MAX),
+                        '+' => (1, usize::MAX),
+                        _ => (0, 1),
+                    };
+                    repeat(&mut pieces, min, max, s, c)?;
+                    continue;
+                }
+                '{' if self.extended => {
+                    let (min, max) = self.bounds()?;
+                    repeat(&mut pieces, min, max, s, c)?;
+                    continue;
+                }
+                c => Node::Atom(Atom::Char(c)),
+            };
+            pieces.push(Piece {
+                node,
+                min: 1,
+                max: 1,
+            });
+        }
+
+        Ok(pieces)
+    }
+
+    // A bracket class, after the [.
+    fn class(&mut self) -> Result<Atom, String> {
+        let mut ranges = vec![];
+        let mut negated = false;
+        let mut first = true;
+        loop {
+            let c = match self.chars.next() {
+                Some(']') if !first => break,
+                Some('^') if first && !negated => {
+                    negated = true;
+                    continue;
+                }
+                Some('\\') => self.chars.next(),
+                c => c,
+            };
+            let c = c.ok_or_else(|| format!("{}: missing ]", self.source))?;
+            first = false;
+
+            let mut rest = self.chars.clone();
+            match (rest.next(), rest.next()) {
+                (Some('-'), Some(hi)) if hi != ']' => {
+                    ranges.push((c, hi));
+                    self.chars = rest;
+                }
+                _ => ranges.push((c, c)),
+            }
+        }
+        Ok(Atom::Class(ranges, negated))
+    }
+
+    // The bounds of {n}, {n,} or {n,m}, after the {, or of \{n,m\} in basic
+    // patterns.
+    fn bounds(&mut self) -> Result<(usize, usize), String> {
+        let mut inside = String::new();
+        loop {
+            match self.chars.next() {
+                Some('}') if self.extended => break,
+                Some('\\') if !self.extended && self.chars.peek() == Some(&'}') => {
+                    self.chars.next();
+                    break;
+                }
+                Some(c) => inside.push(c),
+                None if self.extended => return Err(format!("{}: missing }}", self.source)),
+                None => return Err(format!("{}: missing \\}}", self.source)),
+            }
+        }
+        let number = |n: &str| {
+            n.trim()
+                .parse::<usize>()
+                .map_err(|_| format!("{}: bad repetition {{{}}}", self.source, inside))
+        };
+        match inside.split_once(',') {
+            None => number(&inside).map(|n| (n, n)),
+            Some((min, "")) => number(min).map(|min| (min, usize::MAX)),
+            Some((min, max)) => {
+                let (min, max) = (number(min)?, number(max)?);
+                if min > max {
+                    return Err(format!("{}: bad repetition {{{}}}", self.source, inside));
+                }
+                Ok((min, max))
+            }
+        }
+    }
+}
+
+// Make the last piece repeat, unless it already does.
+fn repeat(pieces: &mut [Piece], min: usize, max: usize, s: &str, c: char) -> Result<(), String> {
+    match pieces.last_mut() {
+        Some(piece) if piece.min == 1 && piece.max == 1 => {
+            (piece.min, piece.max) = (min, max);
+            Ok(())
+        }
+        _ => Err(format!("{}: nothing to repeat before {}", s, c)),
+    }
+}
+
+// Compile the alternatives of a pattern, or None if that'd take more than
+// MAX_PROGRAM instructions.
+fn compile(alternatives: &[Vec<Piece>]) -> Option<Pattern> {
+    let mut compiler = Compiler { program: vec![] };
+    compiler.alternatives(alternatives)?;
+    compiler.program.push(Inst::Match);
+    Some(Pattern {
+        program: compiler.program,
+        ignore_case: false,
+    })
+}
+
+struct Compiler {
+    program: Vec<Inst>,
+}
+
+impl Compiler {
+    fn push(&mut self, inst: Inst) -> Option<usize> {
+        if self.program.len() >= MAX_PROGRAM {
+            return None;
+        }
+        self.program.push(inst);
+        Some(self.program.len() - 1)
+    }
+
+    fn alternatives(&mut self, alternatives: &[Vec<Piece>]) -> Option<()> {
+        let mut jumps = vec![];
+        for (i, pieces) in alternatives.iter().enumerate() {
+            if i + 1 == alternatives.len() {
+                self.sequence(pieces)?;
+                break;
+            }
+            let split = self.push(Inst::Split(0, 0))?;
+            self.sequence(pieces)?;
+            jumps.push(self.push(Inst::Jump(0))?);
+            self.program[split] = Inst::Split(split + 1, self.program.len());
+        }
+        for jump in jumps {
+            self.program[jump] = Inst::Jump(self.program.len());
+        }
+        Some(())
+    }
+
+    fn sequence(&mut self, pieces: &[Piece]) -> Option<()> {
+        for piece in pieces {
+            for _ in 0..piece.min {
+                self.node(&piece.node)?;
+            }
+            if piece.max == usize::MAX {
+                let split = self.push(Inst::Split(0, 0))?;
+                self.node(&piece.node)?;
+                self.push(Inst::Jump(split))?;
+                self.program[split] = Inst::Split(split + 1, self.program.len());
+            } else {
+                // Each optional copy can skip all that are left
+                let mut splits = vec![];
+                for _ in piece.min..piece.max {
+                    splits.push(self.push(Inst::Split(0, 0))?);
+                    self.node(&piece.node)?;
+                }
+                for split in splits {
+                    self.program[split] = Inst::Split(split + 1, self.program.len());
+                }
+            }
+        }
+        Some(())
+    }
+
+    fn node(&mut self, node: &Node) -> Option<()> {
+        match node {
+            Node::Atom(atom) => self.push(Inst::Atom(atom.clone())).map(|_| ()),
+            Node::Start => self.push(Inst::Start).map(|_| ()),
+            Node::End => self.push(Inst::End).map(|_| ()),
+            Node::Group(alternatives) => self.alternatives(alternatives),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn basic(s: &str) -> Pattern {
+        Pattern::parse(s, false).unwrap()
+    }
+
+    fn extended(s: &str) -> Pattern {
+        Pattern::parse(s, true).unwrap()
+    }
+
+    #[test]
+    fn basic_patterns_are_like_bre() {
+        assert!(basic("c++").is_match("in c++ now"));
+        assert!(!basic("c++").is_match("in c now"));
+        assert!(basic("why?").is_match("why?"));
+        assert!(basic("a{2}").is_match("a{2}"));
+        assert!(!basic("a{2}").is_match("aa"));
+        assert!(basic("^(a|b)$").is_match("x^(a|b)$"));
+        assert!(basic("ab\\+c").is_match("abbbc"));
+        assert!(basic("ab\\?c").is_match("ac"));
+        assert!(basic("^a\\{2,3\\}$").is_match("^aaa$"));
+        assert!(Pattern::parse("a\\{2", false).is_err());
+    }
+
+    #[test]
+    fn finds_tickets() {
+        let p: Pattern = "JIRA-\\d+".parse().unwrap();
+        assert_eq!(
+            p.find_all("JIRA-12, JIRA-345 and JIRA-"),
+            ["JIRA-12", "JIRA-345"]
+        );
+    }
+
+    #[test]
+    fn matches_are_leftmost_and_longest() {
+        assert_eq!(extended("a|ab").find_all("xabx"), ["ab"]);
+        assert_eq!(extended("(a|ab)(c|bcd)").find_all("abcd"), ["abcd"]);
+        assert_eq!(basic("a*").find_all("baaab"), ["aaa"]);
+    }
+
+    #[test]
+    fn counted_repetition() {
+        let p = extended("^x{2,3}$");
+        assert!(!p.is_match("x"));
+        assert!(p.is_match("xx"));
+        assert!(p.is_match("xxx"));
+        assert!(!p.is_match("xxxx"));
+        assert!(extended("x{2,}").is_match("axxx"));
+        assert!(Pattern::parse("(a{1000}){1000}", true).is_err());
+    }
+
+    #[test]
+    fn anchors() {
+        assert!(extended("^ab").is_match("abc"));
+        assert!(!extended("^b").is_match("abc"));
+        assert!(extended("c$").is_match("abc"));
+        assert!(!extended("b$").is_match("abc"));
+        assert!(extended("^$").is_match(""));
+    }
+
+    #[test]
+    fn empty_loops_end() {
+        assert!(extended("(a*)*b").is_match("aaab"));
+        assert!(extended("(a|)*$").is_match("aa"));
+        assert!(extended("(x?)*").is_match(""));
+    }
+
+    #[test]
+    fn no_exponential_backtracking() {
+        let text = "a".repeat(30);
+        let p = extended(&format!("{}{}", "a?".repeat(30), "a".repeat(30)));
+        assert!(p.is_match(&text));
+        assert!(!extended("(a*)*b").is_match(&text));
+    }
+
+    #[test]
+    fn long_texts_dont_overflow_the_stack() {
+        let text = "a".repeat(100_000);
+        assert_eq!(basic("a*").find_all(&text).len(), 1);
+        assert!(!basic("a*b").is_match(&text));
+    }
+
+    #[test]
+    fn ignores_case() {
+        let p = Pattern::fixed("Alice").ignore_case();
+        assert!(p.is_match("by ALICE <a@example.com>"));
+        assert!(!Pattern::fixed("Alice").is_match("alice"));
+    }
+
+    #[test]
+    fn classes() {
+        assert_eq!(basic("[A-Z][^ ]*").find_all("a Bc De"), ["Bc", "De"]);
+        assert!(basic("\\w\\s\\d").is_match("x 1"));
+    }
+}
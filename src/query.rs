@@ -0,0 +1,65 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl query`: search the commits in the cache without touching the
+//! repositories.
+
+use crate::collect::{cached_timeline, parse_until, CollectOptions, Timeline};
+use crate::config::Config;
+use crate::error::GglError;
+use crate::pattern::Pattern;
+
+/// What to look for.  Every part that is set has to match.
+#[derive(Debug, Default)]
+pub struct Query {
+    /// Patterns for the author or a co-author, as `Name <email>`.  Any of
+    /// them matches.
+    pub authors: Vec<Pattern>,
+    /// Patterns for the message.  Any of them matches.
+    pub grep: Vec<Pattern>,
+    /// Dates like --until takes: YYYY-MM-DD or a number of days like 30d.
+    pub after: Option<String>,
+    pub before: Option<String>,
+}
+
+fn parse_date(value: &Option<String>) -> Result<Option<i64>, GglError> {
+    match value {
+        None => Ok(None),
+        Some(value) => parse_until(value).map(Some).ok_or_else(|| {
+            GglError::IoError(format!(
+                "{} should be a date like 2022-12-31 or a number of days like 30d",
+                value
+            ))
+        }),
+    }
+}
+
+/// The commits in the cache that match `query`.
+pub fn run(config: &Config, opts: &CollectOptions, query: &Query) -> Result<Timeline, GglError> {
+    let after = parse_date(&query.after)?;
+    let before = parse_date(&query.before)?;
+    let mut timeline = cached_timeline(config, opts)?;
+
+    timeline.retain(|commit| {
+        let date = commit.date.unix_timestamp();
+        (query.authors.is_empty() || query.authors.iter().any(|a| commit.author_matches(a)))
+            && (query.grep.is_empty() || query.grep.iter().any(|g| g.is_match(&commit.message)))
+            && after.map_or(true, |after| date >= after)
+            && before.map_or(true, |before| date < before)
+    });
+
+    Ok(timeline)
+}
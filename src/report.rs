@@ -0,0 +1,232 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl report`: a report of one calendar month, per repository and author.
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::error::GglError;
+use serde::Serialize;
+use std::io;
+use std::io::Write;
+use std::str::FromStr;
+
+/// A calendar month, e.g. 2024-03.
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct Month {
+    pub year: i32,
+    pub month: time::Month,
+}
+
+impl FromStr for Month {
+    type Err = String;
+
+    fn from_str(s: &str) -> Result<Self, Self::Err> {
+        let (year, month) = s
+            .split_once('-')
+            .ok_or_else(|| format!("{} should be a month like 2024-03", s))?;
+        let year: i32 = year
+            .parse()
+            .map_err(|_| format!("{} should be a month like 2024-03", s))?;
+        let month = month
+            .parse::<u8>()
+            .ok()
+            .and_then(|m| time::Month::try_from(m).ok())
+            .ok_or_else(|| format!("{} should be a month like 2024-03", s))?;
+        Ok(Month { year, month })
+    }
+}
+
+impl std::fmt::Display for Month {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        write!(f, "{}-{:02}", self.year, self.month as u8)
+    }
+}
+
+impl Month {
+    /// The month before the current one, in local time.
+    pub fn previous() -> Result<Month, GglError> {
+        let now = time::OffsetDateTime::now_local()
+            .map_err(|e| GglError::IoError(format!("can't determine the local time: {}", e)))?;
+        Ok(match now.month() {
+            time::Month::January => Month {
+                year: now.year() - 1,
+                month: time::Month::December,
+            },
+            month => Month {
+                year: now.year(),
+                month: month.previous(),
+            },
+        })
+    }
+
+    /// The start of the month and of the next one in local time, in seconds
+    /// since the epoch.
+    pub fn range(&self) -> Result<(i64, i64), GglError> {
+        let next = match self.month {
+            time::Month::December => Month {
+                year: self.year + 1,
+                month: time::Month::January,
+            },
+            month => Month {
+                year: self.year,
+                month: month.next(),
+            },
+        };
+        Ok((month_start(self)?, month_start(&next)?))
+    }
+}
+
+// The first second of the month in local time.
+fn month_start(month: &Month) -> Result<i64, GglError> {
+    let day = time::Date::from_calendar_date(month.year, month.month, 1)
+        .map_err(|e| GglError::IoError(format!("{}: {}", month, e)))?;
+    let midnight = day.midnight().assume_utc();
+    // The offset can differ from month to month because of DST
+    let offset = time::UtcOffset::local_offset_at(midnight).unwrap_or(time::UtcOffset::UTC);
+    Ok(day.midnight().assume_offset(offset).unix_timestamp())
+}
+
+/// The commits of a repository or author.
+#[derive(Debug, Serialize)]
+pub struct Section<'a> {
+    pub name: String,
+    pub commits: Vec<&'a GlobalCommit>,
+}
+
+/// The commits of a month, once per repository and once per author.
+#[derive(Debug, Serialize)]
+pub struct Report<'a> {
+    pub month: String,
+    pub commits: usize,
+    pub repositories: Vec<Section<'a>>,
+    pub authors: Vec<Section<'a>>,
+}
+
+// Group the commits under the names `names` gives each of them, with the most
+// commits first, and alphabetically for the same number of commits.
+fn sections<'a>(
+    commits: &[&'a GlobalCommit],
+    names: impl Fn(&'a GlobalCommit) -> Vec<String>,
+) -> Vec<Section<'a>> {
+    let mut sections: Vec<Section> = vec![];
+    for commit in commits {
+        for name in names(commit) {
+            match sections.iter_mut().find(|s| s.name == name) {
+                Some(section) => section.commits.push(commit),
+                None => sections.push(Section {
+                    name,
+                    commits: vec![commit],
+                }),
+            }
+        }
+    }
+    sections.sort_by(|a, b| {
+        b.commits
+            .len()
+            .cmp(&a.commits.len())
+            .then(a.name.cmp(&b.name))
+    });
+    sections
+}
+
+/// Build the report of `month` from a timeline that covers it.  Co-authors
+/// get the commits in their sections too, like in `ggl stats`.
+pub fn build(timeline: &Timeline, month: Month) -> Report<'_> {
+    let commits: Vec<&GlobalCommit> = timeline.commits().collect();
+    Report {
+        month: month.to_string(),
+        commits: commits.len(),
+        repositories: sections(&commits, |c| vec![c.repo_name.clone()]),
+        authors: sections(&commits, |c| {
+            c.authors()
+                .into_iter()
+                .map(|(name, _)| name.to_string())
+                .collect()
+        }),
+    }
+}
+
+fn plural(n: usize, one: &str, many: &str) -> String {
+    if n == 1 {
+        format!("1 {}", one)
+    } else {
+        format!("{} {}", n, many)
+    }
+}
+
+/// Write the report as Markdown: the commits of every repository, and then
+/// how many commits every author made in which repositories.
+pub fn write(w: &mut dyn Write, report: &Report) -> io::Result<()> {
+    writeln!(w, "# {}", report.month)?;
+    writeln!(w)?;
+    writeln!(
+        w,
+        "{} in {} by {}.",
+        plural(report.commits, "commit", "commits"),
+        plural(report.repositories.len(), "repository", "repositories"),
+        plural(report.authors.len(), "author", "authors")
+    )?;
+
+    if report.commits == 0 {
+        return Ok(());
+    }
+
+    writeln!(w)?;
+    writeln!(w, "## Repositories")?;
+    for section in &report.repositories {
+        writeln!(w)?;
+        writeln!(
+            w,
+            "### {} ({})",
+            section.name,
+            plural(section.commits.len(), "commit", "commits")
+        )?;
+        writeln!(w)?;
+        for commit in &section.commits {
+            let subject = commit.message.lines().next().unwrap_or("");
+            writeln!(w, "- `{}` {} ({})", commit.short(), subject, commit.author)?;
+        }
+    }
+
+    writeln!(w)?;
+    writeln!(w, "## Authors")?;
+    for section in &report.authors {
+        writeln!(w)?;
+        writeln!(
+            w,
+            "### {} ({})",
+            section.name,
+            plural(section.commits.len(), "commit", "commits")
+        )?;
+        writeln!(w)?;
+        let mut repositories: Vec<(&str, usize)> = vec![];
+        for commit in &section.commits {
+            match repositories
+                .iter_mut()
+                .find(|(name, _)| *name == commit.repo_name)
+            {
+                Some((_, n)) => *n += 1,
+                None => repositories.push((&commit.repo_name, 1)),
+            }
+        }
+        repositories.sort_by(|a, b| b.1.cmp(&a.1).then(a.0.cmp(b.0)));
+        for (name, n) in repositories {
+            writeln!(w, "- {}: {}", name, plural(n, "commit", "commits"))?;
+        }
+    }
+
+    Ok(())
+}
@@ -0,0 +1,254 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl list`, `ggl status` and `ggl doctor`: reports about the repositories in the config themselves,
+//! rather than their commits.
+
+use crate::collect::{
+    open_repository, remote_prefix, remote_views, resolve_branch, resolve_tip, selected,
+    CollectOptions,
+};
+use crate::config::{Config, Repository, RepositoryType};
+use crate::error::GglError;
+use std::io;
+use std::io::Write;
+use std::path::Path;
+use std::process::{Command, Stdio};
+
+// Write rows under their headings, in columns as wide as their widest cell.
+// The last column isn't padded.
+fn write_table(w: &mut dyn Write, headings: &[&str], rows: &[Vec<String>]) -> io::Result<()> {
+    let mut widths: Vec<usize> = headings.iter().map(|h| h.chars().count()).collect();
+    for row in rows {
+        for (width, cell) in widths.iter_mut().zip(row) {
+            *width = (*width).max(cell.chars().count());
+        }
+    }
+
+    let headings: Vec<String> = headings.iter().map(|h| h.to_string()).collect();
+    for row in Some(&headings).into_iter().chain(rows) {
+        let mut line = String::new();
+        for (i, cell) in row.iter().enumerate() {
+            if i + 1 == row.len() {
+                line.push_str(cell);
+            } else {
+                line.push_str(&format!("{:<width$}  ", cell, width = widths[i]));
+            }
+        }
+        writeln!(w, "{}", line.trim_end())?;
+    }
+    Ok(())
+}
+
+/// List every repository with where it is, what we walk in it, and whether
+/// it's there.
+pub fn list(w: &mut dyn Write, config: &Config) -> io::Result<()> {
+    let mut rows = vec![];
+
+    for block in &config.blocks {
+        for r in &block.repositories {
+            if r.kind != RepositoryType::Local {
+                let kind = format!("{:?}", r.kind).to_lowercase();
+                rows.push(vec![
+                    r.name.clone(),
+                    format!("{}:{}", kind, r.path),
+                    "-".to_string(),
+                    r.branch.clone().unwrap_or_else(|| "-".to_string()),
+                    "-".to_string(),
+                ]);
+                continue;
+            }
+
+            let path = Path::new(&block.root).join(&r.path);
+            let repo = open_repository(&path).ok();
+            let (remote, branch) = if r.remotes.is_empty() {
+                let branch = match &repo {
+                    Some(repo) => resolve_branch(repo, r).ok(),
+                    None => r.branch.clone(),
+                };
+                (r.remote.clone(), branch.unwrap_or_else(|| "?".to_string()))
+            } else {
+                let remotes: Vec<String> = r
+                    .remotes
+                    .iter()
+                    .map(|remote| match &remote.branch {
+                        Some(branch) => format!("{}/{}", remote.remote, branch),
+                        None => remote.remote.clone(),
+                    })
+                    .collect();
+                (remotes.join(", "), "-".to_string())
+            };
+
+            rows.push(vec![
+                r.name.clone(),
+                path.display().to_string(),
+                remote,
+                branch,
+                if repo.is_some() { "yes" } else { "no" }.to_string(),
+            ]);
+        }
+    }
+
+    write_table(w, &["Name", "Path", "Remote", "Branch", "On disk"], &rows)
+}
+
+// How the local branch compares to the remote-tracking branch it follows.
+fn ahead_behind(repo: &git2::Repository, r: &Repository) -> Result<Vec<String>, GglError> {
+    let branch = resolve_branch(repo, r)?;
+    let remote = repo
+        .find_reference(&format!("{}{}", remote_prefix(repo, &r.remote), branch))
+        .and_then(|reference| reference.peel_to_commit())
+        .map_err(|_| GglError::IoError(format!("no {}/{}", r.remote, branch)))?;
+    let local = match repo.find_reference(&format!("refs/heads/{}", branch)) {
+        Ok(reference) => reference.peel_to_commit()?,
+        Err(_) => return Err(GglError::IoError(format!("no local {}", branch))),
+    };
+
+    let (ahead, behind) = repo.graph_ahead_behind(local.id(), remote.id())?;
+    let state = match (ahead, behind) {
+        (0, 0) => "up to date",
+        (_, 0) => "needs push",
+        (0, _) => "needs pull",
+        _ => "diverged",
+    };
+    Ok(vec![
+        format!("{}/{}", r.remote, branch),
+        ahead.to_string(),
+        behind.to_string(),
+        state.to_string(),
+    ])
+}
+
+/// Show how far the local branch of every repository is ahead of and behind
+/// its remote-tracking branch, as of the last fetch.  Repositories on a forge
+/// have no local branch, and are left out.
+pub fn status(w: &mut dyn Write, config: &Config, opts: &CollectOptions) -> io::Result<()> {
+    let mut rows = vec![];
+
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local && selected(r, opts))
+        {
+            let repo = open_repository(&Path::new(&block.root).join(&r.path));
+            for view in remote_views(r) {
+                let columns = match &repo {
+                    Ok(repo) => ahead_behind(repo, &view),
+                    Err(e) => Err(GglError::IoError(format!("{}", e))),
+                };
+                let mut row = vec![view.name.clone()];
+                match columns {
+                    Ok(columns) => row.extend(columns),
+                    Err(e) => {
+                        row.extend(vec!["-".into(), "-".into(), "-".into(), format!("{}", e)])
+                    }
+                }
+                rows.push(row);
+            }
+        }
+    }
+
+    write_table(w, &["Name", "Tracking", "Ahead", "Behind", "Status"], &rows)
+}
+
+// Whether we can talk to the remote, e.g. that the credentials work, without
+// fetching anything.  git doesn't get to prompt for a password.
+fn check_remote(path: &Path, remote: &str, proxy: &Option<String>) -> Result<(), String> {
+    let mut cmd = Command::new("git");
+    if let Some(proxy) = proxy {
+        cmd.arg("-c").arg(format!("http.proxy={}", proxy));
+    }
+    let output = cmd
+        .arg("-C")
+        .arg(path)
+        .args(["ls-remote", "--heads", remote])
+        .env("GIT_TERMINAL_PROMPT", "0")
+        .stdin(Stdio::null())
+        .output()
+        .map_err(|e| format!("can't run git: {}", e))?;
+    if output.status.success() {
+        return Ok(());
+    }
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    let reason = stderr
+        .lines()
+        .find(|l| !l.trim().is_empty())
+        .unwrap_or("")
+        .trim_start_matches("fatal: ");
+    Err(format!("can't reach {}: {}", remote, reason))
+}
+
+// Everything that's wrong with one repository.  We stop at the first problem
+// that makes the rest impossible to check.
+fn diagnose(path: &Path, r: &Repository) -> Vec<String> {
+    if !path.is_dir() {
+        return vec![format!("{} doesn't exist", path.display())];
+    }
+    let repo = match open_repository(path) {
+        Ok(repo) => repo,
+        Err(e) => return vec![format!("{}", e)],
+    };
+
+    let mut problems = vec![];
+    if repo.head_detached().unwrap_or(false) {
+        problems.push("HEAD is detached".to_string());
+    }
+
+    for view in remote_views(r) {
+        if repo.find_remote(&view.remote).is_err() {
+            problems.push(format!("there's no remote called {}", view.remote));
+            continue;
+        }
+        if let Err(e) = resolve_tip(&repo, &view) {
+            problems.push(format!("{}", e));
+        }
+        if view.fetch {
+            if let Err(e) = check_remote(path, &view.remote, &view.proxy) {
+                problems.push(e);
+            }
+        }
+    }
+    problems
+}
+
+/// Check every repository for what would keep ggl from walking or fetching
+/// it, and write a diagnosis for each.  Returns how many repositories have
+/// problems.
+pub fn doctor(w: &mut dyn Write, config: &Config, opts: &CollectOptions) -> io::Result<usize> {
+    let mut broken = 0;
+
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local && selected(r, opts))
+        {
+            let problems = diagnose(&Path::new(&block.root).join(&r.path), r);
+            if problems.is_empty() {
+                writeln!(w, "{}: ok", r.name)?;
+                continue;
+            }
+            broken += 1;
+            writeln!(w, "{}:", r.name)?;
+            for problem in problems {
+                writeln!(w, "  - {}", problem)?;
+            }
+        }
+    }
+
+    Ok(broken)
+}
@@ -0,0 +1,229 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! The `rules` from the config: conditions on new commits, checked by
+//! `ggl daemon`, and what to do about the commits that meet them.
+
+use crate::collect::{open_repository, GlobalCommit};
+use crate::config::{Action, Config, RepositoryType, Rule};
+use crate::error::GglError;
+use crate::files;
+use crate::glob;
+use crate::notify::post_json;
+use crate::pattern::Pattern;
+use colored::*;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+
+struct Compiled<'a> {
+    rule: &'a Rule,
+    grep: Option<Pattern>,
+    authors: Vec<Pattern>,
+}
+
+/// The rules of a config, ready to check commits against.
+pub struct Rules<'a> {
+    rules: Vec<Compiled<'a>>,
+    repo_paths: HashMap<String, PathBuf>,
+    // The branch each repository is configured to follow, for the commits of
+    // repositories without `remotes`, which don't say which branch they're on
+    repo_branches: HashMap<String, String>,
+    repos: HashMap<String, git2::Repository>,
+}
+
+#[derive(Serialize)]
+struct WebhookMessage<'a> {
+    rule: &'a str,
+    commits: &'a [&'a GlobalCommit],
+}
+
+impl<'a> Rules<'a> {
+    /// Compile the patterns of the rules in `config`.
+    pub fn new(config: &'a Config) -> Result<Rules<'a>, GglError> {
+        let compile = |rule: &Rule, source: &str| {
+            Pattern::parse(source, true)
+                .map_err(|e| GglError::ConfigParserError(format!("rule {}: {}", rule.name, e)))
+        };
+
+        let mut rules = vec![];
+        for rule in &config.rules {
+            rules.push(Compiled {
+                rule,
+                grep: match &rule.grep {
+                    Some(grep) => Some(compile(rule, grep)?),
+                    None => None,
+                },
+                authors: rule
+                    .authors
+                    .iter()
+                    .map(|author| compile(rule, author))
+                    .collect::<Result<_, _>>()?,
+            });
+        }
+
+        let mut repo_paths = HashMap::new();
+        let mut repo_branches = HashMap::new();
+        for block in &config.blocks {
+            for r in &block.repositories {
+                if let Some(branch) = &r.branch {
+                    repo_branches.insert(r.name.clone(), branch.clone());
+                }
+                if r.kind == RepositoryType::Local {
+                    repo_paths.insert(r.name.clone(), Path::new(&block.root).join(&r.path));
+                }
+            }
+        }
+
+        Ok(Rules {
+            rules,
+            repo_paths,
+            repo_branches,
+            repos: HashMap::new(),
+        })
+    }
+
+    /// Check the commits against every rule, and act on the ones that meet
+    /// it.  Errors are reported, and don't keep the other rules from being
+    /// checked.
+    pub fn apply(&mut self, commits: &[&GlobalCommit]) {
+        for i in 0..self.rules.len() {
+            let mut matching = vec![];
+            for commit in commits {
+                match self.matches(i, commit) {
+                    Ok(true) => matching.push(*commit),
+                    Ok(false) => {}
+                    Err(e) => eprintln!("error: rule {}: {:?}", self.rules[i].rule.name, e),
+                }
+            }
+            if matching.is_empty() {
+                continue;
+            }
+
+            let rule = self.rules[i].rule;
+            for action in &rule.actions {
+                if let Err(e) = act(rule, action, &matching) {
+                    eprintln!("error: rule {}: {:?}", rule.name, e);
+                }
+            }
+        }
+    }
+
+    // The cheap conditions first, so that we only look at the files of
+    // commits that meet all the others.
+    fn matches(&mut self, i: usize, commit: &GlobalCommit) -> Result<bool, GglError> {
+        let compiled = &self.rules[i];
+        let rule = compiled.rule;
+
+        if !rule.repositories.is_empty()
+            && !rule
+                .repositories
+                .iter()
+                .any(|pattern| glob::matches(pattern, &commit.repo_name))
+        {
+            return Ok(false);
+        }
+        if !rule.branches.is_empty() && !self.on_branch(commit, &rule.branches) {
+            return Ok(false);
+        }
+        if let Some(grep) = &compiled.grep {
+            if !grep.is_match(&commit.message) {
+                return Ok(false);
+            }
+        }
+        if !compiled.authors.is_empty()
+            && !compiled.authors.iter().any(|a| commit.author_matches(a))
+        {
+            return Ok(false);
+        }
+        if rule.paths.is_empty() {
+            return Ok(true);
+        }
+
+        let repo = match self.repository(&commit.repo_name)? {
+            Some(repo) => repo,
+            // Not on disk, so we can't tell
+            None => return Ok(false),
+        };
+        let c = repo.find_commit(git2::Oid::from_str(&commit.sha)?)?;
+        Ok(files::changes(repo, &c)?.iter().any(|change| {
+            rule.paths
+                .iter()
+                .any(|pattern| glob::matches(pattern, &change.path))
+        }))
+    }
+
+    // Whether the commit is on one of `branches`, which may leave out the
+    // remote: `main` is on `upstream/main`.
+    fn on_branch(&self, commit: &GlobalCommit, branches: &[String]) -> bool {
+        let on: Vec<&str> = if commit.branches.is_empty() {
+            self.repo_branches
+                .get(&commit.repo_name)
+                .map(|branch| branch.as_str())
+                .into_iter()
+                .collect()
+        } else {
+            commit
+                .branches
+                .iter()
+                .map(|branch| branch.as_str())
+                .collect()
+        };
+        on.iter().any(|on| {
+            branches
+                .iter()
+                .any(|branch| on == branch || on.ends_with(&format!("/{}", branch)))
+        })
+    }
+
+    fn repository(&mut self, name: &str) -> Result<Option<&git2::Repository>, GglError> {
+        if !self.repos.contains_key(name) {
+            let path = match self.repo_paths.get(name) {
+                Some(path) => path,
+                None => return Ok(None),
+            };
+            self.repos.insert(name.to_string(), open_repository(path)?);
+        }
+        Ok(self.repos.get(name))
+    }
+}
+
+fn act(rule: &Rule, action: &Action, commits: &[&GlobalCommit]) -> Result<(), GglError> {
+    match action {
+        Action::Alert => {
+            for commit in commits {
+                let subject = commit.message.lines().next().unwrap_or("");
+                println!(
+                    "{} {}: {} {} {} ({})",
+                    "ALERT".red().bold(),
+                    rule.name.bold(),
+                    commit.repo_name,
+                    commit.short().yellow(),
+                    subject,
+                    commit.author
+                );
+            }
+            Ok(())
+        }
+        Action::Webhook { url } => {
+            let body = serde_json::to_vec(&WebhookMessage {
+                rule: &rule.name,
+                commits,
+            })?;
+            post_json(url, &body)
+        }
+    }
+}
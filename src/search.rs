@@ -0,0 +1,239 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl search`: find commits by the words in their messages, across every
+//! repository, through an index built from the commit cache.
+//!
+//! The index lives next to the cache.  Every search brings it up to date
+//! first, indexing again only the repositories whose cache changed since, so
+//! that a search is a lookup rather than a walk through history.
+
+use crate::cache;
+use crate::collect::{remote_views, CollectOptions};
+use crate::config::{self, Config, RepositoryType};
+use crate::debug;
+use crate::error::GglError;
+use crate::output::short_relative_time;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap, HashSet};
+use std::fs;
+use std::io;
+use std::io::Write;
+use std::path::PathBuf;
+
+/// A commit that matches.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Hit {
+    pub repo: String,
+    pub sha: String,
+    pub short_sha: String,
+    pub author: String,
+    pub date: time::OffsetDateTime,
+    pub subject: String,
+}
+
+// The commits of one repository, as of the cache with this `head` and
+// `until`, and the positions of the commits with each word in `commits`.
+#[derive(Serialize, Deserialize)]
+struct RepoIndex {
+    head: String,
+    until: i64,
+    commits: Vec<Hit>,
+    words: BTreeMap<String, Vec<u32>>,
+}
+
+#[derive(Default, Serialize, Deserialize)]
+struct Index {
+    repos: HashMap<String, RepoIndex>,
+}
+
+fn index_path() -> Result<PathBuf, GglError> {
+    Ok(cache::cache_dir()?.join("search.json"))
+}
+
+// A missing or unreadable index is not an error; we build it again.
+fn read_index() -> Index {
+    index_path()
+        .ok()
+        .and_then(|path| fs::read(path).ok())
+        .and_then(|contents| serde_json::from_slice(&contents).ok())
+        .unwrap_or_default()
+}
+
+fn write_index(index: &Index) -> Result<(), GglError> {
+    let path = index_path()?;
+    fs::create_dir_all(cache::cache_dir()?)?;
+
+    cache::write_atomically(&path, &serde_json::to_vec(index)?)
+}
+
+// The words of a text, lowercased, each once.
+fn words(text: &str) -> Vec<String> {
+    let mut words: Vec<String> = text
+        .split(|c: char| !c.is_alphanumeric())
+        .filter(|w| !w.is_empty())
+        .map(|w| w.to_lowercase())
+        .collect();
+    words.sort();
+    words.dedup();
+    words
+}
+
+fn index_repo(repo: &str, cached: cache::RepoCache) -> RepoIndex {
+    let mut index = RepoIndex {
+        head: cached.head,
+        until: cached.until,
+        commits: vec![],
+        words: BTreeMap::new(),
+    };
+
+    for commit in cached.sets.iter().flat_map(|set| &set.commits) {
+        let position = index.commits.len() as u32;
+        for word in words(&commit.message) {
+            index.words.entry(word).or_default().push(position);
+        }
+        index.commits.push(Hit {
+            repo: repo.to_string(),
+            sha: commit.sha.clone(),
+            short_sha: commit.short().to_string(),
+            author: commit.author.clone(),
+            date: commit.date,
+            subject: commit.message.lines().next().unwrap_or("").to_string(),
+        });
+    }
+
+    index
+}
+
+// Bring the index up to date with the cache of every local repository in
+// the config, and drop the ones that are gone.
+fn update(config: &Config) -> Result<Index, GglError> {
+    let mut old = read_index();
+    let mut index = Index::default();
+    let mut changed = false;
+
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local)
+        {
+            for view in remote_views(r) {
+                let cached = match cache::read_repo(&view.name) {
+                    Some(cached) => cached,
+                    None => {
+                        debug!("{}: not in the cache", view.name);
+                        continue;
+                    }
+                };
+
+                let repo_index = match old.repos.remove(&view.name) {
+                    Some(i) if i.head == cached.head && i.until == cached.until => i,
+                    _ => {
+                        debug!("{}: indexing", view.name);
+                        changed = true;
+                        index_repo(&r.name, cached)
+                    }
+                };
+                index.repos.insert(view.name, repo_index);
+            }
+        }
+    }
+
+    if changed || !old.repos.is_empty() {
+        write_index(&index)?;
+    }
+    Ok(index)
+}
+
+// The positions of the commits with a word that starts with `prefix`.
+fn lookup(index: &RepoIndex, prefix: &str) -> Vec<u32> {
+    let mut positions: Vec<u32> = index
+        .words
+        .range(prefix.to_string()..)
+        .take_while(|(word, _)| word.starts_with(prefix))
+        .flat_map(|(_, positions)| positions.iter().copied())
+        .collect();
+    positions.sort_unstable();
+    positions.dedup();
+    positions
+}
+
+/// The commits whose messages have every word of `query`, or a word that
+/// starts with it, ignoring case, newest first.  Only the repositories that
+/// --repo picked, and --exclude-repo didn't leave out, are searched, and only
+/// as far back as they were cached.
+pub fn search(config: &Config, opts: &CollectOptions, query: &str) -> Result<Vec<Hit>, GglError> {
+    let terms = words(query);
+    if terms.is_empty() {
+        return Err(GglError::IoError("search for what?".to_string()));
+    }
+
+    let index = update(config)?;
+    let mut hits: Vec<Hit> = vec![];
+    // The same commit on several remotes is only a hit once
+    let mut seen: HashSet<(String, String)> = HashSet::new();
+
+    for repo_index in index.repos.values() {
+        let mut matches: Option<Vec<u32>> = None;
+        for term in &terms {
+            let found = lookup(repo_index, term);
+            matches = Some(match matches {
+                None => found,
+                // Both are sorted
+                Some(m) => m
+                    .into_iter()
+                    .filter(|p| found.binary_search(p).is_ok())
+                    .collect(),
+            });
+        }
+
+        for position in matches.unwrap_or_default() {
+            let hit = &repo_index.commits[position as usize];
+            if (!opts.repos.is_empty() && !opts.repos.contains(&hit.repo))
+                || config::excluded(&hit.repo, &opts.exclude_repos)
+            {
+                continue;
+            }
+            if seen.insert((hit.repo.clone(), hit.sha.clone())) {
+                hits.push(hit.clone());
+            }
+        }
+    }
+
+    hits.sort_by(|a, b| b.date.cmp(&a.date));
+    Ok(hits)
+}
+
+/// Write one line per hit, with how long ago it was committed, or the date
+/// with `absolute`.
+pub fn write(w: &mut dyn Write, hits: &[Hit], absolute: bool) -> io::Result<()> {
+    let format = time::macros::format_description!("[year]-[month]-[day]");
+    let now = time::OffsetDateTime::now_utc();
+    for hit in hits {
+        let date = if absolute {
+            hit.date.format(&format).unwrap()
+        } else {
+            short_relative_time(&hit.date, &now)
+        };
+        writeln!(
+            w,
+            "{} {:<12} {:<10} {}",
+            hit.short_sha, hit.repo, date, hit.subject
+        )?;
+    }
+    Ok(())
+}
@@ -0,0 +1,989 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl serve`: a small HTTP server showing the log as a web page.
+
+use crate::collect::{
+    collect_timeline, fetch_all, get_until, selected, CollectOptions, GlobalCommit, Timeline,
+};
+use crate::config::{Config, RepositoryType};
+use crate::error::GglError;
+use crate::files;
+use crate::hook;
+use crate::interrupt;
+use crate::metrics;
+use crate::output::{escape_html, write_html_commits, DateFormat, HTML_HEAD};
+use crate::stats;
+use crate::ui;
+use crate::{debug, info};
+use base64::engine::general_purpose::STANDARD;
+use base64::Engine;
+use ring::hmac;
+use rustls::pki_types::pem::PemObject;
+use rustls::pki_types::{CertificateDer, PrivateKeyDer};
+use serde::Serialize;
+use std::io;
+use std::io::{BufRead, BufReader, Read, Write};
+use std::net::TcpListener;
+use std::path::Path;
+use std::str;
+use std::sync::{Arc, Mutex};
+use std::thread;
+use std::time::{Duration, Instant};
+
+/// Filters given in the query string of a request, e.g.
+/// `/?repo=linux&author=linus&from=2022-12-01&to=2022-12-31`.  `since` is
+/// another name for `from`, and `offset` and `limit` page through the
+/// commits of /commits.  /commit takes the `repo` and `sha` of one commit.
+#[derive(Default)]
+struct Query {
+    repo: Option<String>,
+    sha: Option<String>,
+    author: Option<String>,
+    from: Option<time::Date>,
+    to: Option<time::Date>,
+    offset: usize,
+    limit: Option<usize>,
+}
+
+impl Query {
+    fn parse(query: &str) -> Result<Query, String> {
+        let format = time::macros::format_description!("[year]-[month]-[day]");
+        let mut q = Query::default();
+
+        for pair in query.split('&') {
+            let (key, value) = pair.split_once('=').unwrap_or((pair, ""));
+            let value = percent_decode(value);
+            if value.is_empty() {
+                continue;
+            }
+
+            match key {
+                "repo" => q.repo = Some(value),
+                "sha" => q.sha = Some(value),
+                "author" => q.author = Some(value),
+                "from" | "since" | "to" => {
+                    let date = time::Date::parse(&value, &format)
+                        .map_err(|_| format!("invalid date: {}", value))?;
+                    if key != "to" {
+                        q.from = Some(date);
+                    } else {
+                        q.to = Some(date);
+                    }
+                }
+                "offset" | "limit" => {
+                    let n: usize = value
+                        .parse()
+                        .map_err(|_| format!("invalid {}: {}", key, value))?;
+                    if key == "offset" {
+                        q.offset = n;
+                    } else {
+                        q.limit = Some(n);
+                    }
+                }
+                _ => {}
+            }
+        }
+
+        Ok(q)
+    }
+
+    fn matches(&self, commit: &GlobalCommit) -> bool {
+        if let Some(repo) = &self.repo {
+            if &commit.repo_name != repo {
+                return false;
+            }
+        }
+
+        if let Some(author) = &self.author {
+            if !commit.authored_by(author) {
+                return false;
+            }
+        }
+
+        let date = commit.date.date();
+
+        if let Some(from) = self.from {
+            if date < from {
+                return false;
+            }
+        }
+
+        if let Some(to) = self.to {
+            if date > to {
+                return false;
+            }
+        }
+
+        true
+    }
+}
+
+fn percent_decode(s: &str) -> String {
+    let bytes = s.as_bytes();
+    let mut decoded: Vec<u8> = Vec::with_capacity(bytes.len());
+    let mut i = 0;
+
+    while i < bytes.len() {
+        let hex = bytes
+            .get(i + 1..i + 3)
+            .and_then(|h| str::from_utf8(h).ok())
+            .and_then(|h| u8::from_str_radix(h, 16).ok());
+
+        match (bytes[i], hex) {
+            (b'%', Some(byte)) => {
+                decoded.push(byte);
+                i += 3;
+            }
+            (b'+', _) => {
+                decoded.push(b' ');
+                i += 1;
+            }
+            (byte, _) => {
+                decoded.push(byte);
+                i += 1;
+            }
+        }
+    }
+
+    String::from_utf8_lossy(&decoded).into_owned()
+}
+
+fn write_form(w: &mut dyn Write, timeline: &Timeline, query: &Query) -> io::Result<()> {
+    let mut repo_names: Vec<&str> = timeline.commits().map(|c| c.repo_name.as_str()).collect();
+    repo_names.sort();
+    repo_names.dedup();
+
+    let value = |v: &Option<String>| escape_html(v.as_deref().unwrap_or(""));
+    let date = |d: &Option<time::Date>| d.map(|d| d.to_string()).unwrap_or_default();
+
+    writeln!(w, "<form method=\"get\" action=\"/\">")?;
+    writeln!(w, "<select name=\"repo\">")?;
+    writeln!(w, "<option value=\"\">all repositories</option>")?;
+    for name in repo_names {
+        let selected = if query.repo.as_deref() == Some(name) {
+            " selected"
+        } else {
+            ""
+        };
+        let name = escape_html(name);
+        writeln!(
+            w,
+            "<option value=\"{}\"{}>{}</option>",
+            name, selected, name
+        )?;
+    }
+    writeln!(w, "</select>")?;
+    writeln!(
+        w,
+        "<input name=\"author\" placeholder=\"author\" value=\"{}\">",
+        value(&query.author)
+    )?;
+    writeln!(
+        w,
+        "<input name=\"from\" type=\"date\" value=\"{}\">",
+        date(&query.from)
+    )?;
+    writeln!(
+        w,
+        "<input name=\"to\" type=\"date\" value=\"{}\">",
+        date(&query.to)
+    )?;
+    writeln!(w, "<input type=\"submit\" value=\"filter\">")?;
+    writeln!(w, "</form>")
+}
+
+fn respond(
+    stream: &mut dyn Write,
+    status: &str,
+    content_type: &str,
+    body: &[u8],
+) -> io::Result<()> {
+    write!(
+        stream,
+        "HTTP/1.1 {}\r\nContent-Type: {}\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        status,
+        content_type,
+        body.len()
+    )?;
+    stream.write_all(body)?;
+    stream.flush()
+}
+
+fn unauthorized(stream: &mut dyn Write, auth: &Auth) -> io::Result<()> {
+    let body = b"unauthorized\n";
+    write!(stream, "HTTP/1.1 401 Unauthorized\r\n")?;
+    // Makes browsers ask for the username and password
+    if auth.basic.is_some() {
+        write!(stream, "WWW-Authenticate: Basic realm=\"ggl\"\r\n")?;
+    }
+    write!(
+        stream,
+        "Content-Type: text/plain\r\nContent-Length: {}\r\nConnection: close\r\n\r\n",
+        body.len()
+    )?;
+    stream.write_all(body)?;
+    stream.flush()
+}
+
+/// What the server shares between the connections and the background
+/// collection.
+struct State {
+    config: Config,
+    opts: CollectOptions,
+    until: Option<String>,
+    /// What the requests to /hook have to send as X-Gitlab-Token, or sign
+    /// their body with for X-Hub-Signature-256.  Without one, /hook takes
+    /// the same login as everything else.
+    hook_token: Option<String>,
+    auth: Auth,
+    timeline: Mutex<Timeline>,
+    // Held while collecting, so that a push doesn't collect at the same time
+    // as the background thread, writing the same cache files
+    collecting: Mutex<()>,
+}
+
+impl State {
+    // Collect the log again, and show it from now on.
+    fn refresh(&self, opts: &CollectOptions) -> Result<(), GglError> {
+        let _collecting = self.collecting.lock().unwrap();
+        let timeline = collect(&self.config, opts, &self.until)?;
+        // Shutting down, and the walks stopped halfway
+        if interrupt::interrupted() {
+            return Ok(());
+        }
+        *self.timeline.lock().unwrap() = timeline;
+        Ok(())
+    }
+}
+
+/// What requests have to send to see anything, from the `serve` section of
+/// the config, or else from GGL_SERVE_TOKEN, GGL_SERVE_USERNAME and
+/// GGL_SERVE_PASSWORD.
+struct Auth {
+    token: Option<String>,
+    // "username:password" in base64, as it comes in the Authorization header
+    basic: Option<String>,
+}
+
+impl Auth {
+    fn new(config: &Config) -> Result<Auth, GglError> {
+        let serve = config.serve.as_ref();
+        let setting =
+            |value: Option<&String>, env: &str| value.cloned().or_else(|| std::env::var(env).ok());
+
+        let token = setting(serve.and_then(|s| s.token.as_ref()), "GGL_SERVE_TOKEN");
+        let username = setting(
+            serve.and_then(|s| s.username.as_ref()),
+            "GGL_SERVE_USERNAME",
+        );
+        let password = setting(
+            serve.and_then(|s| s.password.as_ref()),
+            "GGL_SERVE_PASSWORD",
+        );
+
+        let basic = match (username, password) {
+            (Some(username), Some(password)) => {
+                Some(STANDARD.encode(format!("{}:{}", username, password)))
+            }
+            (None, None) => None,
+            _ => {
+                return Err(GglError::ConfigParserError(
+                    "serve needs both a username and a password".into(),
+                ))
+            }
+        };
+
+        Ok(Auth { token, basic })
+    }
+
+    fn allows(&self, headers: &Headers) -> bool {
+        if self.token.is_none() && self.basic.is_none() {
+            return true;
+        }
+
+        // Where the login of /ui keeps the token
+        let cookie = headers.cookie.as_deref().and_then(|cookies| {
+            cookies
+                .split(';')
+                .find_map(|c| c.trim().strip_prefix("ggl_token="))
+                .map(percent_decode)
+        });
+        if let (Some(token), Some(cookie)) = (&self.token, cookie) {
+            if same(token.as_bytes(), cookie.as_bytes()) {
+                return true;
+            }
+        }
+
+        let authorization = headers.authorization.as_deref();
+        let (scheme, credentials) = match authorization.and_then(|a| a.split_once(' ')) {
+            Some(parts) => parts,
+            None => return false,
+        };
+        let expected = match scheme.to_lowercase().as_str() {
+            "bearer" => &self.token,
+            "basic" => &self.basic,
+            _ => return false,
+        };
+        expected
+            .as_ref()
+            .map_or(false, |e| same(e.as_bytes(), credentials.trim().as_bytes()))
+    }
+}
+
+// Compare secrets in the same time wherever they differ, so that the time it
+// takes doesn't tell how much of a guess was right.
+fn same(a: &[u8], b: &[u8]) -> bool {
+    a.len() == b.len() && a.iter().zip(b).fold(0, |acc, (x, y)| acc | (x ^ y)) == 0
+}
+
+// The headers we care about.
+#[derive(Default)]
+struct Headers {
+    content_length: usize,
+    authorization: Option<String>,
+    cookie: Option<String>,
+    gitlab_token: Option<String>,
+    hub_signature: Option<String>,
+    github_event: Option<String>,
+}
+
+// Push payloads of big pushes can be large, but not this large
+const MAX_BODY: usize = 25 * 1024 * 1024;
+
+// The request line and the headers together
+const MAX_HEADERS: usize = 64 * 1024;
+
+// How many requests are answered at once; the others wait to be accepted
+const MAX_CONNECTIONS: usize = 64;
+
+// How long a client may take to send more of its request, or to take more of
+// the response, before we give up on it
+const IO_TIMEOUT: Duration = Duration::from_secs(30);
+
+// How long shutting down waits for the requests that are being answered, and
+// for a collection to stop
+const SHUTDOWN_TIMEOUT: Duration = Duration::from_secs(10);
+
+// A line of the head of a request, taken out of the `left` bytes it may still
+// have, or None if it doesn't fit.
+fn read_line(reader: &mut dyn BufRead, left: &mut usize) -> io::Result<Option<String>> {
+    let mut line = String::new();
+    let n = reader.take(*left as u64).read_line(&mut line)?;
+    if n == *left && !line.ends_with('\n') {
+        return Ok(None);
+    }
+    *left -= n;
+    Ok(Some(line))
+}
+
+// The headers, or None if they don't fit in the `left` bytes.
+fn read_headers(reader: &mut dyn BufRead, left: &mut usize) -> io::Result<Option<Headers>> {
+    let mut headers = Headers::default();
+    loop {
+        let line = match read_line(reader, left)? {
+            Some(line) => line,
+            None => return Ok(None),
+        };
+        if line.trim().is_empty() {
+            break;
+        }
+        let (name, value) = match line.split_once(':') {
+            Some((name, value)) => (name.trim().to_lowercase(), value.trim().to_string()),
+            None => continue,
+        };
+        match name.as_str() {
+            "content-length" => headers.content_length = value.parse().unwrap_or(0),
+            "authorization" => headers.authorization = Some(value),
+            "cookie" => headers.cookie = Some(value),
+            "x-gitlab-token" => headers.gitlab_token = Some(value),
+            "x-hub-signature-256" => headers.hub_signature = Some(value),
+            "x-github-event" => headers.github_event = Some(value),
+            _ => {}
+        }
+    }
+    Ok(Some(headers))
+}
+
+// Answer one request on `stream`, which is a TcpStream, or TLS over one.
+fn handle_connection(stream: impl Read + Write, state: &State) -> io::Result<()> {
+    let mut reader = BufReader::new(stream);
+    let mut left = MAX_HEADERS;
+    let head = match read_line(&mut reader, &mut left)? {
+        Some(request_line) => read_headers(&mut reader, &mut left)?.map(|h| (request_line, h)),
+        None => None,
+    };
+    let (request_line, headers) = match head {
+        Some(head) => head,
+        None => {
+            return respond(
+                reader.get_mut(),
+                "431 Request Header Fields Too Large",
+                "text/plain",
+                b"request header fields too large\n",
+            )
+        }
+    };
+
+    let mut parts = request_line.split_whitespace();
+    let method = parts.next().unwrap_or("");
+    let target = parts.next().unwrap_or("/");
+    let (path, query) = target.split_once('?').unwrap_or((target, ""));
+
+    if path == "/hook" {
+        if method != "POST" {
+            return respond(
+                reader.get_mut(),
+                "405 Method Not Allowed",
+                "text/plain",
+                b"method not allowed\n",
+            );
+        }
+        // Without a token of its own, /hook is like everything else
+        if state.hook_token.is_none() && !state.auth.allows(&headers) {
+            return unauthorized(reader.get_mut(), &state.auth);
+        }
+        if headers.content_length > MAX_BODY {
+            return respond(
+                reader.get_mut(),
+                "413 Payload Too Large",
+                "text/plain",
+                b"payload too large\n",
+            );
+        }
+        let mut body = vec![0; headers.content_length];
+        reader.read_exact(&mut body)?;
+        return handle_hook(reader.get_mut(), state, &headers, &body);
+    }
+
+    // /hook has its own token, since forges can't log in
+    let stream = reader.get_mut();
+    if !state.auth.allows(&headers) {
+        if path == "/ui" && state.auth.basic.is_none() {
+            let body = format!("{}{}", HTML_HEAD, ui::LOGIN);
+            return respond(
+                stream,
+                "401 Unauthorized",
+                "text/html; charset=utf-8",
+                body.as_bytes(),
+            );
+        }
+        return unauthorized(stream, &state.auth);
+    }
+
+    if method != "GET" {
+        return respond(
+            stream,
+            "405 Method Not Allowed",
+            "text/plain",
+            b"method not allowed\n",
+        );
+    }
+
+    if path == "/metrics" {
+        let body = metrics::render(&state.timeline.lock().unwrap());
+        return respond(
+            stream,
+            "200 OK",
+            "text/plain; version=0.0.4",
+            body.as_bytes(),
+        );
+    }
+
+    if path == "/ui" {
+        let body = format!("{}{}", HTML_HEAD, ui::PAGE);
+        return respond(
+            stream,
+            "200 OK",
+            "text/html; charset=utf-8",
+            body.as_bytes(),
+        );
+    }
+
+    if path == "/ui.js" {
+        return respond(
+            stream,
+            "200 OK",
+            "text/javascript; charset=utf-8",
+            ui::SCRIPT.as_bytes(),
+        );
+    }
+
+    if matches!(path, "/commits" | "/commit" | "/repos" | "/stats") {
+        return match api(state, path, query) {
+            Ok(body) => respond(stream, "200 OK", "application/json", &body),
+            Err(e) => {
+                let body = serde_json::to_vec(&ApiError { error: e }).unwrap_or_default();
+                respond(stream, "400 Bad Request", "application/json", &body)
+            }
+        };
+    }
+
+    if path != "/" {
+        return respond(stream, "404 Not Found", "text/plain", b"not found\n");
+    }
+
+    let query = match Query::parse(query) {
+        Ok(q) => q,
+        Err(e) => return respond(stream, "400 Bad Request", "text/plain", e.as_bytes()),
+    };
+
+    let mut body: Vec<u8> = vec![];
+    {
+        let timeline = state.timeline.lock().unwrap();
+        let commits: Vec<&GlobalCommit> = timeline.commits().filter(|c| query.matches(c)).collect();
+
+        write!(body, "{}", HTML_HEAD)?;
+        write_form(&mut body, &timeline, &query)?;
+        write_html_commits(&mut body, &commits, &DateFormat::Default)?;
+        writeln!(body, "</body>\n</html>")?;
+    }
+
+    respond(stream, "200 OK", "text/html; charset=utf-8", &body)
+}
+
+fn collect(
+    config: &Config,
+    opts: &CollectOptions,
+    until: &Option<String>,
+) -> Result<Timeline, GglError> {
+    let started = Instant::now();
+    let until = git2::Time::new(get_until(until)?, 0);
+    let result = collect_timeline(config, opts, until);
+    metrics::record_collection(started.elapsed(), result.is_ok());
+    result
+}
+
+#[derive(Serialize)]
+struct ApiError {
+    error: String,
+}
+
+/// A commit with its diff, or without one for repositories that aren't on
+/// disk.
+#[derive(Serialize)]
+struct CommitDetail<'a> {
+    commit: &'a GlobalCommit,
+    diff: Vec<String>,
+}
+
+/// A page of the commits that match the query, and how many match in all.
+#[derive(Serialize)]
+struct CommitsPage<'a> {
+    total: usize,
+    offset: usize,
+    commits: Vec<&'a GlobalCommit>,
+}
+
+// The JSON for an endpoint of the API:
+//
+// - /commits: the commits, filtered like the page, newest first
+// - /commit: one commit and its diff
+// - /repos: what `ggl summary` shows about every repository
+// - /stats: what `ggl stats` shows
+fn api(state: &State, endpoint: &str, query: &str) -> Result<Vec<u8>, String> {
+    let query = Query::parse(query)?;
+    let timeline = state.timeline.lock().unwrap();
+
+    let json = match endpoint {
+        "/commits" => {
+            let matching: Vec<&GlobalCommit> =
+                timeline.commits().filter(|c| query.matches(c)).collect();
+            let limit = query.limit.unwrap_or(matching.len());
+            serde_json::to_vec(&CommitsPage {
+                total: matching.len(),
+                offset: query.offset,
+                commits: matching
+                    .into_iter()
+                    .skip(query.offset)
+                    .take(limit)
+                    .collect(),
+            })
+        }
+        "/commit" => {
+            let (repo, sha) = match (&query.repo, &query.sha) {
+                (Some(repo), Some(sha)) => (repo, sha),
+                _ => return Err("repo and sha are required".to_string()),
+            };
+            let commit = timeline
+                .commits()
+                .find(|c| &c.repo_name == repo && &c.sha == sha)
+                .ok_or_else(|| format!("no commit {} in {}", sha, repo))?;
+            let path = state.config.blocks.iter().find_map(|block| {
+                block
+                    .repositories
+                    .iter()
+                    .find(|r| &r.name == repo && r.kind == RepositoryType::Local)
+                    .map(|r| Path::new(&block.root).join(&r.path))
+            });
+            let diff = match path {
+                Some(path) => files::patch(&path, sha).map_err(|e| e.message().to_string())?,
+                None => vec![],
+            };
+            serde_json::to_vec(&CommitDetail { commit, diff })
+        }
+        "/repos" => {
+            let names: Vec<String> = state
+                .config
+                .blocks
+                .iter()
+                .flat_map(|block| block.repositories.iter())
+                .filter(|r| selected(r, &state.opts))
+                .map(|r| r.name.clone())
+                .collect();
+            serde_json::to_vec(&stats::per_repository(&timeline, &names))
+        }
+        _ => serde_json::to_vec(&stats::compute(
+            &timeline,
+            get_until(&state.until).map_err(|e| e.to_string())?,
+        )),
+    };
+    json.map_err(|e| e.to_string())
+}
+
+// Fetch the repository of a push right away, and collect the log again.  We
+// answer before that, since forges don't wait long for the response.
+fn handle_hook(
+    stream: &mut dyn Write,
+    state: &State,
+    headers: &Headers,
+    body: &[u8],
+) -> io::Result<()> {
+    if let Some(token) = &state.hook_token {
+        if !signed(token, headers, body) {
+            return respond(
+                stream,
+                "403 Forbidden",
+                "text/plain",
+                b"wrong token or signature\n",
+            );
+        }
+    }
+
+    // GitHub checks a new webhook with this
+    if headers.github_event.as_deref() == Some("ping") {
+        return respond(stream, "200 OK", "text/plain", b"pong\n");
+    }
+
+    let urls = match hook::payload_urls(body) {
+        Ok(urls) => urls,
+        Err(e) => {
+            let message = format!("{:?}\n", e);
+            return respond(stream, "400 Bad Request", "text/plain", message.as_bytes());
+        }
+    };
+    let names: Vec<String> = hook::repositories(&state.config, &urls)
+        .into_iter()
+        .filter(|name| {
+            state
+                .config
+                .blocks
+                .iter()
+                .flat_map(|block| block.repositories.iter())
+                .any(|r| &r.name == name && selected(r, &state.opts))
+        })
+        .collect();
+    if names.is_empty() {
+        debug!("push to none of our repositories: {}", urls.join(", "));
+        return respond(
+            stream,
+            "404 Not Found",
+            "text/plain",
+            b"no repository in the config has this remote\n",
+        );
+    }
+
+    let message = format!("fetching {}\n", names.join(", "));
+    respond(stream, "202 Accepted", "text/plain", message.as_bytes())?;
+
+    info!("Push to {}", names.join(", "));
+    let fetch = CollectOptions {
+        fetch: true,
+        repos: names,
+        ..state.opts.clone()
+    };
+    // Everything else is up to date enough, or the next round fetches it
+    let refresh = CollectOptions {
+        fetch: false,
+        ..state.opts.clone()
+    };
+    if let Err(e) = fetch_all(&state.config, &fetch).and_then(|_| state.refresh(&refresh)) {
+        eprintln!("error: {:?}", e);
+    }
+    Ok(())
+}
+
+// Whether a push comes from a forge that knows the hook token: GitLab sends it
+// as it is, and GitHub and Gitea sign the body with it.
+fn signed(token: &str, headers: &Headers, body: &[u8]) -> bool {
+    if let Some(given) = &headers.gitlab_token {
+        return same(given.as_bytes(), token.as_bytes());
+    }
+    match headers
+        .hub_signature
+        .as_deref()
+        .and_then(|s| s.strip_prefix("sha256="))
+    {
+        Some(signature) => {
+            let key = hmac::Key::new(hmac::HMAC_SHA256, token.as_bytes());
+            unhex(signature).map_or(false, |tag| hmac::verify(&key, body, &tag).is_ok())
+        }
+        None => false,
+    }
+}
+
+// The bytes spelled by the hexadecimal string `s`.
+fn unhex(s: &str) -> Option<Vec<u8>> {
+    if s.len() % 2 != 0 {
+        return None;
+    }
+    (0..s.len())
+        .step_by(2)
+        .map(|i| s.get(i..i + 2).and_then(|h| u8::from_str_radix(h, 16).ok()))
+        .collect()
+}
+
+// The certificate chain and private key in the PEM files `cert` and `key`,
+// ready to serve HTTPS with.
+fn tls_config(cert: &str, key: &str) -> Result<Arc<rustls::ServerConfig>, GglError> {
+    let certs = CertificateDer::pem_file_iter(cert)
+        .and_then(|certs| certs.collect::<Result<Vec<_>, _>>())
+        .map_err(|e| GglError::IoError(format!("{}: {}", cert, e)))?;
+    if certs.is_empty() {
+        return Err(GglError::IoError(format!("{}: no certificate", cert)));
+    }
+    let private_key = PrivateKeyDer::from_pem_file(key)
+        .map_err(|e| GglError::IoError(format!("{}: {}", key, e)))?;
+
+    let config = rustls::ServerConfig::builder()
+        .with_no_client_auth()
+        .with_single_cert(certs, private_key)
+        .map_err(|e| GglError::IoError(format!("{}: {}", cert, e)))?;
+    Ok(Arc::new(config))
+}
+
+// The certificate and key files from the `serve` section of the config, if
+// it has them.
+fn tls_files(config: &Config) -> Result<Option<(String, String)>, GglError> {
+    let serve = config.serve.as_ref();
+    match (
+        serve.and_then(|s| s.tls_cert.clone()),
+        serve.and_then(|s| s.tls_key.clone()),
+    ) {
+        (Some(cert), Some(key)) => Ok(Some((cert, key))),
+        (None, None) => Ok(None),
+        _ => Err(GglError::ConfigParserError(
+            "serve needs both a tls-cert and a tls-key".into(),
+        )),
+    }
+}
+
+/// Serve the log over HTTP, or over HTTPS with `tls`, the certificate and
+/// key files from --tls-cert and --tls-key, or else the ones in the config.
+/// The log is collected once up front, and then again every `interval`
+/// seconds in the background, or right away for a repository that a push
+/// webhook at /hook tells us about.
+///
+/// Ctrl-C or SIGTERM stop the server: it stops taking connections, and
+/// returns once the requests it is answering are done, or after 10 seconds at
+/// the most.  Clients that send nothing for 30 seconds are dropped.
+pub fn serve(
+    config: Config,
+    opts: CollectOptions,
+    until: Option<String>,
+    listen: &str,
+    interval: u64,
+    hook_token: Option<String>,
+    tls: Option<(String, String)>,
+) -> Result<(), GglError> {
+    let auth = Auth::new(&config)?;
+    let tls = match tls {
+        Some(files) => Some(files),
+        None => tls_files(&config)?,
+    };
+    let tls = match tls {
+        Some((cert, key)) => Some(tls_config(&cert, &key)?),
+        None => None,
+    };
+    let timeline = collect(&config, &opts, &until)?;
+    let state = Arc::new(State {
+        auth,
+        config,
+        opts,
+        until,
+        hook_token,
+        timeline: Mutex::new(timeline),
+        collecting: Mutex::new(()),
+    });
+
+    interrupt::install();
+    interrupt::catch_sigterm();
+
+    let background = Arc::clone(&state);
+    let collector = thread::spawn(move || loop {
+        interrupt::sleep(Duration::from_secs(interval));
+        if interrupt::interrupted() {
+            break;
+        }
+        let opts = background.opts.clone();
+        if let Err(e) = background.refresh(&opts) {
+            eprintln!("error: {:?}", e);
+        }
+    });
+
+    let listener = TcpListener::bind(listen)?;
+    // Don't wait for connections forever, so that we notice a SIGTERM
+    listener.set_nonblocking(true)?;
+    let scheme = if tls.is_some() { "https" } else { "http" };
+    println!("Listening on {}://{}/", scheme, listener.local_addr()?);
+
+    let mut connections: Vec<thread::JoinHandle<()>> = vec![];
+    while !interrupt::interrupted() {
+        connections.retain(|c| !c.is_finished());
+        if connections.len() >= MAX_CONNECTIONS {
+            thread::sleep(Duration::from_millis(100));
+            continue;
+        }
+        let stream = match listener.accept() {
+            Ok((stream, _)) => stream,
+            Err(e) if e.kind() == io::ErrorKind::WouldBlock => {
+                thread::sleep(Duration::from_millis(100));
+                continue;
+            }
+            Err(e) => {
+                eprintln!("error: {}", e);
+                continue;
+            }
+        };
+        let blocking = stream
+            .set_nonblocking(false)
+            .and_then(|_| stream.set_read_timeout(Some(IO_TIMEOUT)))
+            .and_then(|_| stream.set_write_timeout(Some(IO_TIMEOUT)));
+        if let Err(e) = blocking {
+            eprintln!("error: {}", e);
+            continue;
+        }
+
+        let state = Arc::clone(&state);
+        let tls = tls.clone();
+        connections.push(thread::spawn(move || {
+            // The handshake happens as the request is read
+            let result = match tls {
+                Some(tls) => rustls::ServerConnection::new(tls)
+                    .map_err(|e| io::Error::new(io::ErrorKind::Other, e))
+                    .and_then(|tls| {
+                        handle_connection(rustls::StreamOwned::new(tls, stream), &state)
+                    }),
+                None => handle_connection(stream, &state),
+            };
+            if let Err(e) = result {
+                eprintln!("error: {}", e);
+            }
+        }));
+    }
+
+    info!("Shutting down");
+    connections.push(collector);
+    let deadline = Instant::now() + SHUTDOWN_TIMEOUT;
+    while connections.iter().any(|c| !c.is_finished()) {
+        if Instant::now() > deadline {
+            eprintln!("warning: not waiting any longer for requests to be done");
+            break;
+        }
+        thread::sleep(Duration::from_millis(100));
+    }
+
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn decodes_query_strings() {
+        assert_eq!(percent_decode("a%20b+c%2Fd"), "a b c/d");
+        assert_eq!(percent_decode("caf%C3%A9"), "café");
+        assert_eq!(percent_decode("%e2%9c%93"), "✓");
+    }
+
+    #[test]
+    fn reads_headers() {
+        let mut left = MAX_HEADERS;
+        let mut head: &[u8] = b"Content-Length: 12\r\nX-GitHub-Event: push\r\n\r\nbody";
+        let headers = read_headers(&mut head, &mut left).unwrap().unwrap();
+        assert_eq!(headers.content_length, 12);
+        assert_eq!(headers.github_event.as_deref(), Some("push"));
+        assert_eq!(head, b"body");
+    }
+
+    #[test]
+    fn limits_headers() {
+        let mut left = 32;
+        let mut head: &[u8] = b"X-Padding: aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa\r\n\r\n";
+        assert!(read_headers(&mut head, &mut left).unwrap().is_none());
+
+        let mut left = 32;
+        let mut head: &[u8] = b"A: b\r\nA: b\r\nA: b\r\nA: b\r\nA: b\r\nA: b\r\n\r\n";
+        assert!(read_headers(&mut head, &mut left).unwrap().is_none());
+    }
+
+    #[test]
+    fn keeps_bad_escapes() {
+        assert_eq!(percent_decode("100%"), "100%");
+        assert_eq!(percent_decode("%zz%4"), "%zz%4");
+    }
+
+    #[test]
+    fn takes_the_token_as_a_cookie() {
+        let auth = Auth {
+            token: Some("t0k/en".into()),
+            basic: None,
+        };
+        let with = |authorization: Option<&str>, cookie: Option<&str>| Headers {
+            authorization: authorization.map(String::from),
+            cookie: cookie.map(String::from),
+            ..Headers::default()
+        };
+        assert!(auth.allows(&with(Some("Bearer t0k/en"), None)));
+        assert!(auth.allows(&with(None, Some("theme=dark; ggl_token=t0k%2Fen"))));
+        assert!(!auth.allows(&with(None, Some("ggl_token=guess"))));
+        assert!(!auth.allows(&with(Some("Basic dDBrL2Vu"), None)));
+        assert!(!auth.allows(&with(None, None)));
+    }
+
+    #[test]
+    fn checks_hook_signatures() {
+        // GitHub's example
+        let token = "It's a Secret to Everybody";
+        let body = b"Hello, World!";
+        let mut headers = Headers {
+            hub_signature: Some(
+                "sha256=757107ea0eb2509fc211221cce984b8a37570b6d7586c22c46f4379c8b043e17".into(),
+            ),
+            ..Headers::default()
+        };
+        assert!(signed(token, &headers, body));
+        assert!(!signed(token, &headers, b"Hello, World?"));
+        assert!(!signed("guess", &headers, body));
+
+        headers.hub_signature = None;
+        assert!(!signed(token, &headers, body));
+        headers.gitlab_token = Some(token.into());
+        assert!(signed(token, &headers, body));
+        assert!(!signed("guess", &headers, body));
+    }
+}
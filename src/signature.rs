@@ -0,0 +1,104 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Verifying commit signatures with gpg.
+
+use serde::{Deserialize, Serialize};
+use std::fmt;
+use std::fs;
+use std::io::Write;
+use std::process::{Command, Stdio};
+
+/// What gpg had to say about a commit's signature.  `Unknown` covers
+/// signatures we can't check, e.g. because the key isn't in the keyring.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub enum SignatureStatus {
+    Good,
+    Bad,
+    Unknown,
+    Unsigned,
+}
+
+impl fmt::Display for SignatureStatus {
+    fn fmt(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        let s = match self {
+            SignatureStatus::Good => "Good",
+            SignatureStatus::Bad => "Bad",
+            SignatureStatus::Unknown => "Unknown",
+            SignatureStatus::Unsigned => "Unsigned",
+        };
+        write!(f, "{}", s)
+    }
+}
+
+/// Verify the signature of commit `id`, against `keyring` if given or the
+/// user's default keyring otherwise.
+pub fn verify(repo: &git2::Repository, id: git2::Oid, keyring: Option<&str>) -> SignatureStatus {
+    let (signature, signed_data) = match repo.extract_signature(&id, None) {
+        Ok(parts) => parts,
+        Err(_) => return SignatureStatus::Unsigned,
+    };
+
+    // gpg wants the signature in a file; the signed data goes to its stdin.
+    let sig_path = std::env::temp_dir().join(format!("ggl-{}-{}.sig", std::process::id(), id));
+    if fs::write(&sig_path, &*signature).is_err() {
+        return SignatureStatus::Unknown;
+    }
+
+    let status = run_gpg(&sig_path, &signed_data, keyring);
+    let _ = fs::remove_file(&sig_path);
+    status
+}
+
+fn run_gpg(
+    sig_path: &std::path::Path,
+    signed_data: &[u8],
+    keyring: Option<&str>,
+) -> SignatureStatus {
+    let mut cmd = Command::new("gpg");
+    cmd.args(["--batch", "--status-fd", "1"]);
+    if let Some(keyring) = keyring {
+        cmd.args(["--no-default-keyring", "--keyring", keyring]);
+    }
+    cmd.arg("--verify")
+        .arg(sig_path)
+        .arg("-")
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null());
+
+    let mut child = match cmd.spawn() {
+        Ok(child) => child,
+        Err(_) => return SignatureStatus::Unknown,
+    };
+    if let Some(mut stdin) = child.stdin.take() {
+        let _ = stdin.write_all(signed_data);
+    }
+    let output = match child.wait_with_output() {
+        Ok(output) => output,
+        Err(_) => return SignatureStatus::Unknown,
+    };
+
+    for line in String::from_utf8_lossy(&output.stdout).lines() {
+        match line.split_whitespace().nth(1) {
+            Some("GOODSIG") => return SignatureStatus::Good,
+            Some("BADSIG") => return SignatureStatus::Bad,
+            _ => {}
+        }
+    }
+
+    SignatureStatus::Unknown
+}
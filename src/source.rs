@@ -0,0 +1,98 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Where the history of a repository comes from, picked by its `type` in the
+//! config.  Every kind of repository is a [`Source`]: local clones are
+//! [`crate::collect::Local`], and the forges collect through their APIs.
+//! Adding one takes a `RepositoryType` and an arm in [`source`].
+
+use crate::collect::{self, CollectOptions, CommitSet};
+use crate::config::{Config, Repository, RepositoryType};
+use crate::error::GglError;
+use crate::forge;
+use crate::mailmap::Identities;
+use std::collections::HashMap;
+use std::path::Path;
+
+/// What every source needs to collect a repository.
+pub struct Context<'a> {
+    pub config: &'a Config,
+    pub opts: &'a CollectOptions,
+    pub until: git2::Time,
+    pub identities: &'a Identities,
+    /// The heads the last --new-only run saw, by repository name.
+    pub seen: &'a HashMap<String, String>,
+}
+
+/// The commits of a repository, filtered and annotated, ready to be merged
+/// into the timeline.
+#[derive(Default)]
+pub struct Collected {
+    pub sets: Vec<CommitSet>,
+    /// The commits that were walked from, by repository name, for
+    /// --new-only.  Sources that don't walk anything leave this empty.
+    pub heads: HashMap<String, String>,
+    /// Remote views to fold into their repository, see `remotes`.
+    pub folds: HashMap<String, (String, String)>,
+}
+
+/// A provider of history for a kind of repository.
+pub trait Source {
+    /// Bring the repository up to date, for `ggl fetch`.  Sources that always
+    /// ask the remote have nothing to do.
+    fn fetch(&self, _root: &Path, _r: &Repository, _opts: &CollectOptions) -> Result<(), GglError> {
+        Ok(())
+    }
+
+    /// The commits of the repository since `ctx.until`, newest first, with
+    /// the filters of `ctx.opts` applied.  `root` is the block the
+    /// repository is in.  The repository's `timeout` and `proxy` apply, if
+    /// the source can honor them; a source that gives up returns a
+    /// [`GglError::TimeoutError`], and the repository is left out.
+    fn collect(&self, ctx: &Context, root: &Path, r: &Repository) -> Result<Collected, GglError>;
+}
+
+pub struct Github;
+pub struct Gitlab;
+pub struct Gitea;
+
+impl Source for Github {
+    fn collect(&self, ctx: &Context, _root: &Path, r: &Repository) -> Result<Collected, GglError> {
+        collect::collect_remote(ctx, r, forge::collect_github)
+    }
+}
+
+impl Source for Gitlab {
+    fn collect(&self, ctx: &Context, _root: &Path, r: &Repository) -> Result<Collected, GglError> {
+        collect::collect_remote(ctx, r, forge::collect_gitlab)
+    }
+}
+
+impl Source for Gitea {
+    fn collect(&self, ctx: &Context, _root: &Path, r: &Repository) -> Result<Collected, GglError> {
+        collect::collect_remote(ctx, r, forge::collect_gitea)
+    }
+}
+
+/// The source for a kind of repository.
+pub fn source(kind: &RepositoryType) -> &'static dyn Source {
+    match kind {
+        RepositoryType::Local => &collect::Local,
+        RepositoryType::Github => &Github,
+        RepositoryType::Gitlab => &Gitlab,
+        RepositoryType::Gitea => &Gitea,
+    }
+}
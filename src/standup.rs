@@ -0,0 +1,83 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl standup`: what did I do since the previous work day?
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::error::GglError;
+use std::io;
+use std::io::Write;
+
+/// The start of the previous work day in local time, in seconds since the
+/// epoch.  On Mondays (and weekends), that's Friday.
+pub fn previous_work_day() -> Result<i64, GglError> {
+    let now = time::OffsetDateTime::now_local()
+        .map_err(|e| GglError::IoError(format!("can't determine the local time: {}", e)))?;
+
+    let mut day = now.date().previous_day().unwrap();
+    while matches!(
+        day.weekday(),
+        time::Weekday::Saturday | time::Weekday::Sunday
+    ) {
+        day = day.previous_day().unwrap();
+    }
+
+    Ok(day
+        .with_hms(0, 0, 0)
+        .unwrap()
+        .assume_offset(now.offset())
+        .unix_timestamp())
+}
+
+/// The email address from the user's git config.
+pub fn default_email() -> Result<String, GglError> {
+    Ok(git2::Config::open_default()?.get_string("user.email")?)
+}
+
+/// Write the commits authored or co-authored by `email`, grouped by
+/// repository.
+pub fn write(w: &mut dyn Write, timeline: &Timeline, email: &str) -> io::Result<()> {
+    let commits: Vec<&GlobalCommit> = timeline
+        .commits()
+        .filter(|c| {
+            c.authors()
+                .iter()
+                .any(|(_, e)| e.eq_ignore_ascii_case(email))
+        })
+        .collect();
+
+    if commits.is_empty() {
+        return writeln!(w, "No commits by {} since the previous work day", email);
+    }
+
+    let mut repo_names: Vec<&str> = vec![];
+    for commit in &commits {
+        if !repo_names.contains(&commit.repo_name.as_str()) {
+            repo_names.push(&commit.repo_name);
+        }
+    }
+
+    for repo_name in repo_names {
+        writeln!(w, "{}", repo_name)?;
+        for commit in commits.iter().filter(|c| c.repo_name == repo_name) {
+            let subject = commit.message.lines().next().unwrap_or("");
+            writeln!(w, "    {} {}", commit.short(), subject)?;
+        }
+        writeln!(w)?;
+    }
+
+    Ok(())
+}
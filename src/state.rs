@@ -0,0 +1,60 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! State that has to survive between runs, like what --new-only has shown.
+
+use crate::cache;
+use crate::error::GglError;
+use std::collections::HashMap;
+use std::fs;
+use std::path::PathBuf;
+
+// Unlike the cache, the state is not something we can rebuild, so it lives in
+// the data directory.
+fn state_dir() -> Result<PathBuf, GglError> {
+    match dirs::data_dir() {
+        Some(path) => Ok(path.join("ggl")),
+        None => Err(GglError::CacheError(
+            "can't find a data directory".to_string(),
+        )),
+    }
+}
+
+fn seen_path() -> Result<PathBuf, GglError> {
+    Ok(state_dir()?.join("seen.json"))
+}
+
+/// The commit each repository was at when we last ran with --new-only.
+pub fn read_seen() -> HashMap<String, String> {
+    seen_path()
+        .ok()
+        .and_then(|path| fs::read(path).ok())
+        .and_then(|contents| serde_json::from_slice(&contents).ok())
+        .unwrap_or_default()
+}
+
+/// Record the given heads, keeping what we know about other repositories.
+pub fn write_seen(heads: &HashMap<String, String>) -> Result<(), GglError> {
+    // Or another ggl could write what it saw between our read and write
+    let (_lock, _) = cache::lock("seen")?;
+    let mut seen = read_seen();
+    seen.extend(heads.iter().map(|(k, v)| (k.clone(), v.clone())));
+
+    let path = seen_path()?;
+    fs::create_dir_all(state_dir()?)?;
+
+    cache::write_atomically(&path, &serde_json::to_vec(&seen)?)
+}
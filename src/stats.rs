@@ -0,0 +1,314 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl stats`: summary numbers about the commits in the window.
+
+use crate::collect::Timeline;
+use crate::output::short_relative_time;
+use serde::Serialize;
+use std::collections::HashMap;
+use std::io;
+use std::io::Write;
+
+/// The number of commits attributed to a repository, author, team, or day.
+#[derive(Debug, Serialize)]
+pub struct Count {
+    pub name: String,
+    pub commits: usize,
+}
+
+#[derive(Debug, Serialize)]
+pub struct Stats {
+    pub commits: usize,
+    pub days: i64,
+    pub average_per_day: f64,
+    pub busiest_day: Option<Count>,
+    /// The first day of `per_day`, e.g. 2024-03-01.
+    pub first_day: Option<String>,
+    /// The number of commits on every day from `first_day` up to today.
+    pub per_day: Vec<usize>,
+    pub repositories: Vec<Count>,
+    pub authors: Vec<Count>,
+    /// Only for the commits whose author has a team in the config.
+    #[serde(skip_serializing_if = "Vec::is_empty")]
+    pub teams: Vec<Count>,
+}
+
+/// How a repository has been doing in the window, for `ggl summary`.
+#[derive(Debug, Serialize)]
+pub struct Repository {
+    pub name: String,
+    pub commits: usize,
+    /// None when there are no commits in the window.
+    pub last_commit: Option<time::OffsetDateTime>,
+    pub top_author: Option<String>,
+}
+
+// Most commits first, and alphabetically for the same number of commits.
+fn sorted_counts(counts: HashMap<String, usize>) -> Vec<Count> {
+    let mut counts: Vec<Count> = counts
+        .into_iter()
+        .map(|(name, commits)| Count { name, commits })
+        .collect();
+    counts.sort_by(|a, b| b.commits.cmp(&a.commits).then(a.name.cmp(&b.name)));
+    counts
+}
+
+/// Compute the stats for a timeline that goes back to `until` (seconds since
+/// the epoch).
+pub fn compute(timeline: &Timeline, until: i64) -> Stats {
+    let mut repositories: HashMap<String, usize> = HashMap::new();
+    let mut authors: HashMap<String, usize> = HashMap::new();
+    let mut teams: HashMap<String, usize> = HashMap::new();
+    let mut days: HashMap<String, usize> = HashMap::new();
+    let mut dates: HashMap<time::Date, usize> = HashMap::new();
+    let mut commits = 0;
+
+    for commit in timeline.commits() {
+        commits += 1;
+        *repositories.entry(commit.repo_name.clone()).or_default() += 1;
+        // Pair-programmed work counts for everyone
+        for (name, _) in commit.authors() {
+            *authors.entry(name.to_string()).or_default() += 1;
+        }
+        if let Some(team) = &commit.team {
+            *teams.entry(team.clone()).or_default() += 1;
+        }
+        *days.entry(commit.date.date().to_string()).or_default() += 1;
+        *dates.entry(commit.date.date()).or_default() += 1;
+    }
+
+    let now = time::OffsetDateTime::now_utc().unix_timestamp();
+    let window_days = ((now - until + 86399) / 86400).max(1);
+    let (first_day, per_day) = series(&dates, until);
+
+    Stats {
+        commits,
+        days: window_days,
+        average_per_day: commits as f64 / window_days as f64,
+        busiest_day: sorted_counts(days).into_iter().next(),
+        first_day: first_day.map(|day| day.to_string()),
+        per_day,
+        repositories: sorted_counts(repositories),
+        authors: sorted_counts(authors),
+        teams: sorted_counts(teams),
+    }
+}
+
+// The number of commits on every day, from the day of `until` or of the
+// first commit, whichever is later, so that --max-count without --until
+// doesn't go back to 1970, up to today.
+fn series(dates: &HashMap<time::Date, usize>, until: i64) -> (Option<time::Date>, Vec<usize>) {
+    let first = match dates.keys().min() {
+        Some(first) => *first,
+        None => return (None, vec![]),
+    };
+    let first = match time::OffsetDateTime::from_unix_timestamp(until) {
+        Ok(until) if until.date() > first => until.date(),
+        _ => first,
+    };
+    let last = time::OffsetDateTime::now_utc()
+        .date()
+        .max(*dates.keys().max().unwrap());
+
+    let mut per_day = vec![0; (last - first).whole_days() as usize + 1];
+    for (date, commits) in dates {
+        if *date >= first {
+            per_day[(*date - first).whole_days() as usize] += commits;
+        }
+    }
+    (Some(first), per_day)
+}
+
+static BARS: [char; 8] = ['▁', '▂', '▃', '▄', '▅', '▆', '▇', '█'];
+
+/// Draw `values` as a sparkline, one bar per value, or per a couple of them
+/// summed up so that it fits into `width` characters.  Returns the line and
+/// how many values every bar stands for.
+pub fn sparkline(values: &[usize], width: usize) -> (String, usize) {
+    let per_bar = values.len().div_ceil(width.max(1)).max(1);
+    let sums: Vec<usize> = values.chunks(per_bar).map(|c| c.iter().sum()).collect();
+    let max = sums.iter().copied().max().unwrap_or(0);
+
+    let line = sums
+        .iter()
+        .map(|&sum| {
+            if sum == 0 {
+                ' '
+            } else {
+                BARS[((sum * BARS.len()).div_ceil(max) - 1).min(BARS.len() - 1)]
+            }
+        })
+        .collect();
+    (line, per_bar)
+}
+
+/// Summarize every repository in `names`, in that order, and then the ones
+/// in the timeline that aren't in it, like submodules.
+pub fn per_repository(timeline: &Timeline, names: &[String]) -> Vec<Repository> {
+    let mut names = names.to_vec();
+    let mut commits: HashMap<&str, usize> = HashMap::new();
+    let mut authors: HashMap<&str, HashMap<String, usize>> = HashMap::new();
+    let mut last: HashMap<&str, time::OffsetDateTime> = HashMap::new();
+
+    for commit in timeline.commits() {
+        if !names.contains(&commit.repo_name) {
+            names.push(commit.repo_name.clone());
+        }
+        *commits.entry(&commit.repo_name).or_default() += 1;
+        let repo_authors = authors.entry(&commit.repo_name).or_default();
+        for (name, _) in commit.authors() {
+            *repo_authors.entry(name.to_string()).or_default() += 1;
+        }
+        let date = last.entry(&commit.repo_name).or_insert(commit.date);
+        if commit.date > *date {
+            *date = commit.date;
+        }
+    }
+
+    names
+        .into_iter()
+        .map(|name| {
+            let counts = sorted_counts(authors.remove(name.as_str()).unwrap_or_default());
+            Repository {
+                commits: commits.get(name.as_str()).copied().unwrap_or(0),
+                last_commit: last.get(name.as_str()).copied(),
+                top_author: counts.into_iter().next().map(|c| c.name),
+                name,
+            }
+        })
+        .collect()
+}
+
+/// Write one line for every repository, with how long ago its last commit
+/// was, or the date with `absolute`.
+pub fn write_repositories(
+    w: &mut dyn Write,
+    repositories: &[Repository],
+    absolute: bool,
+) -> io::Result<()> {
+    let format = time::macros::format_description!("[year]-[month]-[day] [hour]:[minute]");
+    let now = time::OffsetDateTime::now_utc();
+    let width = repositories
+        .iter()
+        .map(|r| r.name.chars().count())
+        .chain(Some("Repository".len()))
+        .max()
+        .unwrap_or(0);
+
+    writeln!(
+        w,
+        "{:<width$}  {:<16}  Commits  Top author",
+        "Repository",
+        "Last commit",
+        width = width
+    )?;
+    for r in repositories {
+        let last = match r.last_commit {
+            Some(d) if absolute => d.format(&format).unwrap_or_default(),
+            Some(d) => short_relative_time(&d, &now),
+            None => "-".to_string(),
+        };
+        writeln!(
+            w,
+            "{:<width$}  {:<16}  {:>7}  {}",
+            r.name,
+            last,
+            r.commits,
+            r.top_author.as_deref().unwrap_or("-"),
+            width = width
+        )?;
+    }
+    Ok(())
+}
+
+fn write_counts(w: &mut dyn Write, heading: &str, counts: &[Count]) -> io::Result<()> {
+    let width = counts
+        .iter()
+        .map(|c| c.name.chars().count())
+        .chain(Some(heading.len()))
+        .max()
+        .unwrap_or(0);
+
+    writeln!(w, "{:<width$}  Commits", heading, width = width)?;
+    for count in counts {
+        writeln!(
+            w,
+            "{:<width$}  {:>7}",
+            count.name,
+            count.commits,
+            width = width
+        )?;
+    }
+    writeln!(w)
+}
+
+/// Write the headline numbers for the end of the log: the number of commits
+/// and authors, and the commits in every repository.
+pub fn write_summary(w: &mut dyn Write, stats: &Stats) -> io::Result<()> {
+    writeln!(w)?;
+    writeln!(
+        w,
+        "{} commits by {} authors in {} repositories",
+        stats.commits,
+        stats.authors.len(),
+        stats.repositories.len()
+    )?;
+    let width = stats
+        .repositories
+        .iter()
+        .map(|c| c.name.chars().count())
+        .max()
+        .unwrap_or(0);
+    for count in &stats.repositories {
+        writeln!(
+            w,
+            "  {:<width$}  {:>7}",
+            count.name,
+            count.commits,
+            width = width
+        )?;
+    }
+    Ok(())
+}
+
+/// Write the stats as a couple of human readable tables.
+pub fn write_table(w: &mut dyn Write, stats: &Stats) -> io::Result<()> {
+    writeln!(
+        w,
+        "Commits:      {} in {} days ({:.1} per day)",
+        stats.commits, stats.days, stats.average_per_day
+    )?;
+    if let Some(day) = &stats.busiest_day {
+        writeln!(w, "Busiest day:  {} ({} commits)", day.name, day.commits)?;
+    }
+    if let Some(first) = &stats.first_day {
+        let (line, per_bar) = sparkline(&stats.per_day, 60);
+        let label = match per_bar {
+            1 => "Per day:".to_string(),
+            n => format!("Per {} days:", n),
+        };
+        writeln!(w, "{:<14}{}  since {}", label, line, first)?;
+    }
+    writeln!(w)?;
+
+    write_counts(w, "Repository", &stats.repositories)?;
+    write_counts(w, "Author", &stats.authors)?;
+    if !stats.teams.is_empty() {
+        write_counts(w, "Team", &stats.teams)?;
+    }
+    Ok(())
+}
@@ -0,0 +1,104 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl sync`: keep a clone of every repository in the config, cloning the
+//! missing ones as mirrors from their `clone-url`.
+
+use crate::collect::{open_repository, remote_views, selected, CollectOptions};
+use crate::config::{Config, Repository, RepositoryType};
+use crate::error::GglError;
+use crate::info;
+use std::path::Path;
+use std::process::Command;
+
+fn git(r: &Repository) -> Command {
+    let mut cmd = Command::new("git");
+    if let Some(proxy) = &r.proxy {
+        cmd.arg("-c").arg(format!("http.proxy={}", proxy));
+    }
+    cmd
+}
+
+fn run(mut cmd: Command, what: &str) -> Result<(), GglError> {
+    // git shows its own progress on a terminal
+    let status = cmd.status()?;
+    if !status.success() {
+        return Err(GglError::GitError(format!("{} failed", what)));
+    }
+    Ok(())
+}
+
+// Clone a repository that isn't on disk yet as a mirror of its `clone-url`.
+fn clone(path: &Path, r: &Repository) -> Result<(), GglError> {
+    let url = r.clone_url.as_ref().ok_or_else(|| {
+        GglError::IoError(format!(
+            "{} isn't on disk, and has no clone-url to clone it from",
+            r.name
+        ))
+    })?;
+
+    info!("Cloning {} from {}", r.name, url);
+    let mut cmd = git(r);
+    cmd.args(["clone", "--mirror", "--origin", &r.remote])
+        .arg(url)
+        .arg(path);
+    run(cmd, &format!("cloning {}", r.name))
+}
+
+// Fetch every branch of every remote we walk, not only the ones we walk.
+fn update(path: &Path, r: &Repository) -> Result<(), GglError> {
+    let repo = open_repository(path)?;
+    let mut remotes: Vec<String> = remote_views(r).into_iter().map(|v| v.remote).collect();
+    remotes.dedup();
+
+    for remote in remotes {
+        info!("Fetching {} {}", r.name, remote);
+        let mut cmd = git(r);
+        cmd.arg("--git-dir")
+            .arg(repo.path())
+            .args(["fetch", "--prune", &remote]);
+        run(cmd, &format!("fetching {} {}", r.name, remote))?;
+    }
+    Ok(())
+}
+
+/// Clone the local repositories of the config that aren't on disk, and fetch
+/// everything in the ones that are.  A repository that fails doesn't stop the
+/// others; the last error is returned at the end.
+pub fn sync(config: &Config, opts: &CollectOptions) -> Result<(), GglError> {
+    let mut result = Ok(());
+
+    for block in &config.blocks {
+        for r in block
+            .repositories
+            .iter()
+            .filter(|r| r.kind == RepositoryType::Local && selected(r, opts))
+        {
+            let path = Path::new(&block.root).join(&r.path);
+            let synced = if path.exists() {
+                update(&path, r)
+            } else {
+                clone(&path, r)
+            };
+            if let Err(e) = synced {
+                eprintln!("error: {}: {}", r.name, e);
+                result = Err(e);
+            }
+        }
+    }
+
+    result
+}
@@ -0,0 +1,376 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Reports rendered through a template of the user's, see `--template`.
+//!
+//! The syntax is a small subset of Mustache:
+//!
+//! - `{{name}}` is replaced with a value, and `{{name "argument"}}` passes it
+//!   an argument, e.g. a date format: `{{date "[year]-[month]-[day]"}}`
+//! - `{{#commits}}...{{/commits}}` repeats its body for every commit
+//! - `{{#group repo}}...{{/group}}` repeats its body for every repository,
+//!   author, team, day, week or month
+//! - `{{#if name}}...{{/if}}` only renders its body when the value isn't empty
+//! - `{{! ...}}` is a comment
+//!
+//! A line with nothing but a section tag or a comment on it disappears
+//! entirely, so that templates can put them on lines of their own.
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::error::GglError;
+use crate::output::format_time;
+use std::fs;
+use std::path::Path;
+
+#[derive(Debug)]
+enum Node {
+    Text(String),
+    Value {
+        name: String,
+        argument: Option<String>,
+    },
+    Section {
+        name: String,
+        argument: Option<String>,
+        body: Vec<Node>,
+    },
+}
+
+/// A parsed template.
+#[derive(Debug)]
+pub struct Template {
+    nodes: Vec<Node>,
+}
+
+/// What `{{#group}}` can group the commits by.
+const GROUPS: [&str; 6] = ["repo", "author", "team", "day", "week", "month"];
+
+impl Template {
+    /// Read and parse the template at `path`.
+    pub fn load(path: &Path) -> Result<Template, GglError> {
+        let source = fs::read_to_string(path).map_err(|e| {
+            GglError::IoError(format!("can't read the template {}: {}", path.display(), e))
+        })?;
+        source.parse()
+    }
+
+    /// Render the commits of the timeline.
+    pub fn render(&self, timeline: &Timeline) -> Result<String, GglError> {
+        let scope = Scope {
+            commits: timeline.commits().collect(),
+            key: None,
+            commit: None,
+        };
+        let mut out = String::new();
+        render(&self.nodes, &scope, &mut out)?;
+        Ok(out)
+    }
+}
+
+impl std::str::FromStr for Template {
+    type Err = GglError;
+
+    fn from_str(source: &str) -> Result<Self, Self::Err> {
+        let mut stack: Vec<(String, Option<String>, Vec<Node>)> = vec![];
+        let mut nodes: Vec<Node> = vec![];
+        let mut text = String::new();
+        let mut rest = source;
+        // Whether `text` starts at the beginning of a line
+        let mut line_start = true;
+
+        while let Some(start) = rest.find("{{") {
+            let end = rest[start..]
+                .find("}}")
+                .map(|end| start + end)
+                .ok_or_else(|| GglError::TemplateError("a {{ isn't closed".to_string()))?;
+            text.push_str(&rest[..start]);
+            let tag = rest[start + 2..end].trim();
+            rest = &rest[end + 2..];
+
+            let standalone = tag.starts_with(['#', '/', '!']);
+            let before = rest.len();
+            if standalone {
+                rest = strip_line(&mut text, rest, line_start);
+            }
+            line_start = rest.len() < before;
+            if !text.is_empty() {
+                nodes.push(Node::Text(std::mem::take(&mut text)));
+            }
+
+            if tag.starts_with('!') {
+                continue;
+            } else if let Some(open) = tag.strip_prefix('#') {
+                let (name, argument) = split_tag(open)?;
+                stack.push((name, argument, std::mem::take(&mut nodes)));
+            } else if let Some(close) = tag.strip_prefix('/') {
+                let (name, argument, outer) = stack.pop().ok_or_else(|| {
+                    GglError::TemplateError(format!("{{{{/{}}}}} closes nothing", close))
+                })?;
+                if name != close.trim() {
+                    return Err(GglError::TemplateError(format!(
+                        "{{{{#{}}}}} is closed by {{{{/{}}}}}",
+                        name, close
+                    )));
+                }
+                let body = std::mem::replace(&mut nodes, outer);
+                nodes.push(Node::Section {
+                    name,
+                    argument,
+                    body,
+                });
+            } else {
+                let (name, argument) = split_tag(tag)?;
+                nodes.push(Node::Value { name, argument });
+            }
+        }
+
+        text.push_str(rest);
+        if !text.is_empty() {
+            nodes.push(Node::Text(text));
+        }
+        if let Some((name, _, _)) = stack.pop() {
+            return Err(GglError::TemplateError(format!(
+                "{{{{#{}}}}} isn't closed",
+                name
+            )));
+        }
+
+        Ok(Template { nodes })
+    }
+}
+
+// When a tag is alone on its line, drop the indentation before it from
+// `text` and the line break after it from `rest`, and return what's left of
+// `rest`.  `line_start` is whether `text` starts at the beginning of a line.
+fn strip_line<'a>(text: &mut String, rest: &'a str, line_start: bool) -> &'a str {
+    let indent = match text.rfind('\n') {
+        Some(i) => i + 1,
+        None if line_start => 0,
+        None => return rest,
+    };
+    if !text[indent..].trim().is_empty() {
+        return rest;
+    }
+    let line_end = rest.find('\n').map_or(rest.len(), |i| i + 1);
+    if !rest[..line_end].trim().is_empty() {
+        return rest;
+    }
+    text.truncate(indent);
+    &rest[line_end..]
+}
+
+// Split `name "argument"` or `name argument` into its parts.
+fn split_tag(tag: &str) -> Result<(String, Option<String>), GglError> {
+    let tag = tag.trim();
+    let (name, argument) = match tag.split_once(char::is_whitespace) {
+        Some((name, argument)) => (name, Some(argument.trim())),
+        None => (tag, None),
+    };
+    if name.is_empty() {
+        return Err(GglError::TemplateError("empty {{}}".to_string()));
+    }
+    let argument = argument.map(|a| {
+        a.strip_prefix('"')
+            .and_then(|a| a.strip_suffix('"'))
+            .unwrap_or(a)
+            .to_string()
+    });
+    Ok((name.to_string(), argument))
+}
+
+// The commits a part of the template is about: all of them at first, then
+// the ones in a group, then a single one.
+struct Scope<'a> {
+    commits: Vec<&'a GlobalCommit>,
+    key: Option<String>,
+    commit: Option<&'a GlobalCommit>,
+}
+
+fn render(nodes: &[Node], scope: &Scope, out: &mut String) -> Result<(), GglError> {
+    for node in nodes {
+        match node {
+            Node::Text(text) => out.push_str(text),
+            Node::Value { name, argument } => {
+                out.push_str(&value(scope, name, argument.as_deref())?);
+            }
+            Node::Section {
+                name,
+                argument,
+                body,
+            } => match name.as_str() {
+                "commits" => {
+                    for commit in &scope.commits {
+                        let inner = Scope {
+                            commits: vec![*commit],
+                            key: scope.key.clone(),
+                            commit: Some(*commit),
+                        };
+                        render(body, &inner, out)?;
+                    }
+                }
+                "group" => {
+                    let by = argument.as_deref().unwrap_or("");
+                    if !GROUPS.contains(&by) {
+                        return Err(GglError::TemplateError(format!(
+                            "can't group by {:?}, only by {}",
+                            by,
+                            GROUPS.join(", ")
+                        )));
+                    }
+                    for (key, commits) in group(&scope.commits, by) {
+                        let inner = Scope {
+                            commits,
+                            key: Some(key),
+                            commit: None,
+                        };
+                        render(body, &inner, out)?;
+                    }
+                }
+                "if" => {
+                    let name = argument.as_deref().ok_or_else(|| {
+                        GglError::TemplateError("{{#if}} needs a name".to_string())
+                    })?;
+                    if !value(scope, name, None)?.is_empty() {
+                        render(body, scope, out)?;
+                    }
+                }
+                _ => {
+                    return Err(GglError::TemplateError(format!(
+                        "unknown section {{{{#{}}}}}",
+                        name
+                    )))
+                }
+            },
+        }
+    }
+    Ok(())
+}
+
+// Group the commits in the order the groups first appear.  Commits without a
+// team are left out of the teams.
+fn group<'a>(commits: &[&'a GlobalCommit], by: &str) -> Vec<(String, Vec<&'a GlobalCommit>)> {
+    let mut groups: Vec<(String, Vec<&GlobalCommit>)> = vec![];
+    for commit in commits {
+        let key = match by {
+            "repo" => commit.repo_name.clone(),
+            "author" => commit.author.clone(),
+            "team" => match &commit.team {
+                Some(team) => team.clone(),
+                None => continue,
+            },
+            "day" => format_date(&commit.date, "[year]-[month]-[day]"),
+            "week" => format_date(
+                &commit.date,
+                "[year repr:full base:iso_week]-W[week_number]",
+            ),
+            _ => format_date(&commit.date, "[year]-[month]"),
+        };
+        match groups.iter_mut().find(|(k, _)| *k == key) {
+            Some((_, group)) => group.push(commit),
+            None => groups.push((key, vec![commit])),
+        }
+    }
+    groups
+}
+
+fn format_date(t: &time::OffsetDateTime, format: &str) -> String {
+    time::format_description::parse(format)
+        .ok()
+        .and_then(|f| t.format(&f).ok())
+        .unwrap_or_default()
+}
+
+// A date in the format the template asks for, or like `git log` without one.
+fn date(t: &time::OffsetDateTime, format: Option<&str>) -> Result<String, GglError> {
+    let format = match format {
+        Some(format) => format,
+        None => return Ok(format_time(t)),
+    };
+    let description = time::format_description::parse(format)
+        .map_err(|e| GglError::TemplateError(format!("bad date format {:?}: {}", format, e)))?;
+    t.format(&description)
+        .map_err(|e| GglError::TemplateError(format!("bad date format {:?}: {}", format, e)))
+}
+
+fn value(scope: &Scope, name: &str, argument: Option<&str>) -> Result<String, GglError> {
+    let distinct = |f: fn(&GlobalCommit) -> &str| {
+        let mut values: Vec<&str> = scope.commits.iter().map(|c| f(c)).collect();
+        values.sort();
+        values.dedup();
+        values.len().to_string()
+    };
+
+    match name {
+        "count" => return Ok(scope.commits.len().to_string()),
+        "authors" => return Ok(distinct(|c| &c.author)),
+        "repositories" => return Ok(distinct(|c| &c.repo_name)),
+        "key" => return Ok(scope.key.clone().unwrap_or_default()),
+        "now" => {
+            let now = time::OffsetDateTime::now_local()
+                .unwrap_or_else(|_| time::OffsetDateTime::now_utc());
+            return date(&now, argument);
+        }
+        // The commits are in the order of the log, which is newest first
+        // unless it's reversed
+        "first" | "last" => {
+            let dates = scope.commits.iter().map(|c| c.date);
+            return match if name == "first" {
+                dates.min()
+            } else {
+                dates.max()
+            } {
+                Some(t) => date(&t, argument),
+                None => Ok(String::new()),
+            };
+        }
+        _ => {}
+    }
+
+    let commit = scope.commit.ok_or_else(|| {
+        GglError::TemplateError(format!(
+            "{{{{{}}}}} is only known inside {{{{#commits}}}}",
+            name
+        ))
+    })?;
+    let subject = commit.message.lines().next().unwrap_or("");
+
+    Ok(match name {
+        "repo" => commit.repo_name.clone(),
+        "sha" => commit.sha.clone(),
+        "short" => commit.short().to_string(),
+        "author" => commit.author.clone(),
+        "email" => commit.email.clone(),
+        "date" => date(&commit.date, argument)?,
+        "committer" => commit.committer.clone(),
+        "committer_email" => commit.committer_email.clone(),
+        "committer_date" => date(&commit.committer_date, argument)?,
+        "subject" => subject.to_string(),
+        "body" => commit.message[subject.len()..].trim().to_string(),
+        "message" => commit.message.trim_end().to_string(),
+        "url" => commit.url.clone().unwrap_or_default(),
+        "team" => commit.team.clone().unwrap_or_default(),
+        "tickets" => commit.tickets.join(", "),
+        "branches" => commit.branches.join(", "),
+        "refs" => commit.refs.join(", "),
+        "notes" => commit.notes.clone().unwrap_or_default(),
+        _ => {
+            return Err(GglError::TemplateError(format!(
+                "unknown name {{{{{}}}}}",
+                name
+            )))
+        }
+    })
+}
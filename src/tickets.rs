@@ -0,0 +1,105 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Ticket IDs mentioned in commit messages, and `--group-by ticket`.
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::error::GglError;
+use crate::pattern::Pattern;
+use serde::Serialize;
+use std::io;
+use std::io::Write;
+
+/// Compile the `tickets` patterns from the config.
+pub fn patterns(sources: &[String]) -> Result<Vec<Pattern>, GglError> {
+    sources
+        .iter()
+        .map(|source| source.parse())
+        .collect::<Result<_, _>>()
+        .map_err(GglError::ConfigParserError)
+}
+
+/// Fill in the `tickets` of every commit: what `patterns` match in its
+/// message, each ticket once.
+pub fn annotate(timeline: &mut Timeline, patterns: &[Pattern]) {
+    if patterns.is_empty() {
+        return;
+    }
+
+    for entry in timeline.entries.iter_mut() {
+        for commit in entry.commits_mut() {
+            let mut tickets: Vec<String> = vec![];
+            for ticket in patterns.iter().flat_map(|p| p.find_all(&commit.message)) {
+                if !tickets.contains(&ticket) {
+                    tickets.push(ticket);
+                }
+            }
+            commit.tickets = tickets;
+        }
+    }
+}
+
+/// The commits that mention a ticket.
+#[derive(Debug, Serialize)]
+pub struct Group<'a> {
+    pub ticket: String,
+    pub commits: Vec<&'a GlobalCommit>,
+}
+
+/// Group the commits by the tickets they mention, in the order the tickets
+/// first appear in the timeline.  A commit that mentions several tickets is
+/// in each of their groups, and one that mentions none in none.
+pub fn group(timeline: &Timeline) -> Vec<Group<'_>> {
+    let mut groups: Vec<Group> = vec![];
+
+    for commit in timeline.commits() {
+        for ticket in &commit.tickets {
+            match groups.iter_mut().find(|g| &g.ticket == ticket) {
+                Some(group) => group.commits.push(commit),
+                None => groups.push(Group {
+                    ticket: ticket.clone(),
+                    commits: vec![commit],
+                }),
+            }
+        }
+    }
+
+    groups
+}
+
+/// Write the commits grouped by ticket, one line per commit.
+pub fn write(w: &mut dyn Write, groups: &[Group]) -> io::Result<()> {
+    if groups.is_empty() {
+        return writeln!(w, "No commits mention a ticket");
+    }
+
+    for group in groups {
+        writeln!(w, "{}", group.ticket)?;
+        for commit in &group.commits {
+            let subject = commit.message.lines().next().unwrap_or("");
+            writeln!(
+                w,
+                "    {} {:<12} {}",
+                commit.short(),
+                commit.repo_name,
+                subject
+            )?;
+        }
+        writeln!(w)?;
+    }
+
+    Ok(())
+}
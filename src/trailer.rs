@@ -0,0 +1,84 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! Trailers at the end of commit messages, like `Signed-off-by: ...`.
+
+use serde::{Deserialize, Serialize};
+
+/// A `Key: value` line in the last paragraph of a commit message.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Trailer {
+    pub key: String,
+    pub value: String,
+}
+
+/// The trailers of a commit message: its last paragraph, when every line of
+/// it is a trailer.  A line starting with whitespace continues the one
+/// before.
+pub fn parse(message: &str) -> Vec<Trailer> {
+    let message = message.trim_end();
+    let paragraph = match message.rfind("\n\n") {
+        Some(i) => &message[i + 2..],
+        // The subject alone is never a trailer
+        None => return vec![],
+    };
+
+    let mut trailers: Vec<Trailer> = vec![];
+    for line in paragraph.lines() {
+        if line.starts_with(' ') || line.starts_with('\t') {
+            match trailers.last_mut() {
+                Some(trailer) => {
+                    trailer.value.push(' ');
+                    trailer.value.push_str(line.trim());
+                    continue;
+                }
+                None => return vec![],
+            }
+        }
+
+        let (key, value) = match line.split_once(':') {
+            Some((key, value)) if is_key(key) => (key, value),
+            _ => return vec![],
+        };
+        trailers.push(Trailer {
+            key: key.to_string(),
+            value: value.trim().to_string(),
+        });
+    }
+
+    trailers
+}
+
+fn is_key(key: &str) -> bool {
+    !key.is_empty() && key.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+}
+
+/// Whether one of the trailers matches `filter`.  `Key=value` matches a
+/// trailer with that key whose value contains `value`, and `Key` alone any
+/// trailer with that key, both ignoring case.
+pub fn matches(trailers: &[Trailer], filter: &str) -> bool {
+    let (key, value) = match filter.split_once('=') {
+        Some((key, value)) => (key, Some(value.to_lowercase())),
+        None => (filter, None),
+    };
+
+    trailers.iter().any(|trailer| {
+        trailer.key.eq_ignore_ascii_case(key)
+            && value
+                .as_ref()
+                .map_or(true, |v| trailer.value.to_lowercase().contains(v))
+    })
+}
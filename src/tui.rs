@@ -0,0 +1,486 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! `ggl tui`: an interactive terminal browser for the log, and the repository
+//! picker of `--interactive`.
+
+use crate::collect::{GlobalCommit, Timeline};
+use crate::config::{Config, RepositoryType};
+use crate::error::GglError;
+use crate::files;
+use crate::output::format_time;
+use std::collections::HashMap;
+use std::io;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+
+// Puts the terminal into non-canonical mode on the alternate screen, and
+// restores it when dropped.  Ctrl-C is read as a key rather than sent as
+// SIGINT, so that it can quit without leaving the terminal like this.
+struct Terminal {
+    original: libc::termios,
+}
+
+impl Terminal {
+    fn enable() -> io::Result<Terminal> {
+        let original = unsafe {
+            let mut termios: libc::termios = std::mem::zeroed();
+            if libc::tcgetattr(libc::STDIN_FILENO, &mut termios) != 0 {
+                return Err(io::Error::last_os_error());
+            }
+            termios
+        };
+
+        let mut raw = original;
+        raw.c_lflag &= !(libc::ICANON | libc::ECHO | libc::ISIG);
+        raw.c_cc[libc::VMIN] = 1;
+        raw.c_cc[libc::VTIME] = 0;
+
+        if unsafe { libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &raw) } != 0 {
+            return Err(io::Error::last_os_error());
+        }
+
+        // Alternate screen, hide the cursor
+        print!("\x1b[?1049h\x1b[?25l");
+        io::stdout().flush()?;
+
+        Ok(Terminal { original })
+    }
+
+    fn size(&self) -> (usize, usize) {
+        let mut ws: libc::winsize = unsafe { std::mem::zeroed() };
+        let ok = unsafe { libc::ioctl(libc::STDOUT_FILENO, libc::TIOCGWINSZ, &mut ws) } == 0;
+        if ok && ws.ws_row > 0 && ws.ws_col > 0 {
+            (ws.ws_row as usize, ws.ws_col as usize)
+        } else {
+            (24, 80)
+        }
+    }
+}
+
+impl Drop for Terminal {
+    fn drop(&mut self) {
+        print!("\x1b[?25h\x1b[?1049l");
+        let _ = io::stdout().flush();
+        unsafe {
+            libc::tcsetattr(libc::STDIN_FILENO, libc::TCSANOW, &self.original);
+        }
+    }
+}
+
+enum Key {
+    Up,
+    Down,
+    PageUp,
+    PageDown,
+    Home,
+    End,
+    Escape,
+    Char(char),
+    Unknown,
+}
+
+// How long to wait for the rest of an escape sequence before taking the Esc
+// for the Esc key, in milliseconds.
+const ESCAPE_TIMEOUT: i32 = 50;
+
+// Read a byte from stdin, or None if none comes within `timeout` milliseconds;
+// -1 waits for as long as it takes.  This reads the file descriptor itself,
+// as the buffer of io::Stdin would hide the rest of a sequence from poll(2).
+fn read_byte(timeout: i32) -> io::Result<Option<u8>> {
+    let mut fd = libc::pollfd {
+        fd: libc::STDIN_FILENO,
+        events: libc::POLLIN,
+        revents: 0,
+    };
+    let mut byte = 0u8;
+
+    loop {
+        let read = match unsafe { libc::poll(&mut fd, 1, timeout) } {
+            0 => return Ok(None),
+            -1 => -1,
+            _ => unsafe { libc::read(libc::STDIN_FILENO, &mut byte as *mut u8 as *mut _, 1) },
+        };
+        match read {
+            1 => return Ok(Some(byte)),
+            0 => return Err(io::ErrorKind::UnexpectedEof.into()),
+            _ => {
+                let e = io::Error::last_os_error();
+                // E.g. SIGWINCH, when the terminal is resized
+                if e.kind() != io::ErrorKind::Interrupted {
+                    return Err(e);
+                }
+            }
+        }
+    }
+}
+
+fn read_key() -> io::Result<Key> {
+    let byte = match read_byte(-1)? {
+        Some(byte) => byte,
+        None => return Ok(Key::Unknown),
+    };
+    if byte != 0x1b {
+        return Ok(Key::Char(byte as char));
+    }
+
+    match read_byte(ESCAPE_TIMEOUT)? {
+        None => return Ok(Key::Escape),
+        Some(b'[') => {}
+        Some(_) => return Ok(Key::Unknown),
+    }
+
+    let key = match read_byte(ESCAPE_TIMEOUT)? {
+        Some(b'A') => Key::Up,
+        Some(b'B') => Key::Down,
+        Some(b'H') => Key::Home,
+        Some(b'F') => Key::End,
+        Some(code @ (b'5' | b'6')) => {
+            // Page up and down are followed by a ~
+            read_byte(ESCAPE_TIMEOUT)?;
+            if code == b'5' {
+                Key::PageUp
+            } else {
+                Key::PageDown
+            }
+        }
+        _ => Key::Unknown,
+    };
+
+    Ok(key)
+}
+
+// Cut a line so that it fits into `width` columns.
+fn fit(line: &str, width: usize) -> String {
+    line.replace('\t', "    ").chars().take(width).collect()
+}
+
+// Return the value that follows `current` in `values`, wrapping around to
+// None at the end.
+fn cycle(values: &[String], current: &Option<String>) -> Option<String> {
+    let next = match current {
+        None => 0,
+        Some(c) => match values.iter().position(|v| v == c) {
+            Some(i) => i + 1,
+            None => 0,
+        },
+    };
+    values.get(next).cloned()
+}
+
+struct Browser<'a> {
+    commits: Vec<&'a GlobalCommit>,
+    visible: Vec<&'a GlobalCommit>,
+    repos: Vec<String>,
+    authors: Vec<String>,
+    repo_filter: Option<String>,
+    author_filter: Option<String>,
+    repo_paths: HashMap<String, PathBuf>,
+    selected: usize,
+    offset: usize,
+    detail_scroll: usize,
+    diff: Option<(String, Vec<String>)>,
+}
+
+impl<'a> Browser<'a> {
+    fn new(config: &Config, timeline: &'a Timeline) -> Browser<'a> {
+        let commits: Vec<&GlobalCommit> = timeline.commits().collect();
+
+        let mut repos: Vec<String> = commits.iter().map(|c| c.repo_name.clone()).collect();
+        repos.sort();
+        repos.dedup();
+
+        let mut authors: Vec<String> = commits.iter().map(|c| c.author.clone()).collect();
+        authors.sort();
+        authors.dedup();
+
+        let mut repo_paths = HashMap::new();
+        for block in &config.blocks {
+            for r in block
+                .repositories
+                .iter()
+                .filter(|r| r.kind == RepositoryType::Local)
+            {
+                repo_paths.insert(r.name.clone(), Path::new(&block.root).join(&r.path));
+            }
+        }
+
+        let mut browser = Browser {
+            visible: vec![],
+            commits,
+            repos,
+            authors,
+            repo_filter: None,
+            author_filter: None,
+            repo_paths,
+            selected: 0,
+            offset: 0,
+            detail_scroll: 0,
+            diff: None,
+        };
+        browser.apply_filters();
+        browser
+    }
+
+    fn apply_filters(&mut self) {
+        let repo = &self.repo_filter;
+        let author = &self.author_filter;
+
+        self.visible = self
+            .commits
+            .iter()
+            .filter(|c| repo.as_ref().map_or(true, |r| &c.repo_name == r))
+            .filter(|c| author.as_ref().map_or(true, |a| &c.author == a))
+            .copied()
+            .collect();
+        self.selected = 0;
+        self.offset = 0;
+        self.detail_scroll = 0;
+    }
+
+    fn select(&mut self, index: usize) {
+        let last = self.visible.len().saturating_sub(1);
+        self.selected = index.min(last);
+        self.detail_scroll = 0;
+    }
+
+    fn detail(&mut self) -> Vec<String> {
+        let commit = match self.visible.get(self.selected) {
+            Some(c) => *c,
+            None => return vec!["No commits".to_string()],
+        };
+
+        let mut lines = vec![
+            format!("commit {}", commit.sha),
+            format!("Repo:   {}", commit.repo_name),
+            format!("Author: {}", commit.author),
+            format!("Date:   {}", format_time(&commit.date)),
+            String::new(),
+        ];
+        lines.extend(commit.message.lines().map(|l| format!("    {}", l)));
+        lines.push(String::new());
+
+        let cached = matches!(&self.diff, Some((sha, _)) if sha == &commit.sha);
+        if !cached {
+            let diff = match self.repo_paths.get(&commit.repo_name) {
+                Some(path) => files::patch(path, &commit.sha)
+                    .unwrap_or_else(|e| vec![format!("error: {}", e.message())]),
+                None => vec![],
+            };
+            self.diff = Some((commit.sha.clone(), diff));
+        }
+
+        if let Some((_, diff)) = &self.diff {
+            lines.extend(diff.iter().cloned());
+        }
+
+        lines
+    }
+
+    fn draw(&mut self, rows: usize, cols: usize) -> io::Result<()> {
+        let list_height = (rows / 2).max(3);
+        let detail_height = rows.saturating_sub(list_height + 1);
+
+        if self.selected < self.offset {
+            self.offset = self.selected;
+        } else if self.selected >= self.offset + list_height {
+            self.offset = self.selected + 1 - list_height;
+        }
+
+        let date_format = time::macros::format_description!("[year]-[month]-[day]");
+        let mut screen = String::from("\x1b[H\x1b[2J");
+
+        for i in self.offset..self.offset + list_height {
+            if let Some(commit) = self.visible.get(i) {
+                let line = format!(
+                    "{} {} {:<12} {}",
+                    commit.short(),
+                    commit.date.format(&date_format).unwrap(),
+                    commit.repo_name,
+                    commit.message.lines().next().unwrap_or("")
+                );
+                if i == self.selected {
+                    screen.push_str(&format!("\x1b[7m{}\x1b[0m", fit(&line, cols)));
+                } else {
+                    screen.push_str(&fit(&line, cols));
+                }
+            }
+            screen.push_str("\r\n");
+        }
+
+        let status = format!(
+            " {}/{}  repo: {}  author: {}  [j/k] move  [J/K] scroll  [r] repo  [a] author  [c] clear  [q] quit",
+            if self.visible.is_empty() { 0 } else { self.selected + 1 },
+            self.visible.len(),
+            self.repo_filter.as_deref().unwrap_or("all"),
+            self.author_filter.as_deref().unwrap_or("all"),
+        );
+        screen.push_str(&format!(
+            "\x1b[7m{:<width$}\x1b[0m\r\n",
+            fit(&status, cols),
+            width = cols
+        ));
+
+        let detail = self.detail();
+        self.detail_scroll = self.detail_scroll.min(detail.len().saturating_sub(1));
+        for line in detail.iter().skip(self.detail_scroll).take(detail_height) {
+            let line = fit(line, cols);
+            if line.starts_with('+') && !line.starts_with("+++") {
+                screen.push_str(&format!("\x1b[32m{}\x1b[0m", line));
+            } else if line.starts_with('-') && !line.starts_with("---") {
+                screen.push_str(&format!("\x1b[31m{}\x1b[0m", line));
+            } else {
+                screen.push_str(&line);
+            }
+            screen.push_str("\r\n");
+        }
+
+        let mut stdout = io::stdout();
+        stdout.write_all(screen.trim_end_matches("\r\n").as_bytes())?;
+        stdout.flush()
+    }
+}
+
+/// Show the log in an interactive terminal browser.
+pub fn browse(config: &Config, timeline: &Timeline) -> Result<(), GglError> {
+    let mut browser = Browser::new(config, timeline);
+    let terminal = Terminal::enable()?;
+
+    loop {
+        let (rows, cols) = terminal.size();
+        browser.draw(rows, cols)?;
+        let page = (rows / 2).max(3);
+
+        match read_key()? {
+            Key::Char('q') | Key::Char('\x03') | Key::Escape => break,
+            Key::Char('j') | Key::Down => browser.select(browser.selected + 1),
+            Key::Char('k') | Key::Up => browser.select(browser.selected.saturating_sub(1)),
+            Key::PageDown => browser.select(browser.selected + page),
+            Key::PageUp => browser.select(browser.selected.saturating_sub(page)),
+            Key::Char('g') | Key::Home => browser.select(0),
+            Key::Char('G') | Key::End => browser.select(usize::MAX),
+            Key::Char('J') => browser.detail_scroll += 1,
+            Key::Char('K') => browser.detail_scroll = browser.detail_scroll.saturating_sub(1),
+            Key::Char('r') => {
+                browser.repo_filter = cycle(&browser.repos, &browser.repo_filter);
+                browser.apply_filters();
+            }
+            Key::Char('a') => {
+                browser.author_filter = cycle(&browser.authors, &browser.author_filter);
+                browser.apply_filters();
+            }
+            Key::Char('c') => {
+                browser.repo_filter = None;
+                browser.author_filter = None;
+                browser.apply_filters();
+            }
+            _ => {}
+        }
+    }
+
+    Ok(())
+}
+
+/// Whether the characters of `query` appear in `name` in order, ignoring case,
+/// e.g. `ggl` in `honza/ggl-docs`.
+pub fn fuzzy_match(query: &str, name: &str) -> bool {
+    let mut name = name.chars().flat_map(char::to_lowercase);
+    query
+        .chars()
+        .flat_map(char::to_lowercase)
+        .all(|q| name.any(|c| c == q))
+}
+
+/// Let the user pick some of the repositories, starting with the ones in
+/// `selected`.  Typing narrows down the list, space selects, and enter is
+/// done; with nothing selected, enter picks the highlighted repository.
+/// Esc, Ctrl-C or Ctrl-D give up, and return nothing.
+pub fn pick(names: &[String], selected: &[String]) -> Result<Vec<String>, GglError> {
+    let mut picked: Vec<bool> = names.iter().map(|n| selected.contains(n)).collect();
+    let mut query = String::new();
+    let mut cursor = 0;
+    let terminal = Terminal::enable()?;
+
+    loop {
+        let (rows, cols) = terminal.size();
+        let matches: Vec<usize> = (0..names.len())
+            .filter(|&i| fuzzy_match(&query, &names[i]))
+            .collect();
+        cursor = cursor.min(matches.len().saturating_sub(1));
+
+        let height = rows.saturating_sub(2).max(1);
+        let offset = (cursor + 1).saturating_sub(height);
+        let mut screen = String::from("\x1b[H\x1b[2J");
+        let count = picked.iter().filter(|&&p| p).count();
+        screen.push_str(&fit(
+            &format!(
+                "> {}  ({} selected, [space] select, [enter] run)",
+                query, count
+            ),
+            cols,
+        ));
+        screen.push_str("\r\n");
+        for (row, &i) in matches.iter().enumerate().skip(offset).take(height) {
+            let line = format!("{} {}", if picked[i] { "[x]" } else { "[ ]" }, names[i]);
+            if row == cursor {
+                screen.push_str(&format!("\x1b[7m{}\x1b[0m", fit(&line, cols)));
+            } else {
+                screen.push_str(&fit(&line, cols));
+            }
+            screen.push_str("\r\n");
+        }
+        let mut stdout = io::stdout();
+        stdout.write_all(screen.trim_end_matches("\r\n").as_bytes())?;
+        stdout.flush()?;
+
+        match read_key()? {
+            Key::Down => cursor += 1,
+            Key::Up => cursor = cursor.saturating_sub(1),
+            Key::Char('\x03') | Key::Char('\x04') | Key::Escape => return Ok(vec![]),
+            Key::Char(' ') => {
+                if let Some(&i) = matches.get(cursor) {
+                    picked[i] = !picked[i];
+                }
+            }
+            Key::Char('\n') | Key::Char('\r') => {
+                if !picked.contains(&true) {
+                    match matches.get(cursor) {
+                        Some(&i) => picked[i] = true,
+                        None => continue,
+                    }
+                }
+                break;
+            }
+            Key::Char('\x7f') | Key::Char('\x08') => {
+                query.pop();
+                cursor = 0;
+            }
+            Key::Char(c) if !c.is_control() => {
+                query.push(c);
+                cursor = 0;
+            }
+            _ => {}
+        }
+    }
+
+    drop(terminal);
+    Ok(names
+        .iter()
+        .zip(picked)
+        .filter(|(_, p)| *p)
+        .map(|(n, _)| n.clone())
+        .collect())
+}
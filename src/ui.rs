@@ -0,0 +1,214 @@
+// ggl --- global git log
+// Copyright (C) 2022  Honza Pokorny <honza@pokorny.ca>
+
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//! The web front-end of `ggl serve` at /ui: a page with filters, and a
+//! script that fills it from the JSON API.
+
+/// The body of the page, after [`HTML_HEAD`](crate::output::HTML_HEAD).
+pub(crate) static PAGE: &str = "<style>
+#filters { margin-bottom: 2em; }
+.commit { cursor: pointer; }
+.commit:hover .subject { text-decoration: underline; }
+.meta { color: #666; }
+.diff { font-family: monospace; white-space: pre; margin-left: 0; overflow-x: auto; }
+.added { color: #080; }
+.deleted { color: #b00; }
+.error { color: #b00; }
+#pager a { margin-right: 1em; }
+</style>
+<form id=\"filters\">
+<select name=\"repo\"><option value=\"\">all repositories</option></select>
+<input name=\"author\" placeholder=\"author\">
+<input name=\"from\" type=\"date\">
+<input name=\"to\" type=\"date\">
+<input type=\"submit\" value=\"filter\">
+</form>
+<div id=\"main\"></div>
+<div id=\"pager\"></div>
+<script src=\"/ui.js\"></script>
+</body>
+</html>
+";
+
+/// Shown at /ui when the server only takes a token, which browsers can't
+/// send by themselves.  The token goes into a cookie, which the server takes
+/// in place of the Authorization header.
+pub(crate) static LOGIN: &str = "<form id=\"login\">
+<input name=\"token\" type=\"password\" placeholder=\"token\" autofocus>
+<input type=\"submit\" value=\"log in\">
+</form>
+<script>
+document.getElementById(\"login\").addEventListener(\"submit\", function (event) {
+  event.preventDefault();
+  var token = encodeURIComponent(event.target.token.value);
+  document.cookie = \"ggl_token=\" + token + \"; path=/; SameSite=Strict\";
+  location.reload();
+});
+</script>
+</body>
+</html>
+";
+
+/// Served at /ui.js.  The filters and the page are kept in the fragment of
+/// the URL, so that the back button works and views can be linked to.
+pub(crate) static SCRIPT: &str = r##""use strict";
+
+var PAGE_SIZE = 50;
+var FILTERS = ["repo", "author", "from", "to"];
+
+var form = document.getElementById("filters");
+var main = document.getElementById("main");
+var pager = document.getElementById("pager");
+
+function element(tag, className, text) {
+  var e = document.createElement(tag);
+  if (className) e.className = className;
+  if (text !== undefined) e.textContent = text;
+  return e;
+}
+
+function link(text, hash) {
+  var a = element("a", "", text);
+  a.href = "#" + hash;
+  return a;
+}
+
+function getJSON(url) {
+  return fetch(url).then(function (response) {
+    return response.json().then(function (json) {
+      if (!response.ok) throw new Error(json.error);
+      return json;
+    });
+  });
+}
+
+function showError(error) {
+  main.replaceChildren(element("p", "error", error.message));
+  pager.replaceChildren();
+}
+
+// "2022-12-01 10:32:07.0 +01:00:00" -> "2022-12-01 10:32"
+function shortDate(date) {
+  return date.slice(0, 16);
+}
+
+function fillForm(params) {
+  FILTERS.forEach(function (name) {
+    form.elements[name].value = params.get(name) || "";
+  });
+}
+
+function showList(params) {
+  fillForm(params);
+  var offset = parseInt(params.get("offset") || "0", 10);
+  params.set("limit", PAGE_SIZE);
+
+  getJSON("/commits?" + params).then(function (page) {
+    main.replaceChildren();
+    if (page.commits.length === 0) {
+      main.appendChild(element("p", "", "No commits."));
+    }
+    page.commits.forEach(function (commit) {
+      var div = element("div", "commit");
+      div.appendChild(element("div", "sha", commit.sha.slice(0, 10) + " " + commit.repo_name));
+      div.appendChild(element("div", "subject", commit.message.split("\n")[0]));
+      div.appendChild(element("div", "meta", commit.author + ", " + shortDate(commit.date)));
+      div.onclick = function () {
+        var detail = new URLSearchParams({ repo: commit.repo_name, sha: commit.sha });
+        location.hash = "commit?" + detail;
+      };
+      main.appendChild(div);
+    });
+
+    pager.replaceChildren();
+    var at = function (offset) {
+      params.set("offset", offset);
+      params.delete("limit");
+      return "?" + params;
+    };
+    if (offset > 0) {
+      pager.appendChild(link("newer", at(Math.max(0, offset - PAGE_SIZE))));
+    }
+    if (offset + PAGE_SIZE < page.total) {
+      pager.appendChild(link("older", at(offset + PAGE_SIZE)));
+    }
+    var last = Math.min(page.total, offset + PAGE_SIZE);
+    pager.appendChild(element("span", "meta",
+      (page.total ? offset + 1 : 0) + "-" + last + " of " + page.total));
+  }).catch(showError);
+}
+
+function showCommit(params) {
+  getJSON("/commit?" + params).then(function (detail) {
+    var commit = detail.commit;
+    main.replaceChildren();
+    main.appendChild(link("back", "")).onclick = function (event) {
+      event.preventDefault();
+      history.back();
+    };
+    var sha = element("div", "sha", "commit " + commit.sha);
+    if (commit.url) {
+      sha.replaceChildren("commit ", element("a", "", commit.sha));
+      sha.lastChild.href = commit.url;
+    }
+    main.appendChild(sha);
+    main.appendChild(element("div", "", "Repo:   " + commit.repo_name));
+    main.appendChild(element("div", "", "Author: " + commit.author + " <" + commit.email + ">"));
+    main.appendChild(element("div", "", "Date:   " + commit.date));
+    main.appendChild(element("pre", "", commit.message));
+
+    var diff = element("pre", "diff");
+    detail.diff.forEach(function (line) {
+      var className = { "+": "added", "-": "deleted" }[line[0]] || "";
+      diff.appendChild(element("div", className, line));
+    });
+    main.appendChild(diff);
+    pager.replaceChildren();
+  }).catch(showError);
+}
+
+function route() {
+  var hash = location.hash.slice(1);
+  var i = hash.indexOf("?");
+  var view = i < 0 ? hash : hash.slice(0, i);
+  var params = new URLSearchParams(i < 0 ? "" : hash.slice(i + 1));
+
+  if (view === "commit") {
+    showCommit(params);
+  } else {
+    showList(params);
+  }
+}
+
+form.onsubmit = function (event) {
+  event.preventDefault();
+  var params = new URLSearchParams();
+  FILTERS.forEach(function (name) {
+    if (form.elements[name].value) params.set(name, form.elements[name].value);
+  });
+  location.hash = "?" + params;
+};
+
+getJSON("/repos").then(function (repos) {
+  var select = form.elements.repo;
+  repos.forEach(function (repo) {
+    select.appendChild(new Option(repo.name, repo.name));
+  });
+  route();
+}).catch(showError);
+
+window.addEventListener("hashchange", route);
+"##;